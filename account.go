@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"clipflow/auth"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ClaimAccountRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// AnonymousData counts what an anonymous session owns, so that logging in can
+// offer to bring it along into the account
+type AnonymousData struct {
+	Tasks          int   `json:"tasks"`
+	Assets         int   `json:"assets"`
+	RevokedAPIKeys int64 `json:"revoked_api_keys,omitempty"` // API keys of the anonymous user, revoked by the merge
+}
+
+// claimAccountHandler gives the caller's anonymous account a real email,
+// username and password, keeping its tasks and assets
+func claimAccountHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req ClaimAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := db.GetUserByID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+	if !user.IsAnonymous() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account is already registered"})
+		return
+	}
+
+	if existingUser, _ := db.GetUserByEmail(req.Email); existingUser != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User with this email already exists"})
+		return
+	}
+
+	passwordHash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+		return
+	}
+
+	user.Email = req.Email
+	user.Username = req.Username
+	user.PasswordHash = passwordHash
+	if err := db.ClaimUser(user); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: users.username") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+			return
+		}
+		slog.ErrorContext(c.Request.Context(), "Failed to claim account", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	// Sessions opened with the device token end; the account now needs its password
+	if err := db.RevokeUserSessions(user.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke anonymous sessions", "user_id", user.ID, "error", err)
+	}
+	clearDeviceCookie(c)
+
+	if err := sendVerificationEmail(c, user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to send verification email", "user_id", user.ID, "error", err)
+	}
+
+	tokens, err := startSession(c, user)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to start session", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Anonymous account claimed", "user_id", user.ID, "email", user.Email)
+	recordAudit(c, models.AuditEvent{
+		Action:     models.AuditRegister,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Details:    map[string]string{"email": user.Email, "via": "claim"},
+	})
+	c.JSON(http.StatusOK, LoginResponse{
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
+	})
+}
+
+// anonymousCaller returns the anonymous user behind a request's token or
+// device token, if there is one
+func anonymousCaller(c *gin.Context) *models.User {
+	var user *models.User
+	if userID, exists := c.Get("userID"); exists && userID != nil {
+		user, _ = db.GetUserByID(userID.(string))
+	} else {
+		user, _ = userFromDeviceToken(c)
+	}
+	if user == nil || !user.IsAnonymous() {
+		return nil
+	}
+	return user
+}
+
+// mergeAnonymousUser moves an anonymous user's tasks and assets into the
+// account that just logged in, revoking its API keys. When their files don't
+// fit in the account's storage quota nothing is moved, and the reason is
+// returned instead.
+func mergeAnonymousUser(c *gin.Context, anonymous *models.User, target *models.User) (*AnonymousData, string, error) {
+	tasks, assets, err := db.CountUserData(anonymous.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	size, err := db.GetStorageUsed(anonymous.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if size > 0 {
+		reason, err := storageQuotaExceeded(target.ID, size)
+		if err != nil {
+			return nil, "", err
+		}
+		if reason != "" {
+			slog.WarnContext(c.Request.Context(), "Merge refused by storage quota", "anonymous_user_id", anonymous.ID, "user_id", target.ID, "reason", reason)
+			return nil, fmt.Sprintf("The %s of files from before you logged in would exceed your storage quota, so they were not merged", formatBytes(size)), nil
+		}
+	}
+
+	revokedKeys, err := db.MergeUsers(anonymous.ID, target.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	clearDeviceCookie(c)
+	slog.InfoContext(c.Request.Context(), "Merged anonymous user", "anonymous_user_id", anonymous.ID, "user_id", target.ID, "tasks", tasks, "assets", assets, "revoked_api_keys", revokedKeys)
+	return &AnonymousData{Tasks: tasks, Assets: assets, RevokedAPIKeys: revokedKeys}, "", nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"clipflow/config"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminUserListResponse struct {
+	Users []*models.User `json:"users"`
+	Total int            `json:"total"`
+	Page  int            `json:"page"`
+	Limit int            `json:"limit"`
+}
+
+type AdminTaskListResponse struct {
+	Tasks []*models.Task `json:"tasks"`
+	Total int            `json:"total"`
+	Page  int            `json:"page"`
+	Limit int            `json:"limit"`
+}
+
+// AdminUserResponse is a user with a summary of what they own
+type AdminUserResponse struct {
+	*models.User
+	Tasks          int `json:"tasks"`
+	Assets         int `json:"assets"`
+	ActiveSessions int `json:"active_sessions"`
+}
+
+type UpdateUserRequest struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+// AdminQuotaResponse is the limits an admin has set for a user, alongside the
+// limits and usage that result
+type AdminQuotaResponse struct {
+	Override *models.QuotaOverride `json:"override"`
+	Usage    *UsageResponse        `json:"usage"`
+}
+
+type FailTaskRequest struct {
+	Message string `json:"message"`
+}
+
+// DiskUsage is how much space one storage directory takes up
+type DiskUsage struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	Files int    `json:"files"`
+}
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 200
+)
+
+// promoteAdmins gives the admin role to the configured emails, once each has
+// registered and verified its address
+func promoteAdmins() {
+	for _, email := range config.AppConfig.Security.AdminEmails {
+		promoted, err := db.PromoteVerifiedUser(email)
+		if err != nil {
+			slog.Error("Failed to promote admin", "email", email, "error", err)
+			continue
+		}
+		if promoted {
+			slog.Info("Promoted admin", "email", email)
+		}
+	}
+}
+
+// parsePage reads the page and limit query parameters, writing the error
+// response itself when they are invalid
+func parsePage(c *gin.Context, defaultLimit, maxLimit int) (page, limit int, ok bool) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive integer"})
+		return 0, 0, false
+	}
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultLimit)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return 0, 0, false
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return page, limit, true
+}
+
+// adminListUsersHandler lists users, optionally searching email and username
+// with ?q= and filtering by ?role= and ?disabled=
+func adminListUsersHandler(c *gin.Context) {
+	page, limit, ok := parsePage(c, defaultAdminPageSize, maxAdminPageSize)
+	if !ok {
+		return
+	}
+
+	filter := models.UserFilter{
+		Query:  c.Query("q"),
+		Role:   c.Query("role"),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	}
+	if disabled := c.Query("disabled"); disabled != "" {
+		value, err := strconv.ParseBool(disabled)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "disabled must be true or false"})
+			return
+		}
+		filter.Disabled = &value
+	}
+
+	users, total, err := db.SearchUsers(filter)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to search users", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, AdminUserListResponse{
+		Users: users,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	})
+}
+
+func adminGetUserHandler(c *gin.Context) {
+	user, err := db.GetUserByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	response := AdminUserResponse{User: user}
+	response.Tasks, response.Assets, err = db.CountUserData(user.ID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count user data", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	sessions, err := db.GetActiveSessionsByUserID(user.ID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch user sessions", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	response.ActiveSessions = len(sessions)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// adminUpdateUserHandler changes a user's role or disables the account.
+// Disabling signs the user out everywhere and stops their API keys working.
+func adminUpdateUserHandler(c *gin.Context) {
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := db.GetUserByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// Admins can't lock themselves out
+	if user.ID == c.GetString("userID") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't change your own role or disable your own account"})
+		return
+	}
+
+	if req.Role != nil {
+		if *req.Role != models.RoleUser && *req.Role != models.RoleAdmin {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "role must be user or admin"})
+			return
+		}
+		if err := db.SetUserRole(user.ID, *req.Role); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to set user role", "user_id", user.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Admin set user role", "admin_id", c.GetString("userID"), "user_id", user.ID, "role", *req.Role)
+		recordAudit(c, models.AuditEvent{Action: models.AuditAdminUserUpdate, TargetType: "user", TargetID: user.ID, Details: map[string]string{"role": *req.Role}})
+	}
+
+	if req.Disabled != nil {
+		if err := db.SetUserDisabled(user.ID, *req.Disabled); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to disable user", "user_id", user.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Admin set user disabled", "admin_id", c.GetString("userID"), "user_id", user.ID, "disabled", *req.Disabled)
+		recordAudit(c, models.AuditEvent{Action: models.AuditAdminUserUpdate, TargetType: "user", TargetID: user.ID, Details: map[string]string{"disabled": strconv.FormatBool(*req.Disabled)}})
+	}
+
+	user, err = db.GetUserByID(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+func adminGetQuotaHandler(c *gin.Context) {
+	user, err := db.GetUserByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	respondWithQuota(c, user.ID)
+}
+
+// adminUpdateQuotaHandler replaces the limits set for a user. Fields left out
+// or null fall back to the defaults, and 0 removes the limit.
+func adminUpdateQuotaHandler(c *gin.Context) {
+	var req models.QuotaOverride
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, value := range []*int64{req.StorageBytes, req.MaxOutputSeconds, req.MonthlyRenderMinutes} {
+		if value != nil && *value < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Quotas can't be negative"})
+			return
+		}
+	}
+
+	user, err := db.GetUserByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := db.SetQuotaOverride(user.ID, &req); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to set user quota", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		return
+	}
+	slog.InfoContext(c.Request.Context(), "Admin set user quota", "admin_id", c.GetString("userID"), "user_id", user.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditAdminQuotaUpdate, TargetType: "user", TargetID: user.ID, Details: quotaAuditDetails(&req)})
+
+	respondWithQuota(c, user.ID)
+}
+
+// quotaAuditDetails lists the limits an admin set, leaving out the defaults
+func quotaAuditDetails(override *models.QuotaOverride) map[string]string {
+	details := make(map[string]string)
+	for name, value := range map[string]*int64{
+		"storage_bytes":          override.StorageBytes,
+		"max_output_seconds":     override.MaxOutputSeconds,
+		"monthly_render_minutes": override.MonthlyRenderMinutes,
+	} {
+		if value != nil {
+			details[name] = strconv.FormatInt(*value, 10)
+		}
+	}
+	return details
+}
+
+func respondWithQuota(c *gin.Context, userID string) {
+	override, err := db.GetQuotaOverride(userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get user quota", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota"})
+		return
+	}
+	usage, err := getUsage(userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get user usage", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota"})
+		return
+	}
+	c.JSON(http.StatusOK, AdminQuotaResponse{Override: override, Usage: usage})
+}
+
+// adminListTasksHandler lists tasks of all users, filtered by ?status= and
+// ?user_id=
+func adminListTasksHandler(c *gin.Context) {
+	page, limit, ok := parsePage(c, defaultAdminPageSize, maxAdminPageSize)
+	if !ok {
+		return
+	}
+
+	tasks, total, err := db.ListTasks(models.TaskFilter{
+		Status: c.Query("status"),
+		UserID: c.Query("user_id"),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to list tasks", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
+		return
+	}
+
+	withTaskDownloadURLs(tasks...)
+	c.JSON(http.StatusOK, AdminTaskListResponse{
+		Tasks: tasks,
+		Total: total,
+		Page:  page,
+		Limit: limit,
+	})
+}
+
+func adminGetTaskHandler(c *gin.Context) {
+	task, err := db.GetTaskByID(c.Param("taskId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	withTaskDownloadURLs(task)
+	c.JSON(http.StatusOK, task)
+}
+
+// adminFailTaskHandler marks a task that is stuck pending or processing as
+// failed, e.g. after a crash left it behind, and stops processing it if it is
+// still running
+func adminFailTaskHandler(c *gin.Context) {
+	var req FailTaskRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Message == "" {
+		req.Message = "Cancelled by an administrator"
+	}
+
+	task, err := db.GetTaskByID(c.Param("taskId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return
+	}
+
+	failed, err := db.FailTask(task.ID, req.Message)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fail task", "task_id", task.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update task"})
+		return
+	}
+	if !failed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Task has already finished"})
+		return
+	}
+	if runningTasks.Cancel(task.ID) {
+		slog.InfoContext(c.Request.Context(), "Stopped processing of task", "task_id", task.ID)
+	}
+	slog.InfoContext(c.Request.Context(), "Admin force-failed task", "admin_id", c.GetString("userID"), "task_id", task.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditAdminTaskFail, TargetType: "task", TargetID: task.ID, Details: map[string]string{"message": req.Message}})
+
+	task, err = db.GetTaskByID(task.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch task"})
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// adminStatsHandler reports users, the task queue and disk usage
+func adminStatsHandler(c *gin.Context) {
+	queue, err := db.GetQueueStats()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get queue stats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats"})
+		return
+	}
+	users, anonymous, err := db.CountUsers()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count users", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats"})
+		return
+	}
+
+	fileConfig := config.AppConfig.File
+	disk := map[string]*DiskUsage{
+		"temp":     diskUsage(fileConfig.TempDir),
+		"database": diskUsage(config.AppConfig.Database.Path),
+	}
+	// Files in S3 don't take up local disk
+	if config.AppConfig.Storage.Backend != "s3" {
+		disk["uploads"] = diskUsage(fileConfig.UploadsDir)
+		disk["output"] = diskUsage(fileConfig.OutputDir)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": gin.H{"total": users, "anonymous": anonymous},
+		"queue": queue,
+		"disk":  disk,
+	})
+}
+
+// diskUsage adds up the sizes of the files under a path
+func diskUsage(path string) *DiskUsage {
+	usage := &DiskUsage{Path: path}
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				slog.Error("Failed to measure disk usage", "path", path, "error", err)
+			}
+			return nil
+		}
+		if entry.Type().IsRegular() {
+			if info, err := entry.Info(); err == nil {
+				usage.Bytes += info.Size()
+				usage.Files++
+			}
+		}
+		return nil
+	})
+	return usage
+}
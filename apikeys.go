@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type CreateAPIKeyRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Scopes    []string `json:"scopes"`     // Empty for full access
+	ExpiresIn int64    `json:"expires_in"` // Seconds until the key expires, 0 for never
+}
+
+const (
+	// apiKeyPrefix marks Clipflow keys so they're easy to spot in configs and logs
+	apiKeyPrefix = "cf_"
+	// apiKeyDisplayLength is how much of a key is kept to tell keys apart
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+)
+
+func createAPIKeyHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		valid := false
+		for _, known := range models.APIKeyScopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown scope %q, must be one of %s", scope, strings.Join(models.APIKeyScopes, ", "))})
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+	rawKey := apiKeyPrefix + token
+
+	key := &models.APIKey{
+		ID:        uuid.New().String(),
+		UserID:    userID.(string),
+		Name:      req.Name,
+		Prefix:    rawKey[:apiKeyDisplayLength],
+		KeyHash:   auth.HashOpaqueToken(rawKey),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := key.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+
+	if err := db.CreateAPIKey(key); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create API key", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Created API key", "key_id", key.ID, "prefix", key.Prefix, "user_id", userID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditAPIKeyCreate, TargetType: "api_key", TargetID: key.ID, Details: map[string]string{"name": key.Name, "scopes": strings.Join(key.Scopes, ",")}})
+	key.Key = rawKey
+	c.JSON(http.StatusCreated, key)
+}
+
+func listAPIKeysHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	keys, err := db.GetAPIKeysByUserID(userID.(string))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch API keys", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func revokeAPIKeyHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	key, err := db.GetAPIKeyByID(c.Param("id"))
+	if err != nil || key.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	if err := db.RevokeAPIKey(key.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke API key", "key_id", key.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditAPIKeyRevoke, TargetType: "api_key", TargetID: key.ID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RenameAssetRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type AssetListResponse struct {
+	Assets []*models.Asset `json:"assets"`
+	Total  int             `json:"total"`
+	Page   int             `json:"page"`
+	Limit  int             `json:"limit"`
+}
+
+const (
+	defaultAssetPageSize = 20
+	maxAssetPageSize     = 100
+)
+
+// getAccessibleAsset loads an asset and checks that the caller uploaded it or
+// has at least the given role in its workspace, writing the error response
+// itself when they don't
+func getAccessibleAsset(c *gin.Context, userID, role string) (*models.Asset, bool) {
+	asset, err := db.GetAssetByID(c.Param("id"))
+	if err != nil || asset.DeletedAt != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+		return nil, false
+	}
+	if !canAccess(userID, asset.UserID, asset.WorkspaceID, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return asset, true
+}
+
+func listAssetsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "page must be a positive integer"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultAssetPageSize)))
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+	if limit > maxAssetPageSize {
+		limit = maxAssetPageSize
+	}
+
+	assetType := c.Query("type")
+	switch assetType {
+	case "", "video", "audio", "image", "subtitle":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be one of video, audio, image or subtitle"})
+		return
+	}
+
+	var assets []*models.Asset
+	var total int
+	if workspaceID != "" {
+		assets, total, err = db.GetAssetsByWorkspaceID(workspaceID, assetType, limit, (page-1)*limit)
+	} else {
+		assets, total, err = db.GetAssetsByUserID(userID.(string), assetType, limit, (page-1)*limit)
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch assets", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch assets"})
+		return
+	}
+
+	withAssetDownloadURLs(assets...)
+	c.JSON(http.StatusOK, AssetListResponse{
+		Assets: assets,
+		Total:  total,
+		Page:   page,
+		Limit:  limit,
+	})
+}
+
+func renameAssetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req RenameAssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	asset, ok := getAccessibleAsset(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if err := db.RenameAsset(asset.ID, req.Name); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to rename asset", "asset_id", asset.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename asset"})
+		return
+	}
+	asset.Name = req.Name
+
+	withAssetDownloadURLs(asset)
+	c.JSON(http.StatusOK, asset)
+}
+
+func deleteAssetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	asset, ok := getAccessibleAsset(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	if err := db.TrashAsset(asset.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete asset", "asset_id", asset.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete asset"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditAssetDelete, TargetType: "asset", TargetID: asset.ID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Asset moved to the trash"})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditEventListResponse struct {
+	Events []*models.AuditEvent `json:"events"`
+	Total  int                  `json:"total"`
+	Page   int                  `json:"page"`
+	Limit  int                  `json:"limit"`
+}
+
+// recordAudit writes an audit event for the request. The actor defaults to the
+// signed in user, and requests made with an API key note which key. Failures
+// are logged but don't fail the request.
+func recordAudit(c *gin.Context, event models.AuditEvent) {
+	if event.ActorID == "" {
+		event.ActorID = c.GetString("userID")
+	}
+	if value, exists := c.Get("apiKey"); exists {
+		event.Details = withDetail(event.Details, "api_key_id", value.(*models.APIKey).ID)
+	}
+	event.IPAddress = c.ClientIP()
+	saveAuditEvent(&event)
+}
+
+// saveAuditEvent writes an audit event recorded outside a request handler
+func saveAuditEvent(event *models.AuditEvent) {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if err := db.CreateAuditEvent(event); err != nil {
+		slog.Error("Failed to record audit event", "action", event.Action, "actor_id", event.ActorID, "target_type", event.TargetType, "target_id", event.TargetID, "error", err)
+	}
+}
+
+func withDetail(details map[string]string, key, value string) map[string]string {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details[key] = value
+	return details
+}
+
+// adminListAuditHandler lists audit events, newest first, filtered by
+// ?actor_id=, ?action= (a trailing * matches a prefix, e.g. admin.*),
+// ?target_type=, ?target_id=, ?ip= and an RFC 3339 ?since= and ?until=.
+// ?format=csv downloads every matching event, oldest first, instead of a page.
+func adminListAuditHandler(c *gin.Context) {
+	filter := models.AuditFilter{
+		ActorID:    c.Query("actor_id"),
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+		IPAddress:  c.Query("ip"),
+	}
+	for _, bound := range []struct {
+		name  string
+		value **time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": bound.name + " must be an RFC 3339 time, e.g. 2024-01-31T00:00:00Z"})
+			return
+		}
+		// Times are stored in local time, so compare in it too
+		at = at.Local()
+		*bound.value = &at
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "csv":
+		exportAuditCSV(c, filter)
+		return
+	case "json":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	page, limit, ok := parsePage(c, defaultAdminPageSize, maxAdminPageSize)
+	if !ok {
+		return
+	}
+	filter.Limit = limit
+	filter.Offset = (page - 1) * limit
+
+	events, total, err := db.SearchAuditEvents(filter)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to search audit events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, AuditEventListResponse{
+		Events: events,
+		Total:  total,
+		Page:   page,
+		Limit:  limit,
+	})
+}
+
+// exportAuditCSV streams the matching audit events as a CSV download
+func exportAuditCSV(c *gin.Context, filter models.AuditFilter) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-%s.csv"`, time.Now().UTC().Format("20060102-150405")))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "created_at", "actor_id", "ip_address", "action", "target_type", "target_id", "details"})
+	err := db.EachAuditEvent(filter, func(event *models.AuditEvent) error {
+		var details string
+		if len(event.Details) > 0 {
+			encoded, err := json.Marshal(event.Details)
+			if err != nil {
+				return err
+			}
+			details = string(encoded)
+		}
+		return w.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			csvSafe(event.ActorID),
+			csvSafe(event.IPAddress),
+			csvSafe(event.Action),
+			csvSafe(event.TargetType),
+			csvSafe(event.TargetID),
+			csvSafe(details),
+		})
+	})
+	w.Flush()
+	if err == nil {
+		err = w.Error()
+	}
+	if err != nil {
+		// The status has been sent, so all that can be done is stop early
+		slog.ErrorContext(c.Request.Context(), "Failed to export audit events", "error", err)
+		return
+	}
+	slog.InfoContext(c.Request.Context(), "Admin exported audit events", "admin_id", c.GetString("userID"))
+}
+
+// csvSafe stops a value that starts like a formula, e.g. an asset named by a
+// user, from being run when the export is opened in a spreadsheet
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
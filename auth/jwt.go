@@ -10,9 +10,15 @@ import (
 
 var jwtSecret = []byte("your-super-secret-jwt-key-change-this-in-production")
 
+// accessTokenTTL is kept short; clients get new access tokens with their
+// session's refresh token
+var accessTokenTTL = 15 * time.Minute
+
 type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`
+	Role      string `json:"role"`
 	jwt.RegisteredClaims
 }
 
@@ -28,13 +34,30 @@ func CheckPassword(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateToken creates a new JWT token for a user
-func GenerateToken(userID, email string) (string, error) {
+// dummyPasswordHash stands in for accounts that don't exist or have no
+// password, so that rejecting them costs as much as a wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("clipflow-dummy-password"), bcrypt.DefaultCost)
+
+// CheckPasswordConstantTime is like CheckPassword, but takes as long when hash
+// is empty as when it is a real hash. Use it where timing must not reveal
+// whether an account exists.
+func CheckPasswordConstantTime(password, hash string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return false
+	}
+	return CheckPassword(password, hash)
+}
+
+// GenerateToken creates a new JWT access token for a user's session
+func GenerateToken(userID, email, role, sessionID string) (string, error) {
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
+		UserID:    userID,
+		Email:     email,
+		SessionID: sessionID,
+		Role:      role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // 24 hours
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
@@ -55,6 +78,10 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		// Tokens from before sessions existed can't be revoked
+		if claims.SessionID == "" {
+			return nil, errors.New("token has no session")
+		}
 		return claims, nil
 	}
 
@@ -65,3 +92,13 @@ func ValidateToken(tokenString string) (*Claims, error) {
 func SetJWTSecret(secret string) {
 	jwtSecret = []byte(secret)
 }
+
+// SetAccessTokenTTL sets how long access tokens are valid
+func SetAccessTokenTTL(ttl time.Duration) {
+	accessTokenTTL = ttl
+}
+
+// AccessTokenTTL returns how long access tokens are valid
+func AccessTokenTTL() time.Duration {
+	return accessTokenTTL
+}
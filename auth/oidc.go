@@ -0,0 +1,345 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// OIDCConfig describes an OpenID Connect provider and our client registration
+// with it
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// OIDCIdentity is who the provider says signed in
+type OIDCIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// OIDCProvider signs users in with the authorization code flow and PKCE,
+// using the endpoints and keys the issuer publishes
+type OIDCProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	issuer                string
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	mu            sync.Mutex
+	keys          map[string]interface{} // Signing keys by key ID
+	keysFetchedAt time.Time
+}
+
+// Don't refetch the JWKS for an unknown key ID more often than this, so that
+// forged tokens can't make us hammer the provider
+const jwksRefreshInterval = time.Minute
+
+// ID tokens may be signed with any of these; symmetric algorithms and "none"
+// are refused
+var idTokenSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// NewOIDCProvider fetches the issuer's discovery document
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	discoveryURL := strings.TrimSuffix(config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(config.IssuerURL, "/") {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, config.IssuerURL)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+
+	p.issuer = discovery.Issuer
+	p.authorizationEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURI = discovery.JWKSURI
+	return p, nil
+}
+
+// PKCEChallenge derives the S256 code challenge for a code verifier. Any
+// NewOpaqueToken value makes a good verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns where to send the browser to sign in. The provider sends
+// it back to redirectURI with a code and the state.
+func (p *OIDCProvider) AuthCodeURL(redirectURI, state, nonce, verifier string) string {
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", PKCEChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.authorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange trades an authorization code for tokens and returns the identity
+// in the verified ID token
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURI, code, verifier, nonce string) (*OIDCIdentity, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.config.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token response: %v", err)
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("invalid token response (status %d)", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("token request rejected: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// idTokenClaims are the ID token claims we use. Some providers send
+// email_verified as a string.
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	Name              string      `json:"name"`
+	PreferredUsername string      `json:"preferred_username"`
+	AuthorizedParty   string      `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+// VerifyIDToken checks an ID token's signature against the provider's keys,
+// and that it was issued by the provider, for us, for this login
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, rawToken, nonce string) (*OIDCIdentity, error) {
+	claims := &idTokenClaims{}
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenSigningMethods))
+	_, err := parser.ParseWithClaims(rawToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if claims.Issuer != p.issuer {
+		return nil, fmt.Errorf("ID token issued by %q, expected %q", claims.Issuer, p.issuer)
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("ID token is not for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, errors.New("ID token was issued to another party")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+	return &OIDCIdentity{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     verified,
+		Name:              claims.Name,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// signingKey returns the provider's key with the given ID, fetching the JWKS
+// when the key isn't known yet, as happens after the provider rotates keys
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. A token without a key ID is accepted only
+// when the provider has a single key.
+func (p *OIDCProvider) lookupKey(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *OIDCProvider) fetchKeys(ctx context.Context) (map[string]interface{}, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,25 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// NewOpaqueToken returns a random, URL-safe secret for handing to a client.
+// Only its hash (see HashOpaqueToken) should be stored.
+func NewOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashOpaqueToken hashes a token from NewOpaqueToken for storage and lookup.
+// The tokens are random enough that a fast hash is safe here, unlike passwords.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
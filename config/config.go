@@ -3,18 +3,29 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Security SecurityConfig
-	File     FileConfig
+	Server    ServerConfig
+	Database  DatabaseConfig
+	Security  SecurityConfig
+	File      FileConfig
+	Storage   StorageConfig
+	Mail      MailConfig
+	OIDC      OIDCConfig
+	RateLimit RateLimitConfig
+	Quota     QuotaConfig
+	Retention RetentionConfig
+	Log       LogConfig
 }
 
 type ServerConfig struct {
-	Port string
-	Host string
+	Port           string
+	Host           string
+	PublicURL      string   // Base URL for links in emails, e.g. "https://clipflow.example.com"
+	TrustedProxies []string // Proxies whose X-Forwarded-For is believed, as IPs or CIDRs
+	MetricsToken   string   // Bearer token /metrics requires; /metrics is off when empty
 }
 
 type DatabaseConfig struct {
@@ -25,14 +36,131 @@ type DatabaseConfig struct {
 type SecurityConfig struct {
 	JWTSecret     string
 	SessionSecret string
+
+	PublicDownloads   bool  // Serve /uploads and /output to anyone, as before signed URLs
+	DownloadURLExpiry int64 // Lifetime of signed download URLs in seconds
+
+	AccessTokenTTL  int64 // Lifetime of JWT access tokens in seconds
+	RefreshTokenTTL int64 // Lifetime of a session without use, in seconds
+
+	LoginFreeAttempts       int   // Failed logins per account allowed before backoff starts
+	LoginIPFreeAttempts     int   // Failed logins per IP address allowed before backoff starts
+	LoginBackoffBase        int64 // Wait after the first throttled failure in seconds, doubling with each one
+	LoginBackoffMax         int64 // Longest backoff wait in seconds
+	LoginLockoutThreshold   int   // Failed logins per account before it is locked
+	LoginIPLockoutThreshold int   // Failed logins per IP address before it is locked
+	LoginLockoutDuration    int64 // How long a lockout lasts in seconds
+	LoginAttemptWindow      int64 // Failures older than this many seconds are forgotten
+
+	AdminEmails []string // Users promoted to admin at startup, once their email is verified
+
+	WorkspaceInvitationTTL int64 // Lifetime of workspace invitations in seconds
 }
 
 type FileConfig struct {
 	TempDir    string
 	OutputDir  string
 	UploadsDir string
-	MaxSize    int64
+	MaxSize    int64 // Hard cap for any single upload
 	YTDLPPath  string
+
+	ImportTimeout         int64    // Longest a URL import may take to download, in seconds
+	ImportAllowedNetworks []string // CIDRs imports may fetch from even though they are private, e.g. for tests
+
+	// Per-type upload limits, each capped by MaxSize
+	MaxVideoSize    int64
+	MaxAudioSize    int64
+	MaxImageSize    int64
+	MaxSubtitleSize int64
+
+	// Allowed upload extensions per type
+	AllowedVideoFormats    []string
+	AllowedAudioFormats    []string
+	AllowedImageFormats    []string
+	AllowedSubtitleFormats []string
+}
+
+type StorageConfig struct {
+	Backend        string // "local" or "s3"
+	ProxyDownloads bool   // Stream S3 downloads through the server instead of redirecting to presigned URLs
+	URLExpiry      int64  // Lifetime of presigned download URLs in seconds
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3PathStyle bool
+}
+
+type MailConfig struct {
+	Backend string // "log", "file" or "smtp"
+	From    string
+	FileDir string // Where the file backend writes .eml files
+
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+
+	PasswordResetTTL     int64 // Lifetime of password reset links in seconds
+	EmailVerificationTTL int64 // Lifetime of email verification links in seconds
+}
+
+// OIDCConfig enables signing in through an OpenID Connect provider when
+// IssuerURL is set
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Defaults to PUBLIC_URL + "/api/auth/oidc/callback"
+	Scopes       []string
+	ProviderName string // Shown on the sign-in button
+}
+
+// RateLimitRule allows Requests requests per Window seconds, all of which can
+// be used at once. Zero requests turns the limit off.
+type RateLimitRule struct {
+	Requests int
+	Window   int64
+}
+
+type RateLimitConfig struct {
+	Auth   RateLimitRule // Registration, sign-in and anonymous sessions, per IP address
+	API    RateLimitRule // Every other API call, per user or API key
+	Upload RateLimitRule // Starting an upload
+	Render RateLimitRule // Starting a render or import
+
+	MaxActiveTasks int // Pending or processing tasks a user can have at once, 0 for no limit
+}
+
+// QuotaConfig holds the default per-user limits, which admins can override
+// for individual users. Zero means no limit.
+type QuotaConfig struct {
+	StorageBytes         int64 // Uploaded assets plus rendered outputs
+	MaxOutputSeconds     int64 // Longest video a single render can produce
+	MonthlyRenderMinutes int64 // Minutes of output rendered per calendar month
+}
+
+// RetentionConfig controls the janitor that deletes old files. Retention
+// periods are in seconds, and 0 keeps files forever.
+type RetentionConfig struct {
+	Interval int64 // Seconds between janitor runs, 0 to turn it off
+	DryRun   bool  // Only log what would be deleted
+
+	AnonymousOutputs int64 // Finished tasks of anonymous users, with their output
+	AnonymousUploads int64 // Assets of anonymous users
+	Outputs          int64 // Finished tasks of registered users, with their output
+	Uploads          int64 // Assets of registered users
+	Trash            int64 // Deleted tasks and assets, until the trash is emptied
+	Temp             int64 // Leftover task directories and abandoned resumable uploads
+	Orphans          int64 // Files in upload or output storage that no asset or task refers to, off by default
+	LoginRecords     int64 // Failed login records, used or expired email tokens and ended sessions
+}
+
+type LogConfig struct {
+	Level  string // debug, info, warn or error
+	Format string // text or json
 }
 
 var AppConfig *Config
@@ -40,8 +168,12 @@ var AppConfig *Config
 func LoadConfig() error {
 	AppConfig = &Config{
 		Server: ServerConfig{
-			Port: getEnv("PORT", "8080"),
-			Host: getEnv("HOST", "localhost"),
+			Port:      getEnv("PORT", "8080"),
+			Host:      getEnv("HOST", "localhost"),
+			PublicURL: strings.TrimSuffix(getEnv("PUBLIC_URL", ""), "/"),
+
+			TrustedProxies: getEnvAsSlice("TRUSTED_PROXIES", nil),
+			MetricsToken:   getEnv("METRICS_TOKEN", ""),
 		},
 		Database: DatabaseConfig{
 			Type: getEnv("DB_TYPE", "sqlite"),
@@ -50,6 +182,25 @@ func LoadConfig() error {
 		Security: SecurityConfig{
 			JWTSecret:     getEnv("JWT_SECRET", "your-super-secret-jwt-key-change-this-in-production"),
 			SessionSecret: getEnv("SESSION_SECRET", "your-session-secret-change-this-in-production"),
+
+			PublicDownloads:   getEnvAsBool("PUBLIC_DOWNLOADS", false),
+			DownloadURLExpiry: getEnvAsInt64("DOWNLOAD_URL_EXPIRY", 3600), // 1 hour
+
+			AccessTokenTTL:  getEnvAsInt64("ACCESS_TOKEN_TTL", 15*60),        // 15 minutes
+			RefreshTokenTTL: getEnvAsInt64("REFRESH_TOKEN_TTL", 30*24*60*60), // 30 days
+
+			LoginFreeAttempts:       getEnvAsInt("LOGIN_FREE_ATTEMPTS", 3),
+			LoginIPFreeAttempts:     getEnvAsInt("LOGIN_IP_FREE_ATTEMPTS", 10),
+			LoginBackoffBase:        getEnvAsInt64("LOGIN_BACKOFF_BASE", 1),
+			LoginBackoffMax:         getEnvAsInt64("LOGIN_BACKOFF_MAX", 5*60), // 5 minutes
+			LoginLockoutThreshold:   getEnvAsInt("LOGIN_LOCKOUT_THRESHOLD", 10),
+			LoginIPLockoutThreshold: getEnvAsInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50),
+			LoginLockoutDuration:    getEnvAsInt64("LOGIN_LOCKOUT_DURATION", 15*60), // 15 minutes
+			LoginAttemptWindow:      getEnvAsInt64("LOGIN_ATTEMPT_WINDOW", 60*60),   // 1 hour
+
+			AdminEmails: getEnvAsSlice("ADMIN_EMAILS", nil),
+
+			WorkspaceInvitationTTL: getEnvAsInt64("WORKSPACE_INVITATION_TTL", 7*24*60*60), // 7 days
 		},
 		File: FileConfig{
 			TempDir:    getEnv("TEMP_DIR", "./temp"),
@@ -57,6 +208,82 @@ func LoadConfig() error {
 			UploadsDir: getEnv("UPLOADS_DIR", "./uploads"),
 			MaxSize:    getEnvAsInt64("MAX_FILE_SIZE", 100*1024*1024), // 100MB default
 			YTDLPPath:  getEnv("YTDLP_PATH", "yt-dlp"),                // Default to "yt-dlp" if not specified
+
+			ImportTimeout:         getEnvAsInt64("IMPORT_TIMEOUT", 10*60), // 10 minutes
+			ImportAllowedNetworks: getEnvAsSlice("IMPORT_ALLOWED_NETWORKS", nil),
+
+			MaxVideoSize:    getEnvAsInt64("MAX_VIDEO_SIZE", 100*1024*1024), // 100MB
+			MaxAudioSize:    getEnvAsInt64("MAX_AUDIO_SIZE", 20*1024*1024),  // 20MB
+			MaxImageSize:    getEnvAsInt64("MAX_IMAGE_SIZE", 10*1024*1024),  // 10MB
+			MaxSubtitleSize: getEnvAsInt64("MAX_SUBTITLE_SIZE", 1024*1024),  // 1MB
+
+			AllowedVideoFormats:    getEnvAsSlice("ALLOWED_VIDEO_FORMATS", []string{".mp4", ".avi", ".mov", ".wmv", ".flv", ".webm", ".mkv", ".m4v"}),
+			AllowedAudioFormats:    getEnvAsSlice("ALLOWED_AUDIO_FORMATS", []string{".mp3", ".wav", ".aac", ".ogg", ".flac", ".m4a", ".opus"}),
+			AllowedImageFormats:    getEnvAsSlice("ALLOWED_IMAGE_FORMATS", []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}),
+			AllowedSubtitleFormats: getEnvAsSlice("ALLOWED_SUBTITLE_FORMATS", []string{".srt", ".vtt", ".ass", ".ssa"}),
+		},
+		Storage: StorageConfig{
+			Backend:        getEnv("STORAGE_BACKEND", "local"),
+			ProxyDownloads: getEnvAsBool("STORAGE_PROXY_DOWNLOADS", false),
+			URLExpiry:      getEnvAsInt64("STORAGE_URL_EXPIRY", 3600), // 1 hour
+
+			S3Endpoint:  getEnv("S3_ENDPOINT", ""),
+			S3Region:    getEnv("S3_REGION", "us-east-1"),
+			S3Bucket:    getEnv("S3_BUCKET", ""),
+			S3AccessKey: getEnv("S3_ACCESS_KEY", ""),
+			S3SecretKey: getEnv("S3_SECRET_KEY", ""),
+			S3PathStyle: getEnvAsBool("S3_PATH_STYLE", false),
+		},
+		Mail: MailConfig{
+			Backend: getEnv("MAIL_BACKEND", "log"),
+			From:    getEnv("MAIL_FROM", "Clipflow <no-reply@clipflow.local>"),
+			FileDir: getEnv("MAIL_FILE_DIR", "./temp/mail"),
+
+			SMTPHost:     getEnv("SMTP_HOST", ""),
+			SMTPPort:     getEnv("SMTP_PORT", "587"),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+
+			PasswordResetTTL:     getEnvAsInt64("PASSWORD_RESET_TTL", 60*60),          // 1 hour
+			EmailVerificationTTL: getEnvAsInt64("EMAIL_VERIFICATION_TTL", 7*24*60*60), // 7 days
+		},
+		OIDC: OIDCConfig{
+			IssuerURL:    getEnv("OIDC_ISSUER_URL", ""),
+			ClientID:     getEnv("OIDC_CLIENT_ID", ""),
+			ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  getEnv("OIDC_REDIRECT_URL", ""),
+			Scopes:       getEnvAsSlice("OIDC_SCOPES", []string{"openid", "email", "profile"}),
+			ProviderName: getEnv("OIDC_PROVIDER_NAME", "SSO"),
+		},
+		RateLimit: RateLimitConfig{
+			Auth:   getRateLimit("AUTH", 20, 60),
+			API:    getRateLimit("API", 300, 60),
+			Upload: getRateLimit("UPLOAD", 30, 60),
+			Render: getRateLimit("RENDER", 10, 60),
+
+			MaxActiveTasks: getEnvAsInt("MAX_ACTIVE_TASKS", 3),
+		},
+		Quota: QuotaConfig{
+			StorageBytes:         getEnvAsInt64("QUOTA_STORAGE_BYTES", 5*1024*1024*1024), // 5GB
+			MaxOutputSeconds:     getEnvAsInt64("QUOTA_MAX_OUTPUT_SECONDS", 30*60),       // 30 minutes
+			MonthlyRenderMinutes: getEnvAsInt64("QUOTA_RENDER_MINUTES", 300),             // 5 hours
+		},
+		Retention: RetentionConfig{
+			Interval: getEnvAsInt64("JANITOR_INTERVAL", 60*60), // 1 hour
+			DryRun:   getEnvAsBool("JANITOR_DRY_RUN", false),
+
+			AnonymousOutputs: getEnvAsInt64("RETENTION_ANONYMOUS_OUTPUTS", 7*24*60*60), // 7 days
+			AnonymousUploads: getEnvAsInt64("RETENTION_ANONYMOUS_UPLOADS", 7*24*60*60), // 7 days
+			Outputs:          getEnvAsInt64("RETENTION_OUTPUTS", 0),
+			Uploads:          getEnvAsInt64("RETENTION_UPLOADS", 0),
+			Trash:            getEnvAsInt64("RETENTION_TRASH", 30*24*60*60),         // 30 days
+			Temp:             getEnvAsInt64("RETENTION_TEMP", 24*60*60),             // 1 day
+			Orphans:          getEnvAsInt64("RETENTION_ORPHANS", 0),                 // Off until files from before the asset library are accounted for
+			LoginRecords:     getEnvAsInt64("RETENTION_LOGIN_RECORDS", 90*24*60*60), // 90 days
+		},
+		Log: LogConfig{
+			Level:  getEnv("LOG_LEVEL", "info"),
+			Format: getEnv("LOG_FORMAT", "text"),
 		},
 	}
 
@@ -79,6 +306,31 @@ func getEnvAsInt64(key string, defaultValue int64) int64 {
 	return defaultValue
 }
 
+// getEnvAsSlice reads a comma-separated list, e.g. ".mp4,.mov"
+func getEnvAsSlice(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			return items
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
 func getEnvAsInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
@@ -87,3 +339,12 @@ func getEnvAsInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// getRateLimit reads RATE_LIMIT_<NAME> requests per RATE_LIMIT_<NAME>_WINDOW
+// seconds
+func getRateLimit(name string, requests int, window int64) RateLimitRule {
+	return RateLimitRule{
+		Requests: getEnvAsInt("RATE_LIMIT_"+name, requests),
+		Window:   getEnvAsInt64("RATE_LIMIT_"+name+"_WINDOW", window),
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// deviceCookieName holds the device token in browsers; other clients send
+	// it in the deviceTokenHeader instead
+	deviceCookieName  = "clipflow_device"
+	deviceTokenHeader = "X-Device-Token"
+	deviceCookieAge   = 365 * 24 * 60 * 60 // 1 year, in seconds
+)
+
+// deviceTokenFromRequest returns the device token sent with a request, if any
+func deviceTokenFromRequest(c *gin.Context) string {
+	if token := c.GetHeader(deviceTokenHeader); token != "" {
+		return token
+	}
+	token, _ := c.Cookie(deviceCookieName)
+	return token
+}
+
+// setDeviceCookie stores a device token in an HttpOnly cookie so the browser
+// can get back into its anonymous account
+func setDeviceCookie(c *gin.Context, token string) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(deviceCookieName, token, deviceCookieAge, "/", "", c.Request.TLS != nil, true)
+}
+
+// clearDeviceCookie removes the device cookie once it no longer identifies
+// an anonymous account
+func clearDeviceCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(deviceCookieName, "", -1, "/", "", c.Request.TLS != nil, true)
+}
+
+// userFromDeviceToken finds the anonymous user a request's device token
+// belongs to
+func userFromDeviceToken(c *gin.Context) (*models.User, error) {
+	token := deviceTokenFromRequest(c)
+	if token == "" {
+		return nil, fmt.Errorf("no device token")
+	}
+	return db.GetUserByDeviceToken(auth.HashOpaqueToken(token))
+}
+
+// createAnonymousUser creates a user without credentials, bound to a new
+// device token that the caller must hand to the client
+func createAnonymousUser() (*models.User, string, error) {
+	deviceToken, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, "", err
+	}
+	user := &models.User{
+		ID:              uuid.New().String(),
+		Email:           fmt.Sprintf("anonymous_%s@clipflow.local", uuid.New().String()[:8]),
+		Username:        fmt.Sprintf("Anonymous_%s", uuid.New().String()[:8]),
+		PasswordHash:    "",
+		DeviceTokenHash: auth.HashOpaqueToken(deviceToken),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+	if err := db.CreateUser(user); err != nil {
+		return nil, "", err
+	}
+	return user, deviceToken, nil
+}
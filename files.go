@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/config"
+	"clipflow/models"
+	"clipflow/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Storage for uploaded assets and rendered outputs
+var (
+	uploadStore storage.Storage
+	outputStore storage.Storage
+)
+
+// newStorage creates the configured storage backend for one kind of file. On
+// the local filesystem each kind gets its own directory; on S3 they share a
+// bucket under different key prefixes.
+func newStorage(localDir, prefix string) (storage.Storage, error) {
+	storageConfig := config.AppConfig.Storage
+	switch storageConfig.Backend {
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  storageConfig.S3Endpoint,
+			Region:    storageConfig.S3Region,
+			Bucket:    storageConfig.S3Bucket,
+			AccessKey: storageConfig.S3AccessKey,
+			SecretKey: storageConfig.S3SecretKey,
+			Prefix:    prefix,
+			PathStyle: storageConfig.S3PathStyle,
+		})
+	case "local", "":
+		return storage.NewLocal(localDir)
+	}
+	return nil, errors.New("unknown storage backend: " + storageConfig.Backend)
+}
+
+// storedFile describes a file being downloaded: who owns it and what to call
+// it on the user's disk
+type storedFile struct {
+	ownerID     string
+	workspaceID string
+	filename    string
+}
+
+// lookupUpload finds the asset an /uploads file belongs to
+func lookupUpload(key string) (*storedFile, error) {
+	asset, err := db.GetAssetByURL("/uploads/" + key)
+	if err != nil {
+		return nil, err
+	}
+	if asset.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return &storedFile{ownerID: asset.UserID, workspaceID: asset.WorkspaceID, filename: asset.Name}, nil
+}
+
+// lookupOutput finds the task an /output file was rendered by
+func lookupOutput(key string) (*storedFile, error) {
+	task, err := db.GetTaskByOutputFile("/output/" + key)
+	if err != nil {
+		return nil, err
+	}
+	if task.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	filename := fmt.Sprintf("clipflow_%s%s", task.CreatedAt.Format("20060102_150405"), path.Ext(key))
+	return &storedFile{ownerID: task.UserID, workspaceID: task.WorkspaceID, filename: filename}, nil
+}
+
+// signedDownloadURL returns a link to a stored file that works without auth
+// headers, so it can be used directly in <a> and <video> tags. inlineOnly
+// links can only play the file, not save it with download=1.
+func signedDownloadURL(fileURL string, inlineOnly bool) string {
+	if fileURL == "" || config.AppConfig.Security.PublicDownloads {
+		return fileURL
+	}
+	expiry := time.Duration(config.AppConfig.Security.DownloadURLExpiry) * time.Second
+	return auth.SignDownloadURL(fileURL, expiry, inlineOnly)
+}
+
+// withTaskDownloadURLs fills in DownloadURL for tasks with an output file
+func withTaskDownloadURLs(tasks ...*models.Task) {
+	for _, task := range tasks {
+		task.DownloadURL = signedDownloadURL(task.OutputFile, false)
+	}
+}
+
+// withAssetDownloadURLs fills in DownloadURL for assets
+func withAssetDownloadURLs(assets ...*models.Asset) {
+	for _, asset := range assets {
+		asset.DownloadURL = signedDownloadURL(asset.URL, false)
+	}
+}
+
+// serveStoredFile serves files from storage to their owner, members of their
+// workspace or anyone with a valid signed link, unless public downloads are
+// enabled. Backends that support presigned URLs redirect the client there
+// unless downloads are configured to be proxied; everything else is streamed
+// through the server with Range support. Add ?download=1 to save the file instead of playing it,
+// which links signed as inline only refuse.
+func serveStoredFile(store storage.Storage, lookup func(key string) (*storedFile, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("filepath"), "/")
+		ctx := c.Request.Context()
+
+		file, err := lookup(key)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				slog.ErrorContext(ctx, "Failed to look up file owner", "path", c.Request.URL.Path, "error", err)
+			}
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		if !config.AppConfig.Security.PublicDownloads {
+			if sig := c.Query("sig"); sig != "" {
+				if !auth.VerifyDownloadSignature(c.Request.URL.Path, c.Query("expires"), c.Query("disposition"), sig) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired download link"})
+					return
+				}
+				if c.Query("disposition") == auth.DispositionInline && c.Query("download") != "" {
+					c.JSON(http.StatusForbidden, gin.H{"error": "This link does not allow downloading the file"})
+					return
+				}
+			} else {
+				userID, exists := c.Get("userID")
+				if !exists || userID == nil {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: sign in or use a signed download link"})
+					return
+				}
+				if !canAccess(userID.(string), file.ownerID, file.workspaceID, models.WorkspaceViewer) {
+					c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+					return
+				}
+			}
+			c.Header("Cache-Control", "private")
+		}
+
+		dispositionType := "inline"
+		if c.Query("download") != "" {
+			dispositionType = "attachment"
+		}
+		disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": file.filename})
+
+		if !config.AppConfig.Storage.ProxyDownloads {
+			expiry := time.Duration(config.AppConfig.Storage.URLExpiry) * time.Second
+			url, err := store.PresignGet(ctx, key, expiry, disposition)
+			if err == nil {
+				c.Redirect(http.StatusFound, url)
+				return
+			}
+			if !errors.Is(err, storage.ErrPresignNotSupported) {
+				slog.ErrorContext(ctx, "Failed to presign download", "key", key, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare download"})
+				return
+			}
+		}
+
+		content, info, err := store.Get(ctx, key)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			slog.ErrorContext(ctx, "Failed to open file from storage", "key", key, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer content.Close()
+
+		if disposition != "" {
+			c.Header("Content-Disposition", disposition)
+		}
+		http.ServeContent(c.Writer, c.Request, path.Base(key), info.ModTime, content)
+	}
+}
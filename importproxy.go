@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// importProxy is an HTTP proxy on the loopback interface that yt-dlp is told
+// to use with --proxy. yt-dlp does its own fetching and follows redirects, so
+// checking the import URL's host up front isn't enough; going through the
+// proxy puts every connection it makes through importAddressAllowed, the same
+// as direct downloads.
+type importProxy struct {
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	transport *http.Transport
+	url       string
+}
+
+// startImportProxy listens on a random loopback port and serves the proxy
+// until the process exits
+func startImportProxy(dial func(ctx context.Context, network, address string) (net.Conn, error)) (*importProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &importProxy{
+		dial: dial,
+		transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dial,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		url: "http://" + listener.Addr().String(),
+	}
+	server := &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			slog.Error("Import proxy stopped", "error", err)
+		}
+	}()
+	return p, nil
+}
+
+func (p *importProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests are accepted", http.StatusBadRequest)
+		return
+	}
+
+	outgoing := r.Clone(r.Context())
+	outgoing.RequestURI = ""
+	for _, header := range hopByHopHeaders {
+		outgoing.Header.Del(header)
+	}
+	response, err := p.transport.RoundTrip(outgoing)
+	if err != nil {
+		p.refuse(w, r, err)
+		return
+	}
+	defer response.Body.Close()
+
+	for _, header := range hopByHopHeaders {
+		response.Header.Del(header)
+	}
+	for key, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// tunnel connects a CONNECT request, used for HTTPS, to its destination
+func (p *importProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.refuse(w, r, err)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Anything the client sent after the CONNECT line is already buffered
+		io.Copy(upstream, buffered)
+		if conn, ok := upstream.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		if conn, ok := client.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+}
+
+// refuse answers 403 for blocked addresses and 502 for anything else that
+// kept the proxy from reaching the destination
+func (p *importProxy) refuse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errBlockedAddress) {
+		slog.Warn("Import proxy refused a private address", "host", r.Host, "error", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// hopByHopHeaders only apply to one connection, so a proxy doesn't pass them on
+var hopByHopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"clipflow/config"
+	"clipflow/logging"
+	"clipflow/models"
+	"clipflow/storage"
+	"clipflow/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ImportAssetRequest struct {
+	URL  string `json:"url" binding:"required"`
+	Name string `json:"name"` // Optional display name for the new asset
+}
+
+// errNotDirectMedia means a URL points at a web page rather than a media file,
+// so it has to go through yt-dlp instead
+var errNotDirectMedia = errors.New("URL is not a direct media link")
+
+// ytdlpProgressPattern matches yt-dlp's "[download]  42.3% of ..." progress lines
+var ytdlpProgressPattern = regexp.MustCompile(`\[download\]\s+([\d.]+)%`)
+
+// errBlockedAddress means an import URL resolved to an address the server
+// won't fetch from, such as its own loopback or private network
+var errBlockedAddress = errors.New("URL points to a private or local address")
+
+var (
+	// importClient downloads direct media links for imports
+	importClient *http.Client
+	// importAllowedNetworks are exempt from the address check, see
+	// IMPORT_ALLOWED_NETWORKS
+	importAllowedNetworks []*net.IPNet
+	// importProxyURL is the proxy yt-dlp fetches through
+	importProxyURL string
+)
+
+// setupImports builds the HTTP client imports download with, and the proxy
+// yt-dlp is run behind. Both only connect to public addresses, checked on the
+// resolved address of every connection, redirects included, so an import
+// can't be used to reach the server's own network or cloud metadata endpoints.
+func setupImports() error {
+	importAllowedNetworks = nil
+	for _, cidr := range config.AppConfig.File.ImportAllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %v", cidr, err)
+		}
+		importAllowedNetworks = append(importAllowedNetworks, network)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !importAddressAllowed(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+	importClient = &http.Client{
+		Timeout: importTimeout(),
+		Transport: &http.Transport{
+			// Connect directly, so the address check sees the real destination
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+
+	proxy, err := startImportProxy(dialer.DialContext)
+	if err != nil {
+		return fmt.Errorf("failed to start import proxy: %v", err)
+	}
+	importProxyURL = proxy.url
+	return nil
+}
+
+func importTimeout() time.Duration {
+	return time.Duration(config.AppConfig.File.ImportTimeout) * time.Second
+}
+
+// importAddressAllowed reports whether imports may connect to ip
+func importAddressAllowed(ip net.IP) bool {
+	for _, network := range importAllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkImportHost resolves the host of an import URL and refuses it if any of
+// its addresses is blocked, so obviously bad URLs fail before a task is
+// created. Downloads are checked again on every connection they make.
+func checkImportHost(ctx context.Context, host string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", host)
+	}
+	for _, address := range addresses {
+		if !importAddressAllowed(address.IP) {
+			return errBlockedAddress
+		}
+	}
+	return nil
+}
+
+func importAssetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req ImportAssetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	parsed, err := url.Parse(req.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an http or https URL"})
+		return
+	}
+	if err := checkImportHost(c.Request.Context(), parsed.Hostname()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !checkStorageQuota(c, userID.(string), 0) {
+		return
+	}
+
+	unlock := taskLocks.Lock(userID.(string))
+	defer unlock()
+	if !checkActiveTaskLimit(c, userID.(string)) {
+		return
+	}
+
+	taskID := uuid.New().String()
+	taskDetailsJSON, err := json.Marshal(map[string]interface{}{
+		"url":  req.URL,
+		"name": req.Name,
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to marshal task details", "task_id", taskID, "error", err)
+	}
+
+	task := &models.Task{
+		ID:          taskID,
+		UserID:      userID.(string),
+		WorkspaceID: workspaceID,
+		Type:        "import",
+		Status:      "pending",
+		Progress:    0,
+		Message:     "Import created, preparing to download",
+		TaskDetails: string(taskDetailsJSON),
+		CreatedAt:   time.Now(),
+	}
+
+	if err := db.CreateTask(task); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create import task", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Created import task", "task_id", taskID, "user_id", userID, "url", req.URL)
+	recordAudit(c, models.AuditEvent{Action: models.AuditTaskCreate, TargetType: "task", TargetID: taskID, Details: map[string]string{"type": "import", "url": req.URL}})
+
+	go processImportRequest(context.WithoutCancel(c.Request.Context()), taskID, req)
+
+	c.JSON(http.StatusOK, TaskResponse{
+		TaskID:  taskID,
+		Status:  "pending",
+		Message: "Import task created successfully",
+	})
+}
+
+// processImportRequest downloads the media behind an import task's URL into
+// the asset library, logging with ctx like processVideoRequest
+func processImportRequest(ctx context.Context, taskID string, req ImportAssetRequest) {
+	ctx = logging.With(ctx, "task_id", taskID)
+	ctx, done := runningTasks.Start(ctx, taskID)
+	defer done()
+	slog.InfoContext(ctx, "Starting import", "url", req.URL)
+
+	task, err := db.GetTaskByID(taskID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get task", "error", err)
+		return
+	}
+
+	fail := func(message string) {
+		slog.ErrorContext(ctx, "Import failed", "reason", message)
+		task.Status = "failed"
+		task.Message = message
+		if err := db.UpdateTask(task); err != nil {
+			slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
+		}
+	}
+
+	task.Status = "processing"
+	task.Message = "Downloading media"
+	task.Progress = 5
+	if err := db.UpdateTask(task); errors.Is(err, models.ErrTaskFinished) {
+		slog.InfoContext(ctx, "Task was stopped before it started")
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to update task status", "error", err)
+	}
+
+	taskDir := filepath.Join(config.AppConfig.File.TempDir, taskID)
+	os.MkdirAll(taskDir, 0755)
+	defer os.RemoveAll(taskDir)
+
+	// Map download progress onto 5-90%, leaving the rest for validation
+	reportProgress := func(percent float64) {
+		progress := 5 + int(percent*0.85)
+		if progress <= task.Progress || progress > 90 {
+			return
+		}
+		task.Progress = progress
+		if err := db.UpdateTask(task); err != nil {
+			slog.ErrorContext(ctx, "Failed to update task progress", "error", err)
+		}
+	}
+
+	filePath, name, err := downloadDirectMedia(ctx, req.URL, taskDir, reportProgress)
+	if errors.Is(err, errNotDirectMedia) {
+		slog.InfoContext(ctx, "Import is not a direct media link", "url", req.URL, "downloader", config.AppConfig.File.YTDLPPath)
+		filePath, name, err = downloadWithYTDLP(ctx, req.URL, taskDir, reportProgress)
+	}
+	if err != nil {
+		fail(fmt.Sprintf("Failed to download media: %v", err))
+		return
+	}
+
+	task.Message = "Validating downloaded media"
+	task.Progress = 90
+	if err := db.UpdateTask(task); err != nil {
+		slog.ErrorContext(ctx, "Failed to update task progress", "error", err)
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		fail(fmt.Sprintf("Failed to read downloaded file: %v", err))
+		return
+	}
+	assetType, err := utils.ValidateUpload(filePath, info.Size())
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if err := utils.VerifyMediaFile(ctx, filePath, assetType); err != nil {
+		fail(err.Error())
+		return
+	}
+	// The size is only known now that the file has been downloaded
+	if reason, err := storageQuotaExceeded(task.UserID, info.Size()); err != nil {
+		fail(fmt.Sprintf("Failed to check storage quota: %v", err))
+		return
+	} else if reason != "" {
+		fail(reason)
+		return
+	}
+
+	ext := filepath.Ext(filePath)
+	if req.Name != "" {
+		name = req.Name
+	}
+	// PutFile moves or deletes the download, so measure it first
+	duration := probeMediaDuration(ctx, filePath, assetType)
+	storedName := utils.GenerateStoredName(ext)
+	if err := storage.PutFile(ctx, uploadStore, storedName, filePath); err != nil {
+		fail(fmt.Sprintf("Failed to save file: %v", err))
+		return
+	}
+
+	asset, err := registerAsset(task.UserID, task.WorkspaceID, assetType, &utils.FileInfo{
+		OriginalName: name,
+		StoredName:   storedName,
+		FileType:     ext,
+		Size:         info.Size(),
+		Duration:     duration,
+	})
+	if err != nil {
+		uploadStore.Delete(ctx, storedName)
+		fail(fmt.Sprintf("Failed to register asset: %v", err))
+		return
+	}
+
+	taskDetailsJSON, err := json.Marshal(map[string]interface{}{
+		"url":     req.URL,
+		"name":    req.Name,
+		"assetId": asset.ID,
+	})
+	if err == nil {
+		task.TaskDetails = string(taskDetailsJSON)
+	}
+
+	now := time.Now()
+	task.Status = "completed"
+	task.Progress = 100
+	task.Message = "Import completed successfully"
+	task.OutputFile = asset.URL
+	task.CompletedAt = &now
+
+	if err := db.UpdateTask(task); errors.Is(err, models.ErrTaskFinished) {
+		// Failed by an administrator while the asset was being saved
+		slog.InfoContext(ctx, "Task was stopped, discarding its asset", "asset_id", asset.ID)
+		if err := db.PurgeAsset(asset.ID, storedName); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete asset of stopped task", "asset_id", asset.ID, "error", err)
+		}
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to update completed task", "error", err)
+	}
+
+	slog.InfoContext(ctx, "Import completed", "asset_id", asset.ID, "url", asset.URL)
+}
+
+// downloadDirectMedia fetches a URL that serves a media file directly. It returns
+// errNotDirectMedia without downloading anything if the URL serves something else.
+func downloadDirectMedia(ctx context.Context, rawURL, destDir string, onProgress func(percent float64)) (string, string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := importClient.Do(request)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("server returned %s", resp.Status)
+	}
+
+	name := path.Base(resp.Request.URL.Path)
+	contentType := resp.Header.Get("Content-Type")
+	// Generic binary downloads are sniffed once they're on disk
+	isMedia := strings.HasPrefix(contentType, "video/") || strings.HasPrefix(contentType, "audio/") ||
+		strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "application/octet-stream") ||
+		utils.GetFileType(name) != "unknown"
+	if !isMedia {
+		return "", "", errNotDirectMedia
+	}
+
+	maxSize := utils.MaxUploadSize()
+	if resp.ContentLength > maxSize {
+		return "", "", fmt.Errorf("file too large (max %s)", utils.FormatSize(maxSize))
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	if utils.GetFileType(name) == "unknown" {
+		ext = ""
+	}
+	filePath := filepath.Join(destDir, "download"+ext)
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create file: %v", err)
+	}
+
+	progress := &progressWriter{total: resp.ContentLength, onProgress: onProgress}
+	written, err := io.Copy(io.MultiWriter(dst, progress), io.LimitReader(resp.Body, maxSize+1))
+	dst.Close()
+	if err != nil {
+		return "", "", fmt.Errorf("download interrupted: %v", err)
+	}
+	if written > maxSize {
+		return "", "", fmt.Errorf("file too large (max %s)", utils.FormatSize(maxSize))
+	}
+
+	// Without a usable extension in the URL, name the file after its content
+	if ext == "" {
+		ext, err = utils.DetectExtension(filePath)
+		if err != nil {
+			return "", "", err
+		}
+		if ext == "" || utils.GetFileType(ext) == "unknown" {
+			return "", "", fmt.Errorf("unsupported file type")
+		}
+		renamed := filepath.Join(destDir, "download"+ext)
+		if err := os.Rename(filePath, renamed); err != nil {
+			return "", "", fmt.Errorf("failed to rename file: %v", err)
+		}
+		filePath = renamed
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ext
+	}
+
+	return filePath, name, nil
+}
+
+// downloadWithYTDLP downloads the full media behind any page yt-dlp supports
+func downloadWithYTDLP(ctx context.Context, rawURL, destDir string, onProgress func(percent float64)) (string, string, error) {
+	titleFile := filepath.Join(destDir, "title.txt")
+	args := []string{
+		"--newline",
+		"--no-playlist",
+		"--format", "best",
+		"--max-filesize", strconv.FormatInt(utils.MaxUploadSize(), 10),
+		"--print-to-file", "after_move:title", titleFile,
+		"--output", filepath.Join(destDir, "download.%(ext)s"),
+		// Fetch everything through the import proxy, and with yt-dlp's own
+		// downloaders rather than ffmpeg, which would connect directly
+		"--proxy", importProxyURL,
+		"--downloader", "native",
+		rawURL,
+	}
+
+	slog.DebugContext(ctx, "Running yt-dlp", "command", config.AppConfig.File.YTDLPPath, "args", args)
+	ctx, cancel := context.WithTimeout(ctx, importTimeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.AppConfig.File.YTDLPPath, args...)
+	// Once yt-dlp has been killed, stop waiting for the output of anything it
+	// started, such as ffmpeg
+	cmd.WaitDelay = 5 * time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.Stdout = &ytdlpProgressWriter{onProgress: onProgress}
+
+	if err := cmd.Run(); err != nil {
+		commandFailures.Inc(commandYTDLP)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", "", fmt.Errorf("%s timed out after %s", config.AppConfig.File.YTDLPPath, importTimeout())
+		}
+		return "", "", fmt.Errorf("%s failed: %v, output: %s", config.AppConfig.File.YTDLPPath, err, stderr.String())
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(destDir, "download.*"))
+	var filePath string
+	for _, match := range matches {
+		// Skip leftovers such as .part or .ytdl files
+		if utils.GetFileType(match) != "unknown" {
+			filePath = match
+			break
+		}
+	}
+	if filePath == "" {
+		return "", "", fmt.Errorf("%s did not produce a supported media file", config.AppConfig.File.YTDLPPath)
+	}
+
+	name := "download" + filepath.Ext(filePath)
+	if title, err := os.ReadFile(titleFile); err == nil && strings.TrimSpace(string(title)) != "" {
+		name = strings.TrimSpace(string(title)) + filepath.Ext(filePath)
+	}
+
+	return filePath, name, nil
+}
+
+// progressWriter reports how much of a download of known size has been written
+type progressWriter struct {
+	total      int64
+	written    int64
+	onProgress func(percent float64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if p.total > 0 {
+		p.onProgress(float64(p.written) * 100 / float64(p.total))
+	}
+	return len(b), nil
+}
+
+// ytdlpProgressWriter reports the progress lines yt-dlp writes to stdout
+type ytdlpProgressWriter struct {
+	pending    []byte // Start of a line not written in full yet
+	onProgress func(percent float64)
+}
+
+func (p *ytdlpProgressWriter) Write(b []byte) (int, error) {
+	p.pending = append(p.pending, b...)
+	for {
+		end := bytes.IndexByte(p.pending, '\n')
+		if end < 0 {
+			break
+		}
+		if match := ytdlpProgressPattern.FindSubmatch(p.pending[:end]); match != nil {
+			if percent, err := strconv.ParseFloat(string(match[1]), 64); err == nil {
+				p.onProgress(percent)
+			}
+		}
+		p.pending = p.pending[end+1:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clipflow/config"
+	"clipflow/models"
+	"clipflow/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// JanitorReport is what one janitor run deleted, or would have deleted in a
+// dry run
+type JanitorReport struct {
+	DryRun         bool      `json:"dry_run"`
+	Tasks          int       `json:"tasks"`
+	Assets         int       `json:"assets"`
+	Trash          int       `json:"trash"`        // Tasks and assets deleted from the trash
+	PurgedFiles    int       `json:"purged_files"` // Files of items purged from the trash by their owner
+	OrphanFiles    int       `json:"orphan_files"`
+	UploadSessions int       `json:"upload_sessions"`
+	TempEntries    int       `json:"temp_entries"`
+	LoginRecords   int64     `json:"login_records"` // Login attempts, throttles and email tokens
+	Sessions       int64     `json:"sessions"`      // Sessions that expired or were revoked
+	Bytes          int64     `json:"bytes"`
+	Errors         int       `json:"errors"`
+	StartedAt      time.Time `json:"started_at"`
+	FinishedAt     time.Time `json:"finished_at"`
+}
+
+// janitor is one run of the janitor, which deletes what the retention
+// settings say is too old
+type janitor struct {
+	ctx    context.Context
+	report *JanitorReport
+}
+
+// janitorMu stops runs from overlapping
+var janitorMu sync.Mutex
+
+// startJanitor runs the janitor every JANITOR_INTERVAL seconds
+func startJanitor() {
+	interval := time.Duration(config.AppConfig.Retention.Interval) * time.Second
+	if interval <= 0 {
+		slog.Info("Janitor disabled")
+		return
+	}
+	go func() {
+		for {
+			runJanitor(context.Background(), config.AppConfig.Retention.DryRun)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// runJanitor deletes expired tasks and assets, files nothing refers to,
+// abandoned resumable uploads, leftover temp directories and old login
+// records, logging each
+func runJanitor(ctx context.Context, dryRun bool) *JanitorReport {
+	janitorMu.Lock()
+	defer janitorMu.Unlock()
+
+	j := &janitor{ctx: ctx, report: &JanitorReport{DryRun: dryRun, StartedAt: time.Now()}}
+	retention := config.AppConfig.Retention
+
+	j.expireTasks(true, retention.AnonymousOutputs)
+	j.expireTasks(false, retention.Outputs)
+	j.expireAssets(true, retention.AnonymousUploads)
+	j.expireAssets(false, retention.Uploads)
+	j.emptyTrash(retention.Trash)
+	j.removePurgedFiles()
+	j.removeOrphans(uploadStore, "/uploads/", retention.Orphans)
+	j.removeOrphans(outputStore, "/output/", retention.Orphans)
+	j.removeStaleUploads(retention.Temp)
+	j.cleanTempDir(retention.Temp)
+	j.pruneLoginRecords(retention.LoginRecords)
+	j.pruneSessions(retention.LoginRecords)
+
+	report := j.report
+	report.FinishedAt = time.Now()
+	slog.InfoContext(ctx, "Janitor run finished", "dry_run", dryRun, "reclaimed", formatBytes(report.Bytes),
+		"tasks", report.Tasks, "assets", report.Assets, "trash", report.Trash, "purged_files", report.PurgedFiles,
+		"orphan_files", report.OrphanFiles, "upload_sessions", report.UploadSessions, "temp_entries", report.TempEntries,
+		"login_records", report.LoginRecords, "sessions", report.Sessions, "errors", report.Errors)
+	return report
+}
+
+// cutoff returns the time before which things are kept no longer, or false
+// when the retention period keeps them forever
+func cutoff(retention int64) (time.Time, bool) {
+	if retention <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().Add(-time.Duration(retention) * time.Second), true
+}
+
+// deleted logs a deletion, saying it didn't happen on a dry run
+func (j *janitor) deleted(message string, args ...any) {
+	prefix := "Janitor: "
+	if j.report.DryRun {
+		prefix = "Janitor (dry run): would have "
+	}
+	slog.InfoContext(j.ctx, prefix+message, args...)
+}
+
+func (j *janitor) fail(message string, err error, args ...any) {
+	j.report.Errors++
+	slog.ErrorContext(j.ctx, "Janitor: "+message, append(args, "error", err)...)
+}
+
+func (j *janitor) expireTasks(anonymous bool, retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	tasks, err := db.GetExpiredTasks(anonymous, before)
+	if err != nil {
+		j.fail("failed to list expired tasks", err)
+		return
+	}
+	for _, task := range tasks {
+		size := outputSize(j.ctx, task)
+		j.deleted("deleted expired task", "task_id", task.ID, "user_id", task.UserID, "created_at", task.CreatedAt, "size", formatBytes(size))
+		if !j.report.DryRun {
+			if err := deleteTask(j.ctx, task); err != nil {
+				j.fail("failed to delete task", err, "task_id", task.ID)
+				continue
+			}
+		}
+		j.report.Tasks++
+		j.report.Bytes += size
+	}
+}
+
+func (j *janitor) expireAssets(anonymous bool, retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	assets, err := db.GetExpiredAssets(anonymous, before)
+	if err != nil {
+		j.fail("failed to list expired assets", err)
+		return
+	}
+	for _, asset := range assets {
+		j.deleted("deleted expired asset", "asset_id", asset.ID, "name", asset.Name, "user_id", asset.UserID, "created_at", asset.CreatedAt, "size", formatBytes(asset.Size))
+		if !j.report.DryRun {
+			if err := deleteAsset(j.ctx, asset); err != nil {
+				j.fail("failed to delete asset", err, "asset_id", asset.ID)
+				continue
+			}
+		}
+		j.report.Assets++
+		j.report.Bytes += asset.Size
+	}
+}
+
+// emptyTrash deletes tasks and assets, with their files, that have been in the
+// trash for longer than the retention period
+func (j *janitor) emptyTrash(retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	tasks, err := db.GetTasksTrashedBefore(before)
+	if err != nil {
+		j.fail("failed to list tasks in the trash", err)
+		return
+	}
+	for _, task := range tasks {
+		size := outputSize(j.ctx, task)
+		j.deleted("deleted task from the trash", "task_id", task.ID, "user_id", task.UserID, "deleted_at", task.DeletedAt, "size", formatBytes(size))
+		if !j.report.DryRun {
+			if err := deleteTask(j.ctx, task); err != nil {
+				j.fail("failed to delete task", err, "task_id", task.ID)
+				continue
+			}
+		}
+		j.report.Trash++
+		j.report.Bytes += size
+	}
+
+	assets, err := db.GetAssetsTrashedBefore(before)
+	if err != nil {
+		j.fail("failed to list assets in the trash", err)
+		return
+	}
+	for _, asset := range assets {
+		j.deleted("deleted asset from the trash", "asset_id", asset.ID, "name", asset.Name, "user_id", asset.UserID, "deleted_at", asset.DeletedAt, "size", formatBytes(asset.Size))
+		if !j.report.DryRun {
+			if err := deleteAsset(j.ctx, asset); err != nil {
+				j.fail("failed to delete asset", err, "asset_id", asset.ID)
+				continue
+			}
+		}
+		j.report.Trash++
+		j.report.Bytes += asset.Size
+	}
+}
+
+// removePurgedFiles deletes the files of tasks and assets that their owners
+// purged from the trash
+func (j *janitor) removePurgedFiles() {
+	deletions, err := db.GetFileDeletions()
+	if err != nil {
+		j.fail("failed to list purged files", err)
+		return
+	}
+	for _, deletion := range deletions {
+		store := uploadStore
+		if deletion.Store == "output" {
+			store = outputStore
+		}
+		var size int64
+		if info, err := store.Stat(j.ctx, deletion.Key); err == nil {
+			size = info.Size
+		}
+		j.deleted("deleted purged file", "store", deletion.Store, "key", deletion.Key, "size", formatBytes(size))
+		if !j.report.DryRun {
+			if err := store.Delete(j.ctx, deletion.Key); err != nil {
+				j.fail("failed to delete purged file", err, "store", deletion.Store, "key", deletion.Key)
+				continue
+			}
+			if err := db.DeleteFileDeletion(deletion.ID); err != nil {
+				j.fail("failed to forget purged file", err, "store", deletion.Store, "key", deletion.Key)
+				continue
+			}
+		}
+		j.report.PurgedFiles++
+		j.report.Bytes += size
+	}
+}
+
+// removeOrphans deletes files that no asset or task refers to, once they are
+// old enough that they can't belong to an upload or render still being saved.
+// Only backends that can list their files are checked.
+func (j *janitor) removeOrphans(store storage.Storage, urlPrefix string, retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	lister, ok := store.(storage.Lister)
+	if !ok {
+		return
+	}
+
+	var orphans []*storage.ObjectInfo
+	err := lister.List(j.ctx, func(object *storage.ObjectInfo) error {
+		if !object.ModTime.Before(before) {
+			return nil
+		}
+		referenced, err := isReferenced(urlPrefix + object.Key)
+		if err != nil {
+			return err
+		}
+		if !referenced {
+			orphans = append(orphans, object)
+		}
+		return nil
+	})
+	if err != nil {
+		j.fail("failed to list files", err, "prefix", urlPrefix)
+		return
+	}
+
+	for _, object := range orphans {
+		j.deleted("deleted orphaned file", "path", urlPrefix+object.Key, "size", formatBytes(object.Size))
+		if !j.report.DryRun {
+			if err := store.Delete(j.ctx, object.Key); err != nil {
+				j.fail("failed to delete orphaned file", err, "path", urlPrefix+object.Key)
+				continue
+			}
+		}
+		j.report.OrphanFiles++
+		j.report.Bytes += object.Size
+	}
+}
+
+// isReferenced reports whether an asset or task still uses the file at url
+func isReferenced(url string) (bool, error) {
+	var err error
+	if strings.HasPrefix(url, "/uploads/") {
+		_, err = db.GetAssetByURL(url)
+	} else {
+		_, err = db.GetTaskByOutputFile(url)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// removeStaleUploads deletes resumable uploads that stopped receiving data,
+// and the sessions of finished ones
+func (j *janitor) removeStaleUploads(retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	uploads, err := db.GetStaleUploadSessions(before)
+	if err != nil {
+		j.fail("failed to list abandoned uploads", err)
+		return
+	}
+	for _, upload := range uploads {
+		if upload.AssetID != "" {
+			// The file is already an asset, so only the session goes
+			j.deleted("deleted session of finished upload",
+				"upload_id", upload.ID, "filename", upload.Filename, "user_id", upload.UserID, "completed_at", upload.UpdatedAt)
+			if !j.report.DryRun {
+				if err := db.DeleteUploadSession(upload.ID); err != nil {
+					j.fail("failed to delete upload", err, "upload_id", upload.ID)
+					continue
+				}
+			}
+			j.report.UploadSessions++
+			continue
+		}
+
+		partPath := tusPartPath(upload.ID)
+		var size int64
+		if info, err := os.Stat(partPath); err == nil {
+			size = info.Size()
+		}
+		j.deleted("deleted abandoned upload",
+			"upload_id", upload.ID, "filename", upload.Filename, "user_id", upload.UserID, "last_written_at", upload.UpdatedAt, "size", formatBytes(size))
+		if !j.report.DryRun {
+			if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+				j.fail("failed to delete partial upload", err, "path", partPath)
+				continue
+			}
+			if err := db.DeleteUploadSession(upload.ID); err != nil {
+				j.fail("failed to delete upload", err, "upload_id", upload.ID)
+				continue
+			}
+		}
+		j.report.UploadSessions++
+		j.report.Bytes += size
+	}
+}
+
+// cleanTempDir deletes what crashed or interrupted tasks left in TempDir.
+// Directories of tasks still running are kept however old they are.
+func (j *janitor) cleanTempDir(retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	tempDir := config.AppConfig.File.TempDir
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			j.fail("failed to read temp directory", err, "path", tempDir)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(tempDir, entry.Name())
+		if isKeptTempPath(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		if task, err := db.GetTaskByID(entry.Name()); err == nil && (task.Status == "pending" || task.Status == "processing") {
+			continue
+		}
+
+		size := diskUsage(path).Bytes
+		j.deleted("deleted temp entry", "path", path, "modified_at", info.ModTime(), "size", formatBytes(size))
+		if !j.report.DryRun {
+			if err := os.RemoveAll(path); err != nil {
+				j.fail("failed to delete temp entry", err, "path", path)
+				continue
+			}
+		}
+		j.report.TempEntries++
+		j.report.Bytes += size
+	}
+}
+
+// pruneLoginRecords deletes failed login records and email tokens older than
+// the retention period, and throttles that have run out. Throttles are state
+// rather than records, so they go once expired even if records are kept
+// forever.
+func (j *janitor) pruneLoginRecords(retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		// Keep the records, but still clear out the throttles
+		before = time.Time{}
+	}
+	window := time.Duration(config.AppConfig.Security.LoginAttemptWindow) * time.Second
+	pruned, err := db.PruneLoginRecords(before, time.Now().Add(-window), j.report.DryRun)
+	if err != nil {
+		j.fail("failed to prune login records", err)
+		return
+	}
+	if total := pruned.Attempts + pruned.Throttles + pruned.Tokens; total > 0 {
+		j.deleted("deleted login records", "login_attempts", pruned.Attempts, "login_throttles", pruned.Throttles, "email_tokens", pruned.Tokens)
+		j.report.LoginRecords += total
+	}
+}
+
+// isKeptTempPath reports whether a path in TempDir belongs to something with
+// its own cleanup: resumable uploads, or the mail file backend's messages
+func isKeptTempPath(path string) bool {
+	for _, kept := range []string{filepath.Dir(tusPartPath("")), config.AppConfig.Mail.FileDir} {
+		if sameDir(path, kept) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameDir(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// outputKey returns the storage key of a task's output, or "" if it has none
+func outputKey(task *models.Task) string {
+	if !strings.HasPrefix(task.OutputFile, "/output/") {
+		return ""
+	}
+	return strings.TrimPrefix(task.OutputFile, "/output/")
+}
+
+// outputSize returns the size of a task's output, falling back to storage for
+// tasks completed before sizes were recorded
+func outputSize(ctx context.Context, task *models.Task) int64 {
+	if task.OutputSize > 0 {
+		return task.OutputSize
+	}
+	key := outputKey(task)
+	if key == "" {
+		return 0
+	}
+	if info, err := outputStore.Stat(ctx, key); err == nil {
+		return info.Size
+	}
+	return 0
+}
+
+// pruneSessions deletes sessions that ended, by expiring or being revoked,
+// longer ago than the login records are kept
+func (j *janitor) pruneSessions(retention int64) {
+	before, ok := cutoff(retention)
+	if !ok {
+		return
+	}
+	pruned, err := db.PruneSessions(before, j.report.DryRun)
+	if err != nil {
+		j.fail("failed to prune sessions", err)
+		return
+	}
+	if pruned > 0 {
+		j.deleted("deleted ended sessions", "sessions", pruned)
+		j.report.Sessions += pruned
+	}
+}
+
+// deleteTask removes a task along with its share links and output file
+func deleteTask(ctx context.Context, task *models.Task) error {
+	if err := db.DeleteTask(task.ID); err != nil {
+		return err
+	}
+	if err := db.DeleteShareLinksByTaskID(task.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to delete share links of task", "task_id", task.ID, "error", err)
+	}
+	if key := outputKey(task); key != "" {
+		if err := outputStore.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove task output", "task_id", task.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// deleteAsset removes an asset along with its file
+func deleteAsset(ctx context.Context, asset *models.Asset) error {
+	if err := db.DeleteAsset(asset.ID); err != nil {
+		return err
+	}
+	if err := uploadStore.Delete(ctx, asset.StoredName); err != nil {
+		slog.ErrorContext(ctx, "Failed to remove asset file", "asset_id", asset.ID, "error", err)
+	}
+	return nil
+}
+
+// adminRunJanitorHandler runs the janitor now and reports what it deleted.
+// ?dry_run=true only reports what would be deleted.
+func adminRunJanitorHandler(c *gin.Context) {
+	dryRun := config.AppConfig.Retention.DryRun
+	if value := c.Query("dry_run"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "dry_run must be true or false"})
+			return
+		}
+		dryRun = parsed
+	}
+
+	slog.InfoContext(c.Request.Context(), "Admin started a janitor run", "admin_id", c.GetString("userID"), "dry_run", dryRun)
+	recordAudit(c, models.AuditEvent{Action: models.AuditAdminJanitorRun, Details: map[string]string{"dry_run": strconv.FormatBool(dryRun)}})
+	c.JSON(http.StatusOK, runJanitor(c.Request.Context(), dryRun))
+}
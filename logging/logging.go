@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// RequestIDKey is the attribute carrying the ID of the request a record was
+// logged for
+const RequestIDKey = "request_id"
+
+// Setup makes the default slog logger, which the standard log package also
+// writes through, log at the given level ("debug", "info", "warn" or "error")
+// in the given format ("text" or "json"). Records logged with a context get
+// the attributes added to it with With, and secrets are redacted.
+func Setup(w io.Writer, level, format string) error {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: use debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: minLevel, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format %q: use text or json", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+type attrsKey struct{}
+
+// With returns a copy of ctx whose log records all carry the given attributes,
+// as key-value pairs or slog.Attrs like slog.Logger.With takes. The attributes
+// follow the context into goroutines, e.g. from a request into the task it
+// starts.
+func With(ctx context.Context, args ...any) context.Context {
+	attrs := append([]slog.Attr{}, contextAttrs(ctx)...)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+	return context.WithValue(ctx, attrsKey{}, attrs)
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "" outside one
+func RequestID(ctx context.Context) string {
+	for _, attr := range contextAttrs(ctx) {
+		if attr.Key == RequestIDKey {
+			return attr.Value.String()
+		}
+	}
+	return ""
+}
+
+func contextAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the attributes stored in a record's context by With
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs := contextAttrs(ctx); len(attrs) > 0 {
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// NewWriter returns a writer that logs each write as a record at the given
+// level, for libraries that only log to an io.Writer
+func NewWriter(level slog.Level) io.Writer {
+	return &writer{level: level}
+}
+
+type writer struct {
+	level slog.Level
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if message := strings.TrimSpace(string(p)); message != "" {
+		slog.Log(context.Background(), w.level, message)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces secrets in log output
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of attribute names whose values are never logged
+var sensitiveKeys = []string{"password", "passwd", "token", "secret", "authorization", "cookie", "api_key", "apikey", "signature"}
+
+// secretPatterns find secrets embedded in messages and string values, e.g. a
+// header dumped into an error or a signed URL. The first group, if any, is
+// kept.
+var secretPatterns = []*regexp.Regexp{
+	// Authorization headers
+	regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9\-._~+/]{8,}=*`),
+	regexp.MustCompile(`(?i)(basic\s+)[A-Za-z0-9+/]{16,}={0,2}`),
+	// Cookie headers
+	regexp.MustCompile(`(?i)((?:set-)?cookie:\s*)[^\r\n]+`),
+	// JWTs, even cut short
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]{10,}(?:\.[A-Za-z0-9_-]*){0,2}`),
+	// API keys
+	regexp.MustCompile(`cf_[A-Za-z0-9_-]{20,}`),
+	// Query parameters and form fields
+	regexp.MustCompile(`(?i)((?:^|[?&\s;,])(?:[a-z_]*token|password|passwd|secret|sig|signature|api_key|login_code)=)[^&\s"';,]+`),
+	regexp.MustCompile(`(?i)([?&](?:code|state)=)[^&\s"']+`),
+	// JSON fields
+	regexp.MustCompile(`(?i)("(?:[a-z_]*token|[a-z_]*password|secret|api_key|authorization|cookie)"\s*:\s*")[^"]*`),
+}
+
+// redactAttr is the handlers' ReplaceAttr. It hides the values of sensitive
+// attributes and scrubs secrets out of messages and other strings.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if attr.Key == slog.TimeKey || attr.Key == slog.LevelKey {
+		return attr
+	}
+	if isSensitiveKey(attr.Key) {
+		return slog.String(attr.Key, Redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		switch value := attr.Value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, Redact(value.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, Redact(value.String()))
+		case []string:
+			return slog.String(attr.Key, Redact(fmt.Sprint(value)))
+		}
+	}
+	return attr
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return key == "sig"
+}
+
+// Redact replaces the secrets it recognizes in s
+func Redact(s string) string {
+	for _, pattern := range secretPatterns {
+		if pattern.NumSubexp() > 0 {
+			s = pattern.ReplaceAllString(s, "${1}"+Redacted)
+		} else {
+			s = pattern.ReplaceAllString(s, Redacted)
+		}
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"clipflow/config"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// loginLocks serializes login attempts for the same account or IP address, so
+// that parallel guesses can't all slip in before the first failure is counted
+var loginLocks = &keyedMutex{locks: make(map[string]*refMutex)}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// keyedMutex hands out one mutex per key, dropping it once nobody holds it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+// Lock locks key and returns the function that unlocks it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &refMutex{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// loginGuard tracks failed logins for one attempt's account and IP address
+type loginGuard struct {
+	email     string
+	ipAddress string
+	userAgent string
+	unlock    []func()
+}
+
+// loginLimit is how many failures a throttle key tolerates
+type loginLimit struct {
+	key          string
+	freeAttempts int // Failures before backoff starts
+	lockout      int // Failures before a lockout, 0 for never
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// limits returns the throttles that apply to the attempt. Shared IP addresses
+// get more leeway than single accounts.
+func (g *loginGuard) limits() []loginLimit {
+	securityConfig := config.AppConfig.Security
+	return []loginLimit{
+		{key: accountThrottleKey(g.email), freeAttempts: securityConfig.LoginFreeAttempts, lockout: securityConfig.LoginLockoutThreshold},
+		{key: "ip:" + g.ipAddress, freeAttempts: securityConfig.LoginIPFreeAttempts, lockout: securityConfig.LoginIPLockoutThreshold},
+	}
+}
+
+// guardLogin starts a login attempt. Close must be called when it is over.
+// Accounts are tracked by email whether or not they exist, so throttling
+// behaves the same for unknown emails.
+func guardLogin(email, ipAddress, userAgent string) *loginGuard {
+	g := &loginGuard{email: strings.ToLower(strings.TrimSpace(email)), ipAddress: ipAddress, userAgent: userAgent}
+	// Always lock in the same order so two attempts can't deadlock
+	for _, limit := range g.limits() {
+		g.unlock = append(g.unlock, loginLocks.Lock(limit.key))
+	}
+	return g
+}
+
+func (g *loginGuard) Close() {
+	for i := len(g.unlock) - 1; i >= 0; i-- {
+		g.unlock[i]()
+	}
+}
+
+// RetryAfter returns how long the caller must wait before trying again, or
+// zero if the attempt may go ahead
+func (g *loginGuard) RetryAfter() time.Duration {
+	now := time.Now()
+	var wait time.Duration
+	for _, limit := range g.limits() {
+		throttle, err := db.GetLoginThrottle(limit.key)
+		if err != nil {
+			slog.Error("Failed to get login throttle", "key", limit.key, "error", err)
+			continue
+		}
+		if w := throttleWait(throttle, limit.freeAttempts, now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// respondLoginThrottled tells the caller how long to wait before trying again
+func respondLoginThrottled(c *gin.Context, wait time.Duration) {
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, please try again later", "retry_after": retryAfter})
+}
+
+// Fail records a failed attempt: counts it against the account and IP address,
+// locking them once they reach their threshold, and writes the audit record
+func (g *loginGuard) Fail(userID, reason string) {
+	if reason != models.LoginFailureThrottled {
+		for _, limit := range g.limits() {
+			countLoginFailure(limit)
+		}
+	}
+
+	err := db.CreateLoginAttempt(&models.LoginAttempt{
+		ID:        uuid.New().String(),
+		Email:     g.email,
+		UserID:    userID,
+		IPAddress: g.ipAddress,
+		UserAgent: g.userAgent,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Error("Failed to record login attempt", "email", g.email, "error", err)
+	}
+
+	event := &models.AuditEvent{
+		IPAddress: g.ipAddress,
+		Action:    models.AuditLoginFailed,
+		Details:   map[string]string{"email": g.email, "reason": reason},
+	}
+	if userID != "" {
+		event.TargetType, event.TargetID = "user", userID
+	}
+	saveAuditEvent(event)
+}
+
+// Succeed clears the account's failures. The IP address keeps its count, so
+// that logging into one account doesn't buy more guesses at others.
+func (g *loginGuard) Succeed() {
+	if err := db.DeleteLoginThrottle(accountThrottleKey(g.email)); err != nil {
+		slog.Error("Failed to reset login throttle", "email", g.email, "error", err)
+	}
+}
+
+func countLoginFailure(limit loginLimit) {
+	now := time.Now()
+
+	throttle, err := db.GetLoginThrottle(limit.key)
+	if err != nil {
+		slog.Error("Failed to get login throttle", "key", limit.key, "error", err)
+		return
+	}
+	if throttleExpired(throttle, now) {
+		throttle.Failures = 0
+		throttle.LockedUntil = nil
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	if limit.lockout > 0 && throttle.Failures >= limit.lockout {
+		lockedUntil := now.Add(time.Duration(config.AppConfig.Security.LoginLockoutDuration) * time.Second)
+		throttle.LockedUntil = &lockedUntil
+		slog.Warn("Locked after too many failed logins", "key", limit.key, "failures", throttle.Failures, "locked_until", lockedUntil)
+	}
+
+	if err := db.SaveLoginThrottle(throttle); err != nil {
+		slog.Error("Failed to save login throttle", "key", limit.key, "error", err)
+	}
+}
+
+// throttleExpired reports whether a throttle's failures are old enough, or its
+// lockout over, so that counting starts again
+func throttleExpired(throttle *models.LoginThrottle, now time.Time) bool {
+	if throttle.LockedUntil != nil {
+		return !now.Before(*throttle.LockedUntil)
+	}
+	window := time.Duration(config.AppConfig.Security.LoginAttemptWindow) * time.Second
+	return now.Sub(throttle.LastFailureAt) > window
+}
+
+// throttleWait returns how long a throttle makes the next attempt wait: until
+// the end of a lockout, or an exponential backoff after the last failure once
+// the free attempts are used up
+func throttleWait(throttle *models.LoginThrottle, freeAttempts int, now time.Time) time.Duration {
+	if throttle.Failures == 0 || throttleExpired(throttle, now) {
+		return 0
+	}
+	if throttle.LockedUntil != nil {
+		return throttle.LockedUntil.Sub(now)
+	}
+
+	securityConfig := config.AppConfig.Security
+	excess := throttle.Failures - freeAttempts
+	if excess < 0 {
+		return 0
+	}
+	maxDelay := time.Duration(securityConfig.LoginBackoffMax) * time.Second
+	delay := time.Duration(securityConfig.LoginBackoffBase) * time.Second
+	for i := 0; i < excess && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	if next := throttle.LastFailureAt.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
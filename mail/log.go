@@ -0,0 +1,49 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Log notes emails in the server log instead of sending them. Only the
+// recipient and subject are logged: the links in the bodies carry tokens,
+// which the log redacts anyway, so File is the backend for reading them.
+type Log struct{}
+
+func NewLog() *Log {
+	return &Log{}
+}
+
+func (l *Log) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "Mail not sent, use MAIL_BACKEND=file to read it", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// File writes each email to its own .eml file in a directory, for tests and
+// local setups that want to open the messages
+type File struct {
+	dir  string
+	from string
+}
+
+func NewFile(dir, from string) (*File, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %v", err)
+	}
+	return &File{dir: dir, from: from}, nil
+}
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	file, err := os.CreateTemp(f.dir, time.Now().Format("20060102_150405")+"_*.eml")
+	if err != nil {
+		return fmt.Errorf("failed to create mail file: %v", err)
+	}
+	if _, err := file.Write(format(f.from, msg)); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write mail file: %v", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,100 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPConfig configures delivery through an SMTP server
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string // Leave empty for servers that don't require auth
+	Password string
+	From     string
+}
+
+// SMTP sends mail through an SMTP server. Port 465 uses implicit TLS; other
+// ports upgrade with STARTTLS when the server offers it.
+type SMTP struct {
+	cfg      SMTPConfig
+	envelope string // Bare sender address for the SMTP envelope
+}
+
+func NewSMTP(cfg SMTPConfig) (*SMTP, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("SMTP host is required")
+	}
+	if cfg.Port == "" {
+		cfg.Port = "587"
+	}
+	from, err := netmail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mail sender address: %v", err)
+	}
+	return &SMTP{cfg: cfg, envelope: from.Address}, nil
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return errors.New("invalid recipient address")
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, s.cfg.Port)
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{}
+	if s.cfg.Port == "465" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.cfg.Host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if s.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, s.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(s.envelope); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(format(s.cfg.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -12,12 +15,15 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"clipflow/auth"
 	"clipflow/config"
+	"clipflow/logging"
 	"clipflow/middleware"
 	"clipflow/models"
+	"clipflow/storage"
 	"clipflow/utils"
 
 	"github.com/gin-contrib/cors"
@@ -89,6 +95,8 @@ type TaskResponse struct {
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
+	// Move the tasks and assets of the caller's anonymous session into the account
+	MergeAnonymous bool `json:"merge_anonymous"`
 }
 
 type RegisterRequest struct {
@@ -98,57 +106,135 @@ type RegisterRequest struct {
 }
 
 type LoginResponse struct {
-	Token string       `json:"token"`
-	User  *models.User `json:"user"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token"`
+	ExpiresIn    int64        `json:"expires_in"` // Seconds until the access token expires
+	User         *models.User `json:"user"`
+
+	// What the caller's anonymous session owns, when logging in could merge it
+	AnonymousData *AnonymousData `json:"anonymous_data,omitempty"`
+	// What was merged, when merge_anonymous was set
+	Merged *AnonymousData `json:"merged,omitempty"`
+	// Why merge_anonymous was refused, leaving the data with the anonymous session
+	MergeRefused string `json:"merge_refused,omitempty"`
 }
 
 type MeResponse struct {
-	Token string       `json:"token"`
-	User  *models.User `json:"user"`
-	New   bool         `json:"new"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token,omitempty"` // Only sent when a new session is started
+	ExpiresIn    int64        `json:"expires_in"`
+	User         *models.User `json:"user"`
+	New          bool         `json:"new"`
+	DeviceToken  string       `json:"device_token,omitempty"` // Only sent when a new anonymous user is created
 }
 
 var db *models.Database
 
 func main() {
 	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found, using default configuration")
-	}
+	envErr := godotenv.Load()
 
 	// Load configuration
 	if err := config.LoadConfig(); err != nil {
-		log.Fatal("Failed to load configuration:", err)
+		fatal("Failed to load configuration", err)
+	}
+
+	// Log structured records from here on, including through the log package
+	if err := logging.Setup(os.Stderr, config.AppConfig.Log.Level, config.AppConfig.Log.Format); err != nil {
+		fatal("Failed to set up logging", err)
+	}
+	gin.DefaultWriter = logging.NewWriter(slog.LevelDebug)
+	gin.DefaultErrorWriter = logging.NewWriter(slog.LevelError)
+	if envErr != nil {
+		slog.Warn(".env file not found, using default configuration")
 	}
 
-	// Set JWT secret from config
+	// Set JWT and download signing secrets from config
 	auth.SetJWTSecret(config.AppConfig.Security.JWTSecret)
+	auth.SetDownloadSecret(config.AppConfig.Security.SessionSecret)
+	auth.SetAccessTokenTTL(time.Duration(config.AppConfig.Security.AccessTokenTTL) * time.Second)
+
+	// Set upload limits and allowed formats from config
+	fileConfig := config.AppConfig.File
+	utils.SetUploadLimits(utils.UploadLimits{
+		MaxSize: fileConfig.MaxSize,
+		MaxSizes: map[string]int64{
+			"video":    fileConfig.MaxVideoSize,
+			"audio":    fileConfig.MaxAudioSize,
+			"image":    fileConfig.MaxImageSize,
+			"subtitle": fileConfig.MaxSubtitleSize,
+		},
+		AllowedVideoFormats:    fileConfig.AllowedVideoFormats,
+		AllowedAudioFormats:    fileConfig.AllowedAudioFormats,
+		AllowedImageFormats:    fileConfig.AllowedImageFormats,
+		AllowedSubtitleFormats: fileConfig.AllowedSubtitleFormats,
+	})
 
 	// Initialize database
 	var err error
 	db, err = models.NewDatabase(config.AppConfig.Database.Path)
 	if err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		fatal("Failed to initialize database", err)
 	}
 	defer db.Close()
+	promoteAdmins()
 
 	// Create necessary directories
 	os.MkdirAll(config.AppConfig.File.TempDir, 0755)
-	os.MkdirAll(config.AppConfig.File.OutputDir, 0755)
-	os.MkdirAll(config.AppConfig.File.UploadsDir, 0755)
 
-	router := gin.Default()
+	// Initialize storage for uploads and outputs
+	uploadStore, err = newStorage(config.AppConfig.File.UploadsDir, "uploads/")
+	if err != nil {
+		fatal("Failed to initialize upload storage", err)
+	}
+	outputStore, err = newStorage(config.AppConfig.File.OutputDir, "output/")
+	if err != nil {
+		fatal("Failed to initialize output storage", err)
+	}
+
+	// Initialize mail for password resets and email verification
+	mailer, err = newMailer()
+	if err != nil {
+		fatal("Failed to initialize mailer", err)
+	}
+
+	// Delete files once their retention period is up
+	startJanitor()
+
+	if err := setupImports(); err != nil {
+		fatal("Failed to set up imports", err)
+	}
+
+	registerMetricGauges()
+
+	router := gin.New()
+	router.Use(middleware.RequestID(), middleware.RequestLogger(), middleware.Metrics(), gin.Recovery())
+	if err := router.SetTrustedProxies(config.AppConfig.Server.TrustedProxies); err != nil {
+		fatal("Invalid TRUSTED_PROXIES", err)
+	}
 
 	// Configure CORS
 	corsConfig := cors.DefaultConfig()
 	corsConfig.AllowAllOrigins = true
-	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
+	corsConfig.AllowMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-Device-Token", "X-API-Key", "X-Request-ID",
+		"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum"}
+	corsConfig.ExposeHeaders = []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+		"Tus-Checksum-Algorithm", "Upload-Offset", "Upload-Length", "Clipflow-Asset-Id", "Clipflow-Asset-Url",
+		"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"}
 	router.Use(cors.New(corsConfig))
 
+	// Serve stored files to their owners or through signed links
+	downloads := router.Group("")
+	downloads.Use(middleware.OptionalAuthMiddleware(db), middleware.RequireScope(models.ScopeRead))
+	{
+		downloads.GET("/output/*filepath", serveStoredFile(outputStore, lookupOutput))
+		downloads.HEAD("/output/*filepath", serveStoredFile(outputStore, lookupOutput))
+		downloads.GET("/uploads/*filepath", serveStoredFile(uploadStore, lookupUpload))
+		downloads.HEAD("/uploads/*filepath", serveStoredFile(uploadStore, lookupUpload))
+	}
+
 	// Serve static files
-	router.Static("/output", config.AppConfig.File.OutputDir)
-	router.Static("/uploads", config.AppConfig.File.UploadsDir)
 	router.Static("/static", "./static")
 	router.StaticFile("/clipflow-logo.svg", "./clipflow-logo.svg")
 
@@ -156,7 +242,7 @@ func main() {
 	router.GET("/", func(c *gin.Context) {
 		htmlContent, err := os.ReadFile("./index.html")
 		if err != nil {
-			log.Printf("Error loading index.html: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Failed to load index.html", "error", err)
 			c.String(http.StatusInternalServerError, "Error loading frontend")
 			return
 		}
@@ -168,7 +254,7 @@ func main() {
 	router.GET("/history", func(c *gin.Context) {
 		htmlContent, err := os.ReadFile("./history.html")
 		if err != nil {
-			log.Printf("Error loading history.html: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Failed to load history.html", "error", err)
 			c.String(http.StatusInternalServerError, "Error loading history page")
 			return
 		}
@@ -176,11 +262,19 @@ func main() {
 		c.Data(http.StatusOK, "text/html", htmlContent)
 	})
 
+	// Serve account email links
+	router.GET("/reset-password", resetPasswordPageHandler)
+	router.GET("/verify-email", verifyEmailPageHandler)
+
+	// Serve watch pages for shared renders
+	router.GET("/watch/:shareId", watchHandler)
+	router.POST("/watch/:shareId", watchHandler)
+
 	// Serve debug page
 	router.GET("/debug", func(c *gin.Context) {
 		htmlContent, err := os.ReadFile("./debug.html")
 		if err != nil {
-			log.Printf("Error loading debug.html: %v", err)
+			slog.ErrorContext(c.Request.Context(), "Failed to load debug.html", "error", err)
 			c.String(http.StatusInternalServerError, "Error loading debug page")
 			return
 		}
@@ -188,129 +282,224 @@ func main() {
 		c.Data(http.StatusOK, "text/html", htmlContent)
 	})
 
+	// Prometheus metrics, only served to scrapers holding the token
+	if token := config.AppConfig.Server.MetricsToken; token != "" {
+		router.GET("/metrics", middleware.MetricsAuth(token), metricsHandler)
+	} else {
+		slog.Info("Metrics endpoint disabled, set METRICS_TOKEN to enable it")
+	}
+
+	// Rate limits per route group
+	limits := config.AppConfig.RateLimit
+	newRateLimit := func(rule config.RateLimitRule) gin.HandlerFunc {
+		return middleware.RateLimit(rule.Requests, time.Duration(rule.Window)*time.Second)
+	}
+	authLimit := newRateLimit(limits.Auth)
+	apiLimit := newRateLimit(limits.API)
+	uploadLimit := newRateLimit(limits.Upload)
+	renderLimit := newRateLimit(limits.Render)
+
 	// API routes
 	api := router.Group("/api")
 	{
-		// Public routes
-		api.POST("/register", registerHandler)
-		api.POST("/login", loginHandler)
-		api.GET("/me", meHandler)
+		// Public routes, limited per IP address since they run before any
+		// auth middleware
+		api.POST("/register", authLimit, registerHandler)
+		api.POST("/login", authLimit, middleware.OptionalAuthMiddleware(db), loginHandler)
+		api.POST("/login/2fa", authLimit, middleware.OptionalAuthMiddleware(db), verifyTwoFactorHandler)
+		api.GET("/auth/providers", authProvidersHandler)
+		api.GET("/auth/oidc/login", authLimit, oidcLoginHandler)
+		api.GET("/auth/oidc/callback", authLimit, oidcCallbackHandler)
+		api.POST("/auth/oidc/exchange", authLimit, middleware.OptionalAuthMiddleware(db), oidcExchangeHandler)
+		api.GET("/me", authLimit, meHandler)
+		api.POST("/refresh", authLimit, refreshHandler)
+		api.POST("/password/forgot", authLimit, forgotPasswordHandler)
+		api.POST("/password/reset", authLimit, resetPasswordHandler)
+		api.POST("/email/verify", authLimit, verifyEmailHandler)
 
 		// Protected routes (using optional auth middleware)
 		protected := api.Group("")
-		protected.Use(middleware.OptionalAuthMiddleware(db))
+		protected.Use(middleware.OptionalAuthMiddleware(db), apiLimit)
+		{
+			// Credentials can only be managed from a signed-in session
+			sessionOnly := middleware.RequireSession()
+			protected.POST("/logout", sessionOnly, logoutHandler)
+			protected.GET("/sessions", sessionOnly, listSessionsHandler)
+			protected.DELETE("/sessions/:id", sessionOnly, revokeSessionHandler)
+			protected.POST("/account/claim", sessionOnly, claimAccountHandler)
+			protected.POST("/account/password", sessionOnly, changePasswordHandler)
+			protected.GET("/account/2fa", sessionOnly, getTwoFactorStatusHandler)
+			protected.POST("/account/2fa/setup", sessionOnly, setupTwoFactorHandler)
+			protected.POST("/account/2fa/enable", sessionOnly, enableTwoFactorHandler)
+			protected.POST("/account/2fa/disable", sessionOnly, disableTwoFactorHandler)
+			protected.POST("/account/2fa/recovery-codes", sessionOnly, regenerateRecoveryCodesHandler)
+			protected.POST("/email/resend-verification", sessionOnly, resendVerificationHandler)
+			protected.POST("/keys", sessionOnly, createAPIKeyHandler)
+			protected.GET("/keys", sessionOnly, listAPIKeysHandler)
+			protected.DELETE("/keys/:id", sessionOnly, revokeAPIKeyHandler)
+			protected.POST("/workspaces", sessionOnly, createWorkspaceHandler)
+			protected.PATCH("/workspaces/:id", sessionOnly, renameWorkspaceHandler)
+			protected.DELETE("/workspaces/:id", sessionOnly, deleteWorkspaceHandler)
+			protected.PATCH("/workspaces/:id/members/:userId", sessionOnly, updateMemberHandler)
+			protected.DELETE("/workspaces/:id/members/:userId", sessionOnly, removeMemberHandler)
+			protected.POST("/workspaces/:id/invitations", sessionOnly, createInvitationHandler)
+			protected.GET("/workspaces/:id/invitations", sessionOnly, listInvitationsHandler)
+			protected.DELETE("/workspaces/:id/invitations/:invitationId", sessionOnly, revokeInvitationHandler)
+			protected.POST("/invitations/accept", sessionOnly, acceptInvitationHandler)
+
+			// Everything else is also open to API keys with the right scope
+			canRead := middleware.RequireScope(models.ScopeRead)
+			canUpload := middleware.RequireScope(models.ScopeUpload)
+			canRender := middleware.RequireScope(models.ScopeRender)
+			protected.POST("/upload", canUpload, uploadLimit, uploadFileHandler)
+			protected.OPTIONS("/uploads/tus", tusOptionsHandler)
+			protected.POST("/uploads/tus", canUpload, uploadLimit, tusCreateHandler)
+			protected.HEAD("/uploads/tus/:id", canUpload, tusHeadHandler)
+			protected.PATCH("/uploads/tus/:id", canUpload, tusPatchHandler)
+			protected.DELETE("/uploads/tus/:id", canUpload, tusDeleteHandler)
+			protected.POST("/generate-video", canRender, renderLimit, generateVideoHandler)
+			protected.GET("/tasks", canRead, getUserTasksHandler)
+			protected.GET("/task/:taskId", canRead, getTaskStatusHandler)
+			protected.DELETE("/task/:taskId", canRender, deleteTaskHandler)
+			protected.POST("/task/:taskId/share", canRender, createShareHandler)
+			protected.GET("/task/:taskId/shares", canRead, listSharesHandler)
+			protected.DELETE("/task/:taskId/share/:shareId", canRender, revokeShareHandler)
+			protected.GET("/assets", canRead, listAssetsHandler)
+			protected.POST("/assets/import", canUpload, renderLimit, importAssetHandler)
+			protected.PATCH("/assets/:id", canUpload, renameAssetHandler)
+			protected.DELETE("/assets/:id", canUpload, deleteAssetHandler)
+			protected.GET("/workspaces", canRead, listWorkspacesHandler)
+			protected.GET("/workspaces/:id", canRead, getWorkspaceHandler)
+			protected.GET("/usage", canRead, usageHandler)
+			protected.GET("/trash", canRead, listTrashHandler)
+			protected.POST("/trash/:id/restore", restoreTrashHandler) // Checks the scope for the item's type
+			protected.DELETE("/trash/:id", purgeTrashHandler)
+			protected.DELETE("/trash", canRender, canUpload, emptyTrashHandler)
+		}
+
+		// Admin routes
+		admin := api.Group("/admin")
+		admin.Use(middleware.AuthMiddleware(db), apiLimit, middleware.RequireSession(), middleware.RequireRole(models.RoleAdmin))
 		{
-			protected.POST("/upload", uploadFileHandler)
-			protected.POST("/generate-video", generateVideoHandler)
-			protected.GET("/tasks", getUserTasksHandler)
-			protected.GET("/task/:taskId", getTaskStatusHandler)
-			protected.DELETE("/task/:taskId", deleteTaskHandler)
+			admin.GET("/users", adminListUsersHandler)
+			admin.GET("/users/:id", adminGetUserHandler)
+			admin.PATCH("/users/:id", adminUpdateUserHandler)
+			admin.GET("/users/:id/quota", adminGetQuotaHandler)
+			admin.PUT("/users/:id/quota", adminUpdateQuotaHandler)
+			admin.GET("/tasks", adminListTasksHandler)
+			admin.GET("/tasks/:taskId", adminGetTaskHandler)
+			admin.POST("/tasks/:taskId/fail", adminFailTaskHandler)
+			admin.GET("/stats", adminStatsHandler)
+			admin.POST("/janitor/run", adminRunJanitorHandler)
+			admin.GET("/audit", adminListAuditHandler)
 		}
 	}
 
-	log.Printf("Server starting on %s:%s", config.AppConfig.Server.Host, config.AppConfig.Server.Port)
-	router.Run(fmt.Sprintf("%s:%s", config.AppConfig.Server.Host, config.AppConfig.Server.Port))
+	address := fmt.Sprintf("%s:%s", config.AppConfig.Server.Host, config.AppConfig.Server.Port)
+	slog.Info("Server starting", "address", address)
+	if err := router.Run(address); err != nil {
+		fatal("Server stopped", err)
+	}
+}
+
+// fatal logs an error that stops the server from starting, and exits
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
 }
 
 func meHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+
 	// 1. Check for JWT via middleware (userID in context)
 	if userID, exists := c.Get("userID"); exists {
-		log.Printf("/api/me: Authenticated via JWT, userID: %v", userID)
+		slog.DebugContext(ctx, "/api/me: authenticated with an access token", "user_id", userID)
 		user, err := db.GetUserByID(userID.(string))
 		if err != nil {
-			log.Printf("/api/me: Failed to get user by JWT userID: %v", err)
+			slog.ErrorContext(ctx, "/api/me: failed to get user", "user_id", userID, "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
 			return
 		}
-		token, err := auth.GenerateToken(user.ID, user.Email)
+		sessionID, _ := c.Get("sessionID")
+		token, err := auth.GenerateToken(user.ID, user.Email, user.Role, sessionID.(string))
 		if err != nil {
-			log.Printf("/api/me: Failed to generate token for JWT userID: %v", err)
+			slog.ErrorContext(ctx, "/api/me: failed to generate token", "user_id", user.ID, "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 			return
 		}
+		recordTokenMinted(c, user, "access_token")
 		c.JSON(http.StatusOK, MeResponse{
-			Token: token,
-			User:  user,
-			New:   false,
+			Token:     token,
+			ExpiresIn: int64(auth.AccessTokenTTL().Seconds()),
+			User:      user,
+			New:       false,
 		})
 		return
 	}
 
-	// 2. No JWT, check for userID in query param
-	providedUserID := c.Query("userID")
-	if providedUserID != "" {
-		log.Printf("/api/me: No JWT, userID param provided: %s", providedUserID)
-		user, err := db.GetUserByID(providedUserID)
-		if err == nil && user != nil {
-			log.Printf("/api/me: Found user for provided userID: %s", providedUserID)
-			token, err := auth.GenerateToken(user.ID, user.Email)
-			if err != nil {
-				log.Printf("/api/me: Failed to generate token for provided userID: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-				return
-			}
-			c.JSON(http.StatusOK, MeResponse{
-				Token: token,
-				User:  user,
-				New:   false,
-			})
+	// 2. No JWT, check for the device token issued with an anonymous account.
+	// A bare userID proves nothing, so ?userID= is only used for logging.
+	if user, err := userFromDeviceToken(c); err == nil {
+		slog.DebugContext(ctx, "/api/me: authenticated with a device token", "user_id", user.ID)
+		if user.Disabled() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
 			return
-		} else {
-			log.Printf("/api/me: Provided userID not found in database, creating new user with provided ID: %s", providedUserID)
-			// Create new user with the provided userID
-			user := &models.User{
-				ID:           providedUserID,
-				Email:        fmt.Sprintf("anonymous_%s@clipflow.local", uuid.New().String()[:8]),
-				Username:     fmt.Sprintf("Anonymous_%s", uuid.New().String()[:8]),
-				PasswordHash: "",
-				CreatedAt:    time.Now(),
-				UpdatedAt:    time.Now(),
-			}
-			if err := db.CreateUser(user); err != nil {
-				log.Printf("/api/me: Failed to create new user with provided ID: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
-				return
-			}
-			token, err := auth.GenerateToken(user.ID, user.Email)
-			if err != nil {
-				log.Printf("/api/me: Failed to generate token for new user with provided ID: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-				return
-			}
-			c.JSON(http.StatusOK, MeResponse{
-				Token: token,
-				User:  user,
-				New:   true,
-			})
+		}
+		tokens, err := resumeDeviceSession(c, user)
+		if err != nil {
+			slog.ErrorContext(ctx, "/api/me: failed to resume session for device token user", "user_id", user.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 			return
 		}
+		recordTokenMinted(c, user, "device_token")
+		c.JSON(http.StatusOK, MeResponse{
+			Token:        tokens.Token,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresIn:    tokens.ExpiresIn,
+			User:         user,
+			New:          false,
+		})
+		return
 	}
-
-	// 3. No JWT, no userID provided: create new user with new ID
-	log.Printf("/api/me: Creating new anonymous user with new ID.")
-	user := &models.User{
-		ID:           uuid.New().String(),
-		Email:        fmt.Sprintf("anonymous_%s@clipflow.local", uuid.New().String()[:8]),
-		Username:     fmt.Sprintf("Anonymous_%s", uuid.New().String()[:8]),
-		PasswordHash: "",
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+	if providedUserID := c.Query("userID"); providedUserID != "" {
+		slog.InfoContext(ctx, "/api/me: userID provided without a valid device token, creating a new user", "provided_user_id", providedUserID)
 	}
-	if err := db.CreateUser(user); err != nil {
-		log.Printf("/api/me: Failed to create new user: %v", err)
+
+	// 3. No JWT, no device token: create new user with new ID
+	slog.DebugContext(ctx, "/api/me: creating a new anonymous user")
+	user, deviceToken, err := createAnonymousUser()
+	if err != nil {
+		slog.ErrorContext(ctx, "/api/me: failed to create anonymous user", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
-	token, err := auth.GenerateToken(user.ID, user.Email)
+	tokens, err := startSession(c, user)
 	if err != nil {
-		log.Printf("/api/me: Failed to generate token for new user: %v", err)
+		slog.ErrorContext(ctx, "/api/me: failed to start session for new user", "user_id", user.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	recordTokenMinted(c, user, "new_user")
+	setDeviceCookie(c, deviceToken)
 	c.JSON(http.StatusOK, MeResponse{
-		Token: token,
-		User:  user,
-		New:   true,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
+		New:          true,
+		DeviceToken:  deviceToken,
+	})
+}
+
+// recordTokenMinted audits /api/me handing a user an access token, noting
+// whether it was for an existing token, a device token or a new anonymous user
+func recordTokenMinted(c *gin.Context, user *models.User, via string) {
+	recordAudit(c, models.AuditEvent{
+		ActorID:    user.ID,
+		Action:     models.AuditTokenMinted,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Details:    map[string]string{"via": via},
 	})
 }
 
@@ -350,16 +539,30 @@ func registerHandler(c *gin.Context) {
 		return
 	}
 
-	// Generate token
-	token, err := auth.GenerateToken(user.ID, user.Email)
+	if err := sendVerificationEmail(c, user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to send verification email", "user_id", user.ID, "error", err)
+	}
+
+	// Start a session for this device
+	tokens, err := startSession(c, user)
 	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to start session", "user_id", user.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	recordAudit(c, models.AuditEvent{
+		ActorID:    user.ID,
+		Action:     models.AuditRegister,
+		TargetType: "user",
+		TargetID:   user.ID,
+		Details:    map[string]string{"email": user.Email},
+	})
 
 	c.JSON(http.StatusCreated, LoginResponse{
-		Token: token,
-		User:  user,
+		Token:        tokens.Token,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
 	})
 }
 
@@ -370,36 +573,101 @@ func loginHandler(c *gin.Context) {
 		return
 	}
 
-	// Get user by email
-	user, err := db.GetUserByEmail(req.Email)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	// Refuse guesses while the account or IP address is backing off or locked
+	guard := guardLogin(req.Email, c.ClientIP(), c.Request.UserAgent())
+	defer guard.Close()
+	if wait := guard.RetryAfter(); wait > 0 {
+		guard.Fail("", models.LoginFailureThrottled)
+		respondLoginThrottled(c, wait)
 		return
 	}
 
+	// Get user by email. Unknown emails still pay for a password check so that
+	// the response time doesn't reveal which emails have accounts.
+	var passwordHash string
+	user, err := db.GetUserByEmail(req.Email)
+	if err == nil {
+		passwordHash = user.PasswordHash
+	}
+
 	// Check password
-	if !auth.CheckPassword(req.Password, user.PasswordHash) {
+	if !auth.CheckPasswordConstantTime(req.Password, passwordHash) {
+		if user == nil {
+			guard.Fail("", models.LoginFailureUnknownEmail)
+		} else {
+			guard.Fail(user.ID, models.LoginFailureWrongPassword)
+		}
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Generate token
-	token, err := auth.GenerateToken(user.ID, user.Email)
+	// Accounts with 2FA get a challenge to answer with a code instead of a
+	// session. Their failures are only cleared once a code is right, so
+	// logging in again doesn't buy more guesses at it.
+	if user.TOTPEnabled {
+		startTwoFactorChallenge(c, user)
+		return
+	}
+	guard.Succeed()
+
+	completeLogin(c, user, req.MergeAnonymous)
+}
+
+// completeLogin starts a session for a user who has proven who they are,
+// dealing with the caller's anonymous session along the way
+func completeLogin(c *gin.Context, user *models.User, mergeAnonymous bool) {
+	if user.Disabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	// Offer to bring along what the caller did before logging in, or merge it
+	// if they asked to
+	var anonymousData, merged *AnonymousData
+	var mergeRefused string
+	if anonymous := anonymousCaller(c); anonymous != nil && anonymous.ID != user.ID {
+		if mergeAnonymous {
+			var err error
+			merged, mergeRefused, err = mergeAnonymousUser(c, anonymous, user)
+			if err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to merge anonymous user", "anonymous_user_id", anonymous.ID, "user_id", user.ID, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge anonymous session"})
+				return
+			}
+		}
+		// A refused merge leaves the data to offer again
+		if merged == nil {
+			if tasks, assets, err := db.CountUserData(anonymous.ID); err == nil && tasks+assets > 0 {
+				anonymousData = &AnonymousData{Tasks: tasks, Assets: assets}
+			}
+		}
+	}
+
+	// Start a session for this device
+	tokens, err := startSession(c, user)
 	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to start session", "user_id", user.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	recordAudit(c, models.AuditEvent{ActorID: user.ID, Action: models.AuditLogin, TargetType: "user", TargetID: user.ID})
 
 	c.JSON(http.StatusOK, LoginResponse{
-		Token: token,
-		User:  user,
+		Token:         tokens.Token,
+		RefreshToken:  tokens.RefreshToken,
+		ExpiresIn:     tokens.ExpiresIn,
+		User:          user,
+		AnonymousData: anonymousData,
+		Merged:        merged,
+		MergeRefused:  mergeRefused,
 	})
 }
 
 func generateVideoHandler(c *gin.Context) {
+	ctx := c.Request.Context()
 	userID, exists := c.Get("userID")
 	if !exists || userID == nil {
-		log.Printf("Video generation request failed - missing userID in JWT context")
+		slog.WarnContext(ctx, "Video generation rejected - missing userID in JWT context")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
 		return
 	}
@@ -407,72 +675,122 @@ func generateVideoHandler(c *gin.Context) {
 	// Only accept application/json
 	contentType := c.GetHeader("Content-Type")
 	if !strings.HasPrefix(contentType, "application/json") {
-		log.Printf("Invalid content type for video generation: %s", contentType)
+		slog.WarnContext(ctx, "Video generation rejected - invalid content type", "content_type", contentType)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Type must be application/json"})
 		return
 	}
 
 	var req VideoRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		log.Printf("Failed to parse video generation request: %v", err)
+		slog.WarnContext(ctx, "Video generation rejected - invalid request", "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("Video generation request from user %s: %d videos, %d YouTube clips, %d audio files",
-		userID, len(req.Videos), len(req.YouTube), len(req.Audio))
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	slog.InfoContext(ctx, "Video generation requested", "user_id", userID,
+		"videos", len(req.Videos), "youtube_clips", len(req.YouTube), "audio_files", len(req.Audio))
 
 	// Validate required fields
 	if len(req.Videos) == 0 && len(req.YouTube) == 0 {
-		log.Printf("Video generation rejected - no videos or YouTube clips provided")
+		slog.WarnContext(ctx, "Video generation rejected - no videos or YouTube clips provided")
 		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one video or YouTube clip is required"})
 		return
 	}
 
-	// Validate and collect uploaded video file paths
+	// Validate and collect the storage keys of uploaded video files, adding up
+	// how long the result will be as we go
 	var uploadedVideos []string
+	var videoSeconds float64
+	for _, clip := range req.YouTube {
+		for _, segment := range clip.Segments {
+			start, startErr := timeToSeconds(segment.Timeline.Start)
+			end, endErr := timeToSeconds(segment.Timeline.End)
+			if startErr == nil && endErr == nil && end > start {
+				videoSeconds += clipSeconds(float64(end-start), segment.Options.Slowmotion)
+			}
+		}
+	}
 	for i, v := range req.Videos {
 		if v.File == "" {
-			log.Printf("Video generation failed - missing file URL for video %d", i)
+			slog.WarnContext(ctx, "Video generation rejected - missing file URL", "video", i)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Missing file URL for video %d", i)})
 			return
 		}
 		if !strings.HasPrefix(v.File, "/uploads/") {
-			log.Printf("Video generation failed - invalid file URL for video %d: %s", i, v.File)
+			slog.WarnContext(ctx, "Video generation rejected - invalid file URL", "video", i, "file", v.File)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid file URL for video %d", i)})
 			return
 		}
-		filePath := "." + v.File
-		if _, err := os.Stat(filePath); err != nil {
-			log.Printf("Video generation failed - file does not exist for video %d: %s", i, filePath)
+		asset, err := db.GetAssetByURL(v.File)
+		if err != nil || !assetInScope(asset, userID.(string), workspaceID) {
+			slog.WarnContext(ctx, "Video generation rejected - not an asset of the user", "video", i, "user_id", userID, "file", v.File)
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("File not found in your assets for video %d", i)})
+			return
+		}
+		if asset.Type != "video" {
+			slog.WarnContext(ctx, "Video generation rejected - asset is not a video", "video", i, "type", asset.Type, "file", v.File)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File for video %d is not a video file", i)})
+			return
+		}
+		if _, err := uploadStore.Stat(ctx, asset.StoredName); err != nil {
+			slog.WarnContext(ctx, "Video generation rejected - file does not exist", "video", i, "stored_name", asset.StoredName, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File does not exist for video %d", i)})
 			return
 		}
-		log.Printf("Video file validated: %s", filePath)
-		uploadedVideos = append(uploadedVideos, filePath)
+		slog.DebugContext(ctx, "Video file validated", "stored_name", asset.StoredName)
+		uploadedVideos = append(uploadedVideos, asset.StoredName)
+		videoSeconds += clipSeconds(assetDuration(ctx, asset), v.Options.Slowmotion)
 	}
 
-	// Validate and collect uploaded audio file paths
+	// Validate and collect the storage keys of uploaded audio files. The
+	// video runs on for as long as the longest of them.
 	var uploadedAudio []string
+	estimatedSeconds := videoSeconds
 	for i, a := range req.Audio {
 		if a.File == "" {
-			log.Printf("Video generation failed - missing file URL for audio %d", i)
+			slog.WarnContext(ctx, "Video generation rejected - missing file URL", "audio", i)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Missing file URL for audio %d", i)})
 			return
 		}
 		if !strings.HasPrefix(a.File, "/uploads/") {
-			log.Printf("Video generation failed - invalid file URL for audio %d: %s", i, a.File)
+			slog.WarnContext(ctx, "Video generation rejected - invalid file URL", "audio", i, "file", a.File)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid file URL for audio %d", i)})
 			return
 		}
-		filePath := "." + a.File
-		if _, err := os.Stat(filePath); err != nil {
-			log.Printf("Video generation failed - file does not exist for audio %d: %s", i, filePath)
+		asset, err := db.GetAssetByURL(a.File)
+		if err != nil || !assetInScope(asset, userID.(string), workspaceID) {
+			slog.WarnContext(ctx, "Video generation rejected - not an asset of the user", "audio", i, "user_id", userID, "file", a.File)
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("File not found in your assets for audio %d", i)})
+			return
+		}
+		if asset.Type != "audio" {
+			slog.WarnContext(ctx, "Video generation rejected - asset is not audio", "audio", i, "type", asset.Type, "file", a.File)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File for audio %d is not an audio file", i)})
+			return
+		}
+		if _, err := uploadStore.Stat(ctx, asset.StoredName); err != nil {
+			slog.WarnContext(ctx, "Video generation rejected - file does not exist", "audio", i, "stored_name", asset.StoredName, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("File does not exist for audio %d", i)})
 			return
 		}
-		log.Printf("Audio file validated: %s", filePath)
-		uploadedAudio = append(uploadedAudio, filePath)
+		slog.DebugContext(ctx, "Audio file validated", "stored_name", asset.StoredName)
+		uploadedAudio = append(uploadedAudio, asset.StoredName)
+		estimatedSeconds = math.Max(estimatedSeconds, assetDuration(ctx, asset))
+	}
+
+	if !checkStorageQuota(c, userID.(string), 0) {
+		return
+	}
+
+	unlock := taskLocks.Lock(userID.(string))
+	defer unlock()
+	if !checkActiveTaskLimit(c, userID.(string)) || !checkRenderQuota(c, userID.(string), estimatedSeconds) {
+		return
 	}
 
 	// Create task
@@ -489,12 +807,14 @@ func generateVideoHandler(c *gin.Context) {
 
 	taskDetailsJSON, err := json.Marshal(taskDetails)
 	if err != nil {
-		log.Printf("Failed to marshal task details for task %s: %v", taskID, err)
+		slog.ErrorContext(ctx, "Failed to marshal task details", "task_id", taskID, "error", err)
 	}
 
 	task := &models.Task{
 		ID:          taskID,
 		UserID:      userID.(string),
+		WorkspaceID: workspaceID,
+		Type:        "render",
 		Status:      "pending",
 		Progress:    0,
 		Message:     "Task created, preparing for processing",
@@ -503,15 +823,22 @@ func generateVideoHandler(c *gin.Context) {
 	}
 
 	if err := db.CreateTask(task); err != nil {
-		log.Printf("Failed to create task for user %s: %v", userID, err)
+		slog.ErrorContext(ctx, "Failed to create task", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
 		return
 	}
 
-	log.Printf("Created video generation task %s for user %s", taskID, userID)
+	// Count the render against the monthly quota until it finishes
+	if err := db.ReserveRenderUsage(taskID, userID.(string), estimatedSeconds); err != nil {
+		slog.ErrorContext(ctx, "Failed to reserve render usage", "task_id", taskID, "error", err)
+	}
+
+	slog.InfoContext(ctx, "Created video generation task", "task_id", taskID, "user_id", userID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditTaskCreate, TargetType: "task", TargetID: taskID, Details: map[string]string{"type": "render"}})
 
-	// Start processing in goroutine
-	go processVideoRequest(taskID, req, uploadedVideos, uploadedAudio)
+	// Start processing in goroutine, logging with the request's ID but without
+	// being cancelled when the request ends
+	go processVideoRequest(context.WithoutCancel(ctx), taskID, req, uploadedVideos, uploadedAudio)
 
 	c.JSON(http.StatusOK, TaskResponse{
 		TaskID:  taskID,
@@ -520,38 +847,142 @@ func generateVideoHandler(c *gin.Context) {
 	})
 }
 
-func getTaskStatusHandler(c *gin.Context) {
-	taskID := c.Param("taskId")
-	userID, exists := c.Get("userID")
+// clipSeconds returns how long a clip lasts in the rendered video
+func clipSeconds(seconds float64, slowmotion bool) float64 {
+	if slowmotion {
+		return seconds * 2 // applyVideoEffects plays it at half speed
+	}
+	return seconds
+}
 
-	task, err := db.GetTaskByID(taskID)
+// taskLocks serializes starting tasks for the same user, so concurrent
+// requests can't slip past the active task limit
+var taskLocks = &keyedMutex{locks: make(map[string]*refMutex)}
+
+// runningTasks lets an administrator stop a task that is being processed
+var runningTasks = &taskCancels{cancels: make(map[string]context.CancelFunc)}
+
+// taskCancels holds the cancel function of each task being processed
+type taskCancels struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// Start returns a context for processing taskID that Cancel stops, and the
+// function to call once processing is over
+func (t *taskCancels) Start(ctx context.Context, taskID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	t.mu.Lock()
+	t.cancels[taskID] = cancel
+	t.mu.Unlock()
+	return ctx, func() {
+		t.mu.Lock()
+		delete(t.cancels, taskID)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// Cancel stops processing taskID, killing its ffmpeg and yt-dlp runs. It
+// reports whether the task was running here.
+func (t *taskCancels) Cancel(taskID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cancel, ok := t.cancels[taskID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// checkActiveTaskLimit refuses to start another task while the user already
+// has MAX_ACTIVE_TASKS pending or processing, writing the error response
+// itself. Hold taskLocks for the user from the check until the task is
+// created.
+func checkActiveTaskLimit(c *gin.Context, userID string) bool {
+	limit := config.AppConfig.RateLimit.MaxActiveTasks
+	if limit <= 0 {
+		return true
+	}
+	active, err := db.CountActiveTasksByUserID(userID)
 	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count active tasks", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create task"})
+		return false
+	}
+	if active >= limit {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("You already have %d tasks in progress, wait for one to finish before starting another", active)})
+		return false
+	}
+	return true
+}
+
+// assetInScope reports whether an asset can be used in a task created in the
+// given workspace, or outside any workspace when workspaceID is empty
+func assetInScope(asset *models.Asset, userID, workspaceID string) bool {
+	if asset.DeletedAt != nil {
+		return false
+	}
+	if workspaceID == "" {
+		return asset.WorkspaceID == "" && asset.UserID == userID
+	}
+	return asset.WorkspaceID == workspaceID
+}
+
+// getAccessibleTask loads the task named in the URL, unless it is in the
+// trash, and checks that the caller
+// created it or has at least the given role in its workspace, writing the
+// error response itself when they don't
+func getAccessibleTask(c *gin.Context, userID, role string) (*models.Task, bool) {
+	task, err := db.GetTaskByID(c.Param("taskId"))
+	if err != nil || task.DeletedAt != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+		return nil, false
+	}
+	if !canAccess(userID, task.UserID, task.WorkspaceID, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return task, true
+}
+
+func getTaskStatusHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
 		return
 	}
 
-	// If user is authenticated, check ownership
-	if exists && task.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	task, ok := getAccessibleTask(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
 		return
 	}
 
+	withTaskDownloadURLs(task)
 	c.JSON(http.StatusOK, task)
 }
 
 func getUserTasksHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists || userID == nil {
-		log.Printf("Tasks request failed - missing userID in JWT context")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
 		return
 	}
 
-	log.Printf("Fetching tasks for user: %s", userID)
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
+		return
+	}
 
-	tasks, err := db.GetTasksByUserID(userID.(string))
+	var tasks []*models.Task
+	var err error
+	if workspaceID != "" {
+		tasks, err = db.GetTasksByWorkspaceID(workspaceID)
+	} else {
+		tasks, err = db.GetTasksByUserID(userID.(string))
+	}
 	if err != nil {
-		log.Printf("Failed to fetch tasks for user %s: %v", userID, err)
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch tasks", "user_id", userID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tasks"})
 		return
 	}
@@ -563,51 +994,62 @@ func getUserTasksHandler(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Found %d tasks for user %s", len(tasks), userID)
+	withTaskDownloadURLs(tasks...)
 	c.JSON(http.StatusOK, tasks)
 }
 
 func deleteTaskHandler(c *gin.Context) {
-	taskID := c.Param("taskId")
 	userID, exists := c.Get("userID")
 	if !exists || userID == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
 		return
 	}
-	task, err := db.GetTaskByID(taskID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+	task, ok := getAccessibleTask(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
 		return
 	}
-	if task.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
-	}
-	if err := db.DeleteTask(taskID); err != nil {
+	if err := db.TrashTask(task.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete task", "task_id", task.ID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete task"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Task deleted successfully"})
+	recordAudit(c, models.AuditEvent{Action: models.AuditTaskDelete, TargetType: "task", TargetID: task.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Task moved to the trash"})
 }
 
-func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []string, uploadedAudio []string) {
-	log.Printf("Starting video processing for task %s", taskID)
+// processVideoRequest renders a task. ctx carries the logging attributes of
+// the request that created it; every line logged for the task adds its ID.
+func processVideoRequest(ctx context.Context, taskID string, req VideoRequest, uploadedVideos []string, uploadedAudio []string) {
+	ctx = logging.With(ctx, "task_id", taskID)
+	ctx, done := runningTasks.Start(ctx, taskID)
+	defer done()
+	slog.InfoContext(ctx, "Starting video processing")
 
 	task, err := db.GetTaskByID(taskID)
 	if err != nil {
-		log.Printf("Failed to get task %s: %v", taskID, err)
+		slog.ErrorContext(ctx, "Failed to get task", "error", err)
 		return
 	}
 
+	// Failed renders don't count against the render quota
+	defer func() {
+		if task.Status != "completed" {
+			if err := db.ReleaseRenderUsage(taskID); err != nil {
+				slog.ErrorContext(ctx, "Failed to release render usage", "error", err)
+			}
+		}
+	}()
+
 	task.Status = "processing"
 	task.Message = "Starting video processing"
 	task.Progress = 10
-	if err := db.UpdateTask(task); err != nil {
-		log.Printf("Failed to update task %s status: %v", taskID, err)
+	if err := db.UpdateTask(task); errors.Is(err, models.ErrTaskFinished) {
+		slog.InfoContext(ctx, "Task was stopped before it started")
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to update task status", "error", err)
 	}
 
-	log.Printf("Task %s status updated to processing", taskID)
-
 	// Create temporary directory for this task
 	taskDir := filepath.Join(config.AppConfig.File.TempDir, taskID)
 	os.MkdirAll(taskDir, 0755)
@@ -626,25 +1068,23 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 
 	// Process YouTube videos
 	for _, ytClip := range req.YouTube {
-		log.Printf("Processing YouTube video: %s", ytClip.URL)
+		slog.InfoContext(ctx, "Processing YouTube video", "url", ytClip.URL)
 		task.Message = fmt.Sprintf("Downloading YouTube video: %s", ytClip.URL)
 		task.Progress = 20 + (videoIndex * 10)
 		if err := db.UpdateTask(task); err != nil {
-			log.Printf("Failed to update task %s progress: %v", taskID, err)
+			slog.ErrorContext(ctx, "Failed to update task progress", "error", err)
 		}
 
 		for _, segment := range ytClip.Segments {
 			fileName := fmt.Sprintf("yt_%d_%s.mp4", segment.Index, generateFileHash(ytClip.URL+segment.Timeline.Start+segment.Timeline.End))
 			outputPath := filepath.Join(taskDir, fileName)
 
-			log.Printf("Downloading YouTube segment: %s (%s - %s) with index %d", ytClip.URL, segment.Timeline.Start, segment.Timeline.End, segment.Index)
-
-			if err := downloadYouTubeSegment(ytClip.URL, ytClip.Quality, segment.Timeline, outputPath); err != nil {
-				log.Printf("Failed to download YouTube segment for task %s: %v", taskID, err)
+			if err := downloadYouTubeSegment(ctx, ytClip.URL, ytClip.Quality, segment.Timeline, outputPath); err != nil {
+				slog.ErrorContext(ctx, "Failed to download YouTube segment", "url", ytClip.URL, "index", segment.Index, "error", err)
 				task.Status = "failed"
 				task.Message = fmt.Sprintf("Failed to download YouTube video: %v", err)
 				if err := db.UpdateTask(task); err != nil {
-					log.Printf("Failed to update failed task %s: %v", taskID, err)
+					slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 				}
 				return
 			}
@@ -652,7 +1092,8 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 			// Apply segment options (slowmotion, mute)
 			if segment.Options.Slowmotion || segment.Options.Mute {
 				processedPath := filepath.Join(taskDir, fmt.Sprintf("processed_%s", fileName))
-				if err := applyVideoEffects(outputPath, processedPath, segment.Options.Slowmotion, segment.Options.Mute); err != nil {
+				if err := applyVideoEffects(ctx, outputPath, processedPath, segment.Options.Slowmotion, segment.Options.Mute); err != nil {
+					slog.ErrorContext(ctx, "Failed to apply effects to YouTube segment", "url", ytClip.URL, "index", segment.Index, "error", err)
 					task.Status = "failed"
 					task.Message = fmt.Sprintf("Failed to apply effects: %v", err)
 					db.UpdateTask(task)
@@ -674,23 +1115,29 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 
 	// Process uploaded video files
 	for i, video := range req.Videos {
-		log.Printf("Processing uploaded video %d: %s with index %d", i, video.File, video.Options.Index)
+		slog.InfoContext(ctx, "Processing uploaded video", "video", i, "file", video.File, "index", video.Options.Index)
 
-		// Find the corresponding uploaded video path
+		// Find the corresponding uploaded video and make it available locally
 		var videoPath string
-		for _, uploadedPath := range uploadedVideos {
-			if strings.HasSuffix(uploadedPath, filepath.Base(video.File)) {
-				videoPath = uploadedPath
+		for _, uploadedKey := range uploadedVideos {
+			if strings.HasSuffix(uploadedKey, filepath.Base(video.File)) {
+				localPath, cleanup, err := storage.Localize(ctx, uploadStore, uploadedKey, taskDir)
+				if err != nil {
+					slog.ErrorContext(ctx, "Failed to fetch uploaded video", "stored_name", uploadedKey, "error", err)
+					break
+				}
+				defer cleanup()
+				videoPath = localPath
 				break
 			}
 		}
 
 		if videoPath == "" {
-			log.Printf("Failed to find uploaded video path for %s", video.File)
+			slog.ErrorContext(ctx, "Failed to find uploaded video", "file", video.File)
 			task.Status = "failed"
 			task.Message = fmt.Sprintf("Failed to find uploaded video: %s", video.File)
 			if err := db.UpdateTask(task); err != nil {
-				log.Printf("Failed to update failed task %s: %v", taskID, err)
+				slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 			}
 			return
 		}
@@ -698,14 +1145,12 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 		// Apply video options if specified
 		if video.Options.Slowmotion || video.Options.Mute {
 			processedPath := filepath.Join(taskDir, fmt.Sprintf("processed_upload_%d.mp4", i))
-			log.Printf("Applying effects to video %d: slowmotion=%v, mute=%v", i, video.Options.Slowmotion, video.Options.Mute)
-
-			if err := applyVideoEffects(videoPath, processedPath, video.Options.Slowmotion, video.Options.Mute); err != nil {
-				log.Printf("Failed to apply effects to uploaded video %d: %v", i, err)
+			if err := applyVideoEffects(ctx, videoPath, processedPath, video.Options.Slowmotion, video.Options.Mute); err != nil {
+				slog.ErrorContext(ctx, "Failed to apply effects to uploaded video", "video", i, "error", err)
 				task.Status = "failed"
 				task.Message = fmt.Sprintf("Failed to apply effects to uploaded video: %v", err)
 				if err := db.UpdateTask(task); err != nil {
-					log.Printf("Failed to update failed task %s: %v", taskID, err)
+					slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 				}
 				return
 			}
@@ -726,11 +1171,11 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 	}
 
 	if len(videoClips) == 0 {
-		log.Printf("No video files to process for task %s", taskID)
+		slog.ErrorContext(ctx, "No video files to process")
 		task.Status = "failed"
 		task.Message = "No video files to process"
 		if err := db.UpdateTask(task); err != nil {
-			log.Printf("Failed to update failed task %s: %v", taskID, err)
+			slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 		}
 		return
 	}
@@ -740,50 +1185,48 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 		return videoClips[i].Index < videoClips[j].Index
 	})
 
-	log.Printf("Video clips sorted by index: %v", func() []int {
-		var indices []int
-		for _, clip := range videoClips {
-			indices = append(indices, clip.Index)
-		}
-		return indices
-	}())
-
 	// Extract file paths in sorted order
 	var videoFiles []string
 	for _, clip := range videoClips {
 		videoFiles = append(videoFiles, clip.FilePath)
-		log.Printf("Adding video file to merge (index %d): %s", clip.Index, clip.FilePath)
+		slog.DebugContext(ctx, "Adding video file to merge", "index", clip.Index, "path", clip.FilePath)
 	}
 
 	// Process audio files if provided
 	var audioFiles []string
 	if len(req.Audio) > 0 {
-		log.Printf("Processing %d audio files", len(req.Audio))
+		slog.InfoContext(ctx, "Processing audio files", "count", len(req.Audio))
 		task.Message = "Processing audio files"
 		task.Progress = 60
 		if err := db.UpdateTask(task); err != nil {
-			log.Printf("Failed to update task %s progress: %v", taskID, err)
+			slog.ErrorContext(ctx, "Failed to update task progress", "error", err)
 		}
 
 		for i, audio := range req.Audio {
-			// Find the corresponding uploaded audio path
+			// Find the corresponding uploaded audio and make it available locally
 			var audioPath string
-			for _, uploadedPath := range uploadedAudio {
-				if strings.HasSuffix(uploadedPath, filepath.Base(audio.File)) {
-					audioPath = uploadedPath
+			for _, uploadedKey := range uploadedAudio {
+				if strings.HasSuffix(uploadedKey, filepath.Base(audio.File)) {
+					localPath, cleanup, err := storage.Localize(ctx, uploadStore, uploadedKey, taskDir)
+					if err != nil {
+						slog.ErrorContext(ctx, "Failed to fetch uploaded audio", "stored_name", uploadedKey, "error", err)
+						break
+					}
+					defer cleanup()
+					audioPath = localPath
 					break
 				}
 			}
 
 			if audioPath == "" {
-				log.Printf("Failed to find uploaded audio path for %s", audio.File)
+				slog.WarnContext(ctx, "Skipping audio that could not be found", "file", audio.File)
 				continue
 			}
 
 			// Process audio with options (volume, fade in/out)
 			processedAudioPath := filepath.Join(taskDir, fmt.Sprintf("processed_audio_%d.mp3", i))
-			if err := processAudioFile(audioPath, processedAudioPath, audio.Options); err != nil {
-				log.Printf("Failed to process audio file %d: %v", i, err)
+			if err := processAudioFile(ctx, audioPath, processedAudioPath, audio.Options); err != nil {
+				slog.WarnContext(ctx, "Skipping audio that failed to process", "audio", i, "error", err)
 				continue
 			}
 			audioFiles = append(audioFiles, processedAudioPath)
@@ -791,40 +1234,60 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 	}
 
 	// Merge videos
-	log.Printf("Merging %d videos for task %s", len(videoFiles), taskID)
+	slog.InfoContext(ctx, "Merging videos", "count", len(videoFiles))
 	task.Message = "Merging videos"
 	task.Progress = 70
 	if err := db.UpdateTask(task); err != nil {
-		log.Printf("Failed to update task %s progress: %v", taskID, err)
+		slog.ErrorContext(ctx, "Failed to update task progress", "error", err)
 	}
 
-	outputFileName := fmt.Sprintf("merged_%s_%s.mp4", task.UserID, taskID)
-	outputPath := filepath.Join(config.AppConfig.File.OutputDir, outputFileName)
-	log.Printf("Output path for task %s: %s", taskID, outputPath)
+	// Render into the task directory, then hand the result to output storage
+	outputFileName := fmt.Sprintf("render_%s.mp4", taskID)
+	outputPath := filepath.Join(taskDir, outputFileName)
 
 	// If we have audio files, merge them with the video
 	if len(audioFiles) > 0 {
-		if err := mergeVideosWithAudio(videoFiles, audioFiles, outputPath, req.OutputSize, req.FPS); err != nil {
-			log.Printf("Failed to merge videos with audio for task %s: %v", taskID, err)
+		if err := mergeVideosWithAudio(ctx, videoFiles, audioFiles, outputPath, req.OutputSize, req.FPS); err != nil {
+			slog.ErrorContext(ctx, "Failed to merge videos with audio", "error", err)
 			task.Status = "failed"
 			task.Message = fmt.Sprintf("Failed to merge videos with audio: %v", err)
 			if err := db.UpdateTask(task); err != nil {
-				log.Printf("Failed to update failed task %s: %v", taskID, err)
+				slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 			}
 			return
 		}
 	} else {
-		if err := mergeVideos(videoFiles, outputPath, req.OutputSize, req.FPS); err != nil {
-			log.Printf("Failed to merge videos for task %s: %v", taskID, err)
+		if err := mergeVideos(ctx, videoFiles, outputPath, req.OutputSize, req.FPS); err != nil {
+			slog.ErrorContext(ctx, "Failed to merge videos", "error", err)
 			task.Status = "failed"
 			task.Message = fmt.Sprintf("Failed to merge videos: %v", err)
 			if err := db.UpdateTask(task); err != nil {
-				log.Printf("Failed to update failed task %s: %v", taskID, err)
+				slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
 			}
 			return
 		}
 	}
 
+	// Charge for what was actually rendered rather than the estimate
+	if duration, err := utils.ProbeDuration(ctx, outputPath); err != nil {
+		slog.ErrorContext(ctx, "Failed to measure output", "error", err)
+	} else if err := db.SettleRenderUsage(taskID, duration); err != nil {
+		slog.ErrorContext(ctx, "Failed to record render usage", "error", err)
+	}
+	if info, err := os.Stat(outputPath); err == nil {
+		task.OutputSize = info.Size()
+	}
+
+	if err := storage.PutFile(ctx, outputStore, outputFileName, outputPath); err != nil {
+		slog.ErrorContext(ctx, "Failed to store output", "error", err)
+		task.Status = "failed"
+		task.Message = fmt.Sprintf("Failed to save output: %v", err)
+		if err := db.UpdateTask(task); err != nil {
+			slog.ErrorContext(ctx, "Failed to update failed task", "error", err)
+		}
+		return
+	}
+
 	// Complete task
 	now := time.Now()
 	task.Status = "completed"
@@ -833,32 +1296,37 @@ func processVideoRequest(taskID string, req VideoRequest, uploadedVideos []strin
 	task.OutputFile = fmt.Sprintf("/output/%s", outputFileName)
 	task.CompletedAt = &now
 
-	log.Printf("Task %s completed successfully. Output: %s", taskID, task.OutputFile)
-
-	if err := db.UpdateTask(task); err != nil {
-		log.Printf("Failed to update completed task %s: %v", taskID, err)
+	if err := db.UpdateTask(task); errors.Is(err, models.ErrTaskFinished) {
+		// Failed by an administrator while the output was being stored
+		slog.InfoContext(ctx, "Task was stopped, discarding its output")
+		task.Status = "failed"
+		if err := outputStore.Delete(context.WithoutCancel(ctx), outputFileName); err != nil {
+			slog.ErrorContext(ctx, "Failed to delete output of stopped task", "error", err)
+		}
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, "Failed to update completed task", "error", err)
 	}
+
+	slog.InfoContext(ctx, "Task completed", "output", task.OutputFile)
 }
 
-func downloadYouTubeSegment(url, quality string, timeline TimelineOptions, outputPath string) error {
-	log.Printf("Downloading YouTube segment: %s (%s - %s) to %s", url, timeline.Start, timeline.End, outputPath)
+func downloadYouTubeSegment(ctx context.Context, url, quality string, timeline TimelineOptions, outputPath string) error {
+	slog.InfoContext(ctx, "Downloading YouTube segment", "url", url, "start", timeline.Start, "end", timeline.End)
 
 	// Convert time format from MM:SS to seconds
 	startSeconds, err := timeToSeconds(timeline.Start)
 	if err != nil {
-		log.Printf("Invalid start time for YouTube download: %s", timeline.Start)
 		return fmt.Errorf("invalid start time: %v", err)
 	}
 
 	endSeconds, err := timeToSeconds(timeline.End)
 	if err != nil {
-		log.Printf("Invalid end time for YouTube download: %s", timeline.End)
 		return fmt.Errorf("invalid end time: %v", err)
 	}
 
 	duration := endSeconds - startSeconds
 	if duration <= 0 {
-		log.Printf("Invalid time range for YouTube download: %s - %s", timeline.Start, timeline.End)
 		return fmt.Errorf("invalid time range")
 	}
 
@@ -872,20 +1340,21 @@ func downloadYouTubeSegment(url, quality string, timeline TimelineOptions, outpu
 		url,
 	}
 
-	log.Printf("Running yt-dlp command: %s %v", config.AppConfig.File.YTDLPPath, args)
-	cmd := exec.Command(config.AppConfig.File.YTDLPPath, args...)
+	slog.DebugContext(ctx, "Running yt-dlp", "command", config.AppConfig.File.YTDLPPath, "args", args)
+	defer timeStage(stageDownload)()
+	cmd := exec.CommandContext(ctx, config.AppConfig.File.YTDLPPath, args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("%s failed for %s: %v, output: %s", config.AppConfig.File.YTDLPPath, url, err, string(output))
+		commandFailures.Inc(commandYTDLP)
 		return fmt.Errorf("%s failed: %v, output: %s", config.AppConfig.File.YTDLPPath, err, string(output))
 	}
 
-	log.Printf("YouTube segment downloaded successfully: %s", outputPath)
+	slog.DebugContext(ctx, "YouTube segment downloaded", "path", outputPath)
 	return nil
 }
 
-func applyVideoEffects(inputPath, outputPath string, slowmotion, mute bool) error {
-	log.Printf("Applying video effects: %s -> %s (slowmotion=%v, mute=%v)", inputPath, outputPath, slowmotion, mute)
+func applyVideoEffects(ctx context.Context, inputPath, outputPath string, slowmotion, mute bool) error {
+	slog.InfoContext(ctx, "Applying video effects", "input", inputPath, "slowmotion", slowmotion, "mute", mute)
 
 	args := []string{"-i", inputPath}
 
@@ -906,23 +1375,23 @@ func applyVideoEffects(inputPath, outputPath string, slowmotion, mute bool) erro
 
 	args = append(args, "-c:v", "libx264", outputPath)
 
-	log.Printf("Running ffmpeg command: ffmpeg %v", args)
-	cmd := exec.Command("ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg", "args", args)
+	defer timeStage(stageEffects)()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("ffmpeg failed for effects: %v, output: %s", err, string(output))
+		commandFailures.Inc(commandFFmpeg)
 		return fmt.Errorf("ffmpeg failed: %v, output: %s", err, string(output))
 	}
 
-	log.Printf("Video effects applied successfully: %s", outputPath)
+	slog.DebugContext(ctx, "Video effects applied", "path", outputPath)
 	return nil
 }
 
-func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) error {
-	log.Printf("Merging %d videos to %s with size %s and FPS %d", len(inputFiles), outputPath, outputSize, fps)
+func mergeVideos(ctx context.Context, inputFiles []string, outputPath, outputSize string, fps int) error {
+	slog.DebugContext(ctx, "Merging videos", "count", len(inputFiles), "output", outputPath, "size", outputSize, "fps", fps)
 
 	if len(inputFiles) == 0 {
-		log.Printf("No input files provided for merge")
 		return fmt.Errorf("no input files provided")
 	}
 
@@ -931,7 +1400,6 @@ func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) er
 	for i, file := range inputFiles {
 		// Check if file exists
 		if _, err := os.Stat(file); os.IsNotExist(err) {
-			log.Printf("Input file does not exist: %s", file)
 			return fmt.Errorf("input file does not exist: %s", file)
 		}
 
@@ -940,8 +1408,7 @@ func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) er
 		if i > 0 || len(inputFiles) > 1 {
 			// For multiple files or if we want to ensure consistency, normalize FPS
 			normalizedPath = strings.TrimSuffix(file, filepath.Ext(file)) + "_normalized.mp4"
-			if err := normalizeVideoFPS(file, normalizedPath, fps); err != nil {
-				log.Printf("Failed to normalize FPS for %s: %v", file, err)
+			if err := normalizeVideoFPS(ctx, file, normalizedPath, fps); err != nil {
 				return fmt.Errorf("failed to normalize FPS: %v", err)
 			}
 			defer os.Remove(normalizedPath) // Clean up temporary file
@@ -956,16 +1423,13 @@ func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) er
 		// Convert to absolute path to avoid relative path issues
 		absPath, err := filepath.Abs(file)
 		if err != nil {
-			log.Printf("Failed to get absolute path for %s: %v", file, err)
 			return fmt.Errorf("failed to resolve file path: %v", err)
 		}
 		listContent += fmt.Sprintf("file '%s'\n", absPath)
-		log.Printf("Adding normalized file to merge list: %s (absolute: %s)", file, absPath)
 	}
 
-	log.Printf("Creating input list file: %s", listFile)
+	slog.DebugContext(ctx, "Creating input list file", "path", listFile, "files", normalizedFiles)
 	if err := os.WriteFile(listFile, []byte(listContent), 0644); err != nil {
-		log.Printf("Failed to create input list file: %v", err)
 		return fmt.Errorf("failed to create input list: %v", err)
 	}
 	defer os.Remove(listFile)
@@ -987,8 +1451,6 @@ func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) er
 		width, height = 1920, 1080
 	}
 
-	log.Printf("Output dimensions: %dx%d", width, height)
-
 	// Build ffmpeg command
 	args := []string{
 		"-f", "concat",
@@ -1004,20 +1466,16 @@ func mergeVideos(inputFiles []string, outputPath, outputSize string, fps int) er
 		outputPath,
 	}
 
-	// Get current working directory for debugging
-	if cwd, err := os.Getwd(); err == nil {
-		log.Printf("Current working directory: %s", cwd)
-	}
-
-	log.Printf("Running ffmpeg merge command: ffmpeg %v", args)
-	cmd := exec.Command("ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg merge", "args", args)
+	defer timeStage(stageMerge)()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("ffmpeg merge failed: %v, output: %s", err, string(output))
+		commandFailures.Inc(commandFFmpeg)
 		return fmt.Errorf("ffmpeg merge failed: %v, output: %s", err, string(output))
 	}
 
-	log.Printf("Videos merged successfully: %s", outputPath)
+	slog.DebugContext(ctx, "Videos merged", "path", outputPath)
 	return nil
 }
 
@@ -1045,89 +1503,133 @@ func generateFileHash(input string) string {
 	return fmt.Sprintf("%x", hash)[:8]
 }
 
+// multipartOverhead leaves room for the multipart boundaries and part headers
+// around the file when limiting the size of an upload request
+const multipartOverhead = 1024 * 1024
+
 // uploadFileHandler handles video/audio file uploads with validation
 func uploadFileHandler(c *gin.Context) {
-	log.Printf("📤 [Upload] Request received for path: %s", c.Request.URL.Path)
-	log.Printf("📤 [Upload] Authorization header: %s", c.GetHeader("Authorization"))
-	log.Printf("📤 [Upload] All headers: %v", c.Request.Header)
-
+	ctx := c.Request.Context()
 	userID, exists := c.Get("userID")
-	log.Printf("📤 [Upload] userID from context: %v, exists: %v", userID, exists)
-
-	// Check all context keys
-	keys := make([]string, 0)
-	for key := range c.Keys {
-		keys = append(keys, key)
-	}
-	log.Printf("📤 [Upload] All context keys: %v", keys)
-
 	if !exists || userID == nil {
-		log.Printf("📤 [Upload] Unauthorized - userID not found in context")
+		slog.WarnContext(ctx, "Upload rejected - missing userID in JWT context")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
 		return
 	}
-	log.Printf("📤 [Upload] User authenticated: %s", userID)
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	// Cut the request off while it streams in rather than after it has been
+	// buffered; the per-type limit is checked once we know the file's type
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, utils.MaxUploadSize()+multipartOverhead)
+
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
-		log.Printf("Upload error - no file: %v", err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			slog.WarnContext(ctx, "Upload rejected - request body too large", "limit", maxBytesErr.Limit)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("File too large (max %s)", utils.FormatSize(utils.MaxUploadSize()))})
+			return
+		}
+		slog.WarnContext(ctx, "Upload rejected - no file", "error", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
 		return
 	}
 	defer file.Close()
 
-	log.Printf("File upload attempt: %s, size: %d bytes, type: %s",
-		header.Filename, header.Size, header.Header.Get("Content-Type"))
-
-	// Validate file size (max 100MB for video, 20MB for audio)
-	maxVideoSize := int64(100 * 1024 * 1024) // 100MB
-	maxAudioSize := int64(20 * 1024 * 1024)  // 20MB
-	fileType := header.Header.Get("Content-Type")
+	slog.InfoContext(ctx, "File upload attempt", "name", header.Filename, "size", header.Size, "content_type", header.Header.Get("Content-Type"))
 
-	if strings.HasPrefix(fileType, "video/") {
-		if header.Size > maxVideoSize {
-			log.Printf("Upload rejected - video file too large: %s (%d bytes)", header.Filename, header.Size)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Video file too large (max 100MB)"})
-			return
-		}
-		if err := utils.ValidateVideoFile(header); err != nil {
-			log.Printf("Upload rejected - invalid video file %s: %v", header.Filename, err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-	} else if strings.HasPrefix(fileType, "audio/") {
-		if header.Size > maxAudioSize {
-			log.Printf("Upload rejected - audio file too large: %s (%d bytes)", header.Filename, header.Size)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Audio file too large (max 20MB)"})
-			return
-		}
-		if err := utils.ValidateAudioFile(header); err != nil {
-			log.Printf("Upload rejected - invalid audio file %s: %v", header.Filename, err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-	} else {
-		log.Printf("Upload rejected - unsupported file type: %s (%s)", header.Filename, fileType)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported file type"})
+	assetType, err := utils.ValidateUpload(header.Filename, header.Size)
+	if err != nil {
+		slog.WarnContext(ctx, "Upload rejected", "name", header.Filename, "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkStorageQuota(c, userID.(string), header.Size) {
 		return
 	}
 
 	// Save file
-	fileInfo, err := utils.SaveFile(header, config.AppConfig.File.UploadsDir)
+	fileInfo, err := utils.SaveFile(ctx, header, uploadStore)
+	if err != nil {
+		slog.ErrorContext(ctx, "Upload failed - could not save file", "name", header.Filename, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	// The extension only tells us what the client claims; check the actual content
+	localPath, cleanup, err := storage.Localize(ctx, uploadStore, fileInfo.StoredName, config.AppConfig.File.TempDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "Upload failed - could not read the file back", "name", header.Filename, "error", err)
+		uploadStore.Delete(ctx, fileInfo.StoredName)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	err = utils.VerifyMediaFile(c.Request.Context(), localPath, assetType)
+	if err == nil {
+		fileInfo.Duration = probeMediaDuration(c.Request.Context(), localPath, assetType)
+	}
+	cleanup()
+	if err != nil {
+		slog.WarnContext(ctx, "Upload rejected - content check failed", "name", header.Filename, "error", err)
+		uploadStore.Delete(ctx, fileInfo.StoredName)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	asset, err := registerAsset(userID.(string), workspaceID, assetType, fileInfo)
 	if err != nil {
-		log.Printf("Upload failed - save error for %s: %v", header.Filename, err)
+		slog.ErrorContext(ctx, "Upload failed - could not register asset", "name", header.Filename, "error", err)
+		uploadStore.Delete(ctx, fileInfo.StoredName)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
+	recordAudit(c, uploadAuditEvent(asset, "upload"))
+	uploadedBytes.Add(float64(asset.Size), "multipart")
+
 	// Return file URL
-	fileURL := "/uploads/" + fileInfo.StoredName
-	log.Printf("Upload successful: %s -> %s", header.Filename, fileURL)
-	c.JSON(http.StatusOK, gin.H{"url": fileURL})
+	slog.InfoContext(ctx, "Upload successful", "name", header.Filename, "asset_id", asset.ID, "url", asset.URL)
+	withAssetDownloadURLs(asset)
+	c.JSON(http.StatusOK, gin.H{"url": asset.URL, "asset": asset})
+}
+
+// registerAsset records a file saved in upload storage in the asset library of
+// a workspace, or of the user when workspaceID is empty
+func registerAsset(userID, workspaceID, assetType string, fileInfo *utils.FileInfo) (*models.Asset, error) {
+	asset := &models.Asset{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		WorkspaceID: workspaceID,
+		Name:        fileInfo.OriginalName,
+		StoredName:  fileInfo.StoredName,
+		Type:        assetType,
+		Size:        fileInfo.Size,
+		Duration:    fileInfo.Duration,
+		URL:         "/uploads/" + fileInfo.StoredName,
+		CreatedAt:   time.Now(),
+	}
+	if err := db.CreateAsset(asset); err != nil {
+		return nil, err
+	}
+	return asset, nil
+}
+
+// uploadAuditEvent describes a new asset for the audit log
+func uploadAuditEvent(asset *models.Asset, via string) models.AuditEvent {
+	return models.AuditEvent{
+		Action:     models.AuditUpload,
+		TargetType: "asset",
+		TargetID:   asset.ID,
+		Details:    map[string]string{"name": asset.Name, "size": strconv.FormatInt(asset.Size, 10), "via": via},
+	}
 }
 
-func processAudioFile(inputPath, outputPath string, options AudioOptions) error {
-	log.Printf("Processing audio file: %s with volume %.2f, fadeIn: %v, fadeOut: %v",
-		inputPath, options.Volume, options.FadeIn, options.FadeOut)
+func processAudioFile(ctx context.Context, inputPath, outputPath string, options AudioOptions) error {
+	slog.DebugContext(ctx, "Processing audio file", "input", inputPath, "volume", options.Volume, "fade_in", options.FadeIn, "fade_out", options.FadeOut)
 
 	// Build ffmpeg command for audio processing
 	args := []string{
@@ -1147,17 +1649,15 @@ func processAudioFile(inputPath, outputPath string, options AudioOptions) error
 		}
 		if options.FadeOut {
 			// Get duration first to calculate fade out start time
-			durationCmd := exec.Command("ffprobe", "-v", "quiet", "-show_entries", "format=duration", "-of", "csv=p=0", inputPath)
+			durationCmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-show_entries", "format=duration", "-of", "csv=p=0", inputPath)
 			durationOutput, err := durationCmd.Output()
 			if err != nil {
-				log.Printf("Failed to get audio duration: %v", err)
 				return fmt.Errorf("failed to get audio duration: %v", err)
 			}
 
 			durationStr := strings.TrimSpace(string(durationOutput))
 			duration, err := strconv.ParseFloat(durationStr, 64)
 			if err != nil {
-				log.Printf("Failed to parse audio duration: %v", err)
 				return fmt.Errorf("failed to parse audio duration: %v", err)
 			}
 
@@ -1183,30 +1683,28 @@ func processAudioFile(inputPath, outputPath string, options AudioOptions) error
 		outputPath,
 	)
 
-	log.Printf("Running ffmpeg audio processing command: ffmpeg %v", args)
-	cmd := exec.Command("ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg audio processing", "args", args)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("ffmpeg audio processing failed: %v, output: %s", err, string(output))
+		commandFailures.Inc(commandFFmpeg)
 		return fmt.Errorf("ffmpeg audio processing failed: %v, output: %s", err, string(output))
 	}
 
-	log.Printf("Audio processing completed successfully: %s", outputPath)
+	slog.DebugContext(ctx, "Audio processed", "path", outputPath)
 	return nil
 }
 
-func mergeVideosWithAudio(videoFiles, audioFiles []string, outputPath, outputSize string, fps int) error {
-	log.Printf("Merging %d videos with %d audio files to %s", len(videoFiles), len(audioFiles), outputPath)
+func mergeVideosWithAudio(ctx context.Context, videoFiles, audioFiles []string, outputPath, outputSize string, fps int) error {
+	slog.DebugContext(ctx, "Merging videos with audio", "videos", len(videoFiles), "audio_files", len(audioFiles), "output", outputPath)
 
 	if len(videoFiles) == 0 {
-		log.Printf("No video files provided for merge")
 		return fmt.Errorf("no video files provided")
 	}
 
 	// First, merge videos without audio
 	tempVideoPath := strings.TrimSuffix(outputPath, ".mp4") + "_temp_video.mp4"
-	if err := mergeVideos(videoFiles, tempVideoPath, outputSize, fps); err != nil {
-		log.Printf("Failed to merge videos: %v", err)
+	if err := mergeVideos(ctx, videoFiles, tempVideoPath, outputSize, fps); err != nil {
 		return fmt.Errorf("failed to merge videos: %v", err)
 	}
 	defer os.Remove(tempVideoPath)
@@ -1268,20 +1766,21 @@ func mergeVideosWithAudio(videoFiles, audioFiles []string, outputPath, outputSiz
 		outputPath,
 	)
 
-	log.Printf("Running ffmpeg merge with audio command: ffmpeg %v", args)
-	cmd := exec.Command("ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg merge with audio", "args", args)
+	defer timeStage(stageMux)()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("ffmpeg merge with audio failed: %v, output: %s", err, string(output))
+		commandFailures.Inc(commandFFmpeg)
 		return fmt.Errorf("ffmpeg merge with audio failed: %v, output: %s", err, string(output))
 	}
 
-	log.Printf("Videos merged with audio successfully: %s", outputPath)
+	slog.DebugContext(ctx, "Videos merged with audio", "path", outputPath)
 	return nil
 }
 
-func normalizeVideoFPS(inputPath, outputPath string, targetFPS int) error {
-	log.Printf("Normalizing video FPS: %s -> %s (target: %d fps)", inputPath, outputPath, targetFPS)
+func normalizeVideoFPS(ctx context.Context, inputPath, outputPath string, targetFPS int) error {
+	slog.DebugContext(ctx, "Normalizing video FPS", "input", inputPath, "fps", targetFPS)
 
 	// Build ffmpeg command to normalize FPS
 	args := []string{
@@ -1295,14 +1794,15 @@ func normalizeVideoFPS(inputPath, outputPath string, targetFPS int) error {
 		outputPath,
 	}
 
-	log.Printf("Running ffmpeg FPS normalization command: ffmpeg %v", args)
-	cmd := exec.Command("ffmpeg", args...)
+	slog.DebugContext(ctx, "Running ffmpeg FPS normalization", "args", args)
+	defer timeStage(stageNormalize)()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("ffmpeg FPS normalization failed: %v, output: %s", err, string(output))
+		commandFailures.Inc(commandFFmpeg)
 		return fmt.Errorf("ffmpeg FPS normalization failed: %v, output: %s", err, string(output))
 	}
 
-	log.Printf("Video FPS normalized successfully: %s", outputPath)
+	slog.DebugContext(ctx, "Video FPS normalized", "path", outputPath)
 	return nil
 }
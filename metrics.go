@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"clipflow/config"
+	"clipflow/metrics"
+	"clipflow/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pipeline stages timed in pipelineStageDuration
+const (
+	stageDownload  = "download"  // yt-dlp fetching a YouTube segment
+	stageEffects   = "effects"   // Slow motion and muting
+	stageNormalize = "normalize" // Converting a clip to the output frame rate
+	stageMerge     = "merge"     // Concatenating the clips
+	stageMux       = "mux"       // Mixing the audio tracks into the merged video
+)
+
+// Commands counted in commandFailures
+const (
+	commandFFmpeg = "ffmpeg"
+	commandYTDLP  = "yt-dlp"
+)
+
+// Renders take from seconds to many minutes
+var stageBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800}
+
+var (
+	pipelineStageDuration = metrics.NewHistogramVec("clipflow_pipeline_stage_duration_seconds",
+		"How long each stage of the render pipeline took, including runs that failed.", stageBuckets, "stage")
+	commandFailures = metrics.NewCounterVec("clipflow_command_failures_total",
+		"ffmpeg and yt-dlp runs that failed to start or exited with an error.", "command")
+	uploadedBytes = metrics.NewCounterVec("clipflow_uploaded_bytes_total",
+		"Bytes of files uploaded, by upload method.", "method")
+)
+
+// taskStatuses are always reported, so a status with no tasks shows as 0
+// rather than disappearing
+var taskStatuses = []string{"pending", "processing", "completed", "failed"}
+
+// registerMetricGauges adds the gauges that are read from the database and
+// filesystem on each scrape
+func registerMetricGauges() {
+	metrics.NewGaugeFunc("clipflow_tasks", "Tasks by status, including those in the trash.", []string{"status"},
+		func(set func(float64, ...string)) {
+			stats, err := db.GetQueueStats()
+			if err != nil {
+				slog.Error("Failed to count tasks for metrics", "error", err)
+				return
+			}
+			for _, status := range taskStatuses {
+				set(float64(stats.Counts[status]), status)
+			}
+			for status, count := range stats.Counts {
+				set(float64(count), status)
+			}
+		})
+
+	metrics.NewGaugeFunc("clipflow_disk_free_bytes", "Free space on the filesystems holding the temp and output directories.", []string{"dir"},
+		func(set func(float64, ...string)) {
+			for _, dir := range []struct{ name, path string }{
+				{"temp", config.AppConfig.File.TempDir},
+				{"output", config.AppConfig.File.OutputDir},
+			} {
+				free, err := utils.FreeDiskSpace(dir.path)
+				if err != nil {
+					slog.Debug("Failed to read free disk space for metrics", "dir", dir.path, "error", err)
+					continue
+				}
+				set(float64(free), dir.name)
+			}
+		})
+}
+
+// timeStage starts timing a pipeline stage; call the returned function when
+// it ends, e.g. defer timeStage(stageMerge)()
+func timeStage(stage string) func() {
+	start := time.Now()
+	return func() {
+		pipelineStageDuration.Observe(time.Since(start).Seconds(), stage)
+	}
+}
+
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", metrics.ContentType)
+	c.Status(http.StatusOK)
+	if err := metrics.Write(c.Writer); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to write metrics", "error", err)
+	}
+}
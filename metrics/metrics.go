@@ -0,0 +1,276 @@
+// Package metrics keeps counters, histograms and gauges in memory and writes
+// them in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of what Write produces
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram buckets, in seconds, suited to HTTP requests
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, m)
+}
+
+// Write writes every metric created so far to w, in the order they were
+// created
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]metric{}, registry...)
+	registryMu.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+// series holds what is common to every time series of a metric: its label
+// values, in the order of the metric's label names
+type series struct {
+	labelValues []string
+}
+
+// seriesKey identifies a combination of label values
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func checkLabels(name string, labels, labelValues []string) {
+	if len(labels) != len(labelValues) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", name, len(labels), len(labelValues)))
+	}
+}
+
+// CounterVec is a counter split by labels, which only ever goes up
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*counterSeries
+}
+
+type counterSeries struct {
+	series
+	value float64
+}
+
+// NewCounterVec creates a counter with the given label names and adds it to
+// what Write writes
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterSeries)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds value, which must not be negative, to the series with the given
+// label values
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	checkLabels(c.name, c.labels, labelValues)
+	if value < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot go down", c.name))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := c.values[key]
+	if !ok {
+		s = &counterSeries{series: series{labelValues: append([]string{}, labelValues...)}}
+		c.values[key] = s
+	}
+	s.value += value
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		s := c.values[key]
+		writeSample(w, c.name, c.labels, s.labelValues, s.value)
+	}
+}
+
+// HistogramVec counts observations, such as durations, into buckets, split
+// by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	series
+	counts []uint64 // Observations in each bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec creates a histogram with the given upper bucket bounds, in
+// increasing order, and label names, and adds it to what Write writes. A
+// +Inf bucket is always added.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not in increasing order", name))
+	}
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+// Observe counts value in the series with the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	checkLabels(h.name, h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := seriesKey(labelValues)
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogramSeries{
+			series: series{labelValues: append([]string{}, labelValues...)},
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+	// Values above the last bound are only in the +Inf bucket, i.e. count
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labelValues...), formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labelValues...), "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, float64(s.count))
+	}
+}
+
+// GaugeFunc is a gauge whose values are read when the metrics are written,
+// for things that are cheaper to look up than to track, like free disk space
+type GaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc creates a gauge with the given label names and adds it to what
+// Write writes. Each time, collect is called and reports the current value
+// of every series by calling set.
+func NewGaugeFunc(name, help string, labels []string, collect func(set func(value float64, labelValues ...string))) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, collect: collect}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	values := make(map[string]*counterSeries)
+	g.collect(func(value float64, labelValues ...string) {
+		checkLabels(g.name, g.labels, labelValues)
+		values[seriesKey(labelValues)] = &counterSeries{series: series{labelValues: append([]string{}, labelValues...)}, value: value}
+	})
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedKeys(values) {
+		s := values[key]
+		writeSample(w, g.name, g.labels, s.labelValues, s.value)
+	}
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelValueEscaper.Replace(labelValues[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
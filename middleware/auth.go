@@ -1,7 +1,7 @@
 package middleware
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 
@@ -11,9 +11,28 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware validates JWT tokens and sets user context
+// AuthMiddleware validates JWT tokens or API keys and sets user context
 func AuthMiddleware(db *models.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if rawKey := c.GetHeader(APIKeyHeader); rawKey != "" {
+			user, key, err := authenticateAPIKey(db, rawKey)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired API key"})
+				c.Abort()
+				return
+			}
+			if user.Disabled() {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+				c.Abort()
+				return
+			}
+			c.Set("user", user)
+			c.Set("userID", user.ID)
+			c.Set("apiKey", key)
+			c.Next()
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -39,6 +58,13 @@ func AuthMiddleware(db *models.Database) gin.HandlerFunc {
 			return
 		}
 
+		// Reject tokens whose session has been revoked
+		if !sessionActive(db, claims) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked or expired"})
+			c.Abort()
+			return
+		}
+
 		// Get user from database
 		user, err := db.GetUserByID(claims.UserID)
 		if err != nil {
@@ -46,62 +72,95 @@ func AuthMiddleware(db *models.Database) gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		if user.Disabled() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+			c.Abort()
+			return
+		}
 
 		// Set user in context
 		c.Set("user", user)
 		c.Set("userID", user.ID)
+		c.Set("sessionID", claims.SessionID)
 		c.Next()
 	}
 }
 
-// OptionalAuthMiddleware validates JWT tokens if present but doesn't require them
+// OptionalAuthMiddleware validates JWT tokens or API keys if present but doesn't require them
 func OptionalAuthMiddleware(db *models.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		log.Printf("🔐 [Middleware] Authorization header: %s", authHeader)
+		ctx := c.Request.Context()
+		if rawKey := c.GetHeader(APIKeyHeader); rawKey != "" {
+			user, key, err := authenticateAPIKey(db, rawKey)
+			if err != nil {
+				slog.DebugContext(ctx, "API key rejected, proceeding without auth", "error", err)
+				c.Next()
+				return
+			}
+			if user.Disabled() {
+				slog.DebugContext(ctx, "User is disabled, proceeding without auth", "user_id", user.ID)
+				c.Next()
+				return
+			}
+			slog.DebugContext(ctx, "Authenticated with API key", "api_key_id", key.ID, "user_id", user.ID)
+			c.Set("user", user)
+			c.Set("userID", user.ID)
+			c.Set("apiKey", key)
+			c.Next()
+			return
+		}
 
+		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			log.Printf("🔐 [Middleware] No Authorization header found, proceeding without auth")
 			c.Next()
 			return
 		}
 
 		if !strings.HasPrefix(authHeader, "Bearer ") {
-			log.Printf("🔐 [Middleware] Invalid Authorization header format (missing 'Bearer ' prefix)")
+			slog.DebugContext(ctx, "Invalid Authorization header format (missing 'Bearer ' prefix), proceeding without auth")
 			c.Next()
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		log.Printf("🔐 [Middleware] Token string: %s...", tokenString[:min(len(tokenString), 20)])
-
 		claims, err := auth.ValidateToken(tokenString)
 		if err != nil {
-			log.Printf("🔐 [Middleware] Token validation failed: %v", err)
+			slog.DebugContext(ctx, "Token validation failed, proceeding without auth", "error", err)
+			c.Next()
+			return
+		}
+
+		if !sessionActive(db, claims) {
+			slog.DebugContext(ctx, "Session has been revoked or expired, proceeding without auth", "session_id", claims.SessionID)
 			c.Next()
 			return
 		}
-		log.Printf("🔐 [Middleware] Token validated successfully, userID: %s", claims.UserID)
 
 		user, err := db.GetUserByID(claims.UserID)
 		if err != nil {
-			log.Printf("🔐 [Middleware] Failed to get user from database: %v", err)
-			log.Printf("🔐 [Middleware] UserID from token not found in database, proceeding without auth")
+			slog.DebugContext(ctx, "User from token not found, proceeding without auth", "user_id", claims.UserID, "error", err)
+			c.Next()
+			return
+		}
+		if user.Disabled() {
+			slog.DebugContext(ctx, "User is disabled, proceeding without auth", "user_id", user.ID)
 			c.Next()
 			return
 		}
-		log.Printf("🔐 [Middleware] User found in database: %s (%s)", user.ID, user.Email)
 
 		c.Set("user", user)
 		c.Set("userID", user.ID)
-		log.Printf("🔐 [Middleware] User context set successfully for path: %s", c.Request.URL.Path)
+		c.Set("sessionID", claims.SessionID)
 		c.Next()
 	}
 }
 
-func min(a, b int) int {
-	if a < b {
-		return a
+// sessionActive checks that the session a token was issued for still exists
+// and hasn't been revoked
+func sessionActive(db *models.Database, claims *auth.Claims) bool {
+	session, err := db.GetSessionByID(claims.SessionID)
+	if err != nil {
+		return false
 	}
-	return b
+	return session.UserID == claims.UserID && session.Active()
 }
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"clipflow/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("clipflow_http_requests_total",
+		"HTTP requests handled, by method, route and status code.", "method", "route", "status")
+	httpRequestDuration = metrics.NewHistogramVec("clipflow_http_request_duration_seconds",
+		"How long HTTP requests took to handle, by method and route.", metrics.DefaultBuckets, "method", "route")
+)
+
+// Metrics counts and times requests by route, the pattern they matched like
+// /api/task/:taskId, so IDs in paths don't each get their own series
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.Inc(c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route)
+	}
+}
+
+// MetricsAuth guards the metrics endpoint with a static bearer token for the
+// scraper. An empty token lets nobody in.
+func MetricsAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing metrics token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
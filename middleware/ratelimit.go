@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenBucket holds the requests a caller has left. It refills continuously,
+// so its level is only brought up to date when it is used.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps one token bucket per caller for a group of routes
+type rateLimiter struct {
+	capacity float64
+	rate     float64 // Tokens added per second
+	window   time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// take spends a token from key's bucket if there is one. It returns the
+// tokens left, how long until the bucket is full again and, when the request
+// was refused, how long until a token is available.
+func (l *rateLimiter) take(key string, now time.Time) (allowed bool, remaining int, reset, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, 0, l.duration(l.capacity - bucket.tokens), l.duration(1 - bucket.tokens)
+	}
+	bucket.tokens--
+	return true, int(bucket.tokens), l.duration(l.capacity - bucket.tokens), 0
+}
+
+// sweep forgets buckets that have refilled completely, since a new bucket
+// would be just the same. It runs at most once per window.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// duration returns how long it takes to add the given number of tokens
+func (l *rateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// RateLimit allows each caller a burst of up to requests requests, refilled
+// evenly over window. Callers are told apart by API key, then user ID, then
+// IP address, so it should run after the auth middleware where there is one.
+// Responses carry the RateLimit-* headers; refused requests get 429 with
+// Retry-After. A limit of 0 turns it off.
+func RateLimit(requests int, window time.Duration) gin.HandlerFunc {
+	if requests <= 0 || window <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	limiter := &rateLimiter{
+		capacity: float64(requests),
+		rate:     float64(requests) / window.Seconds(),
+		window:   window,
+		buckets:  make(map[string]*tokenBucket),
+	}
+	policy := fmt.Sprintf("%d;w=%d", requests, int64(window.Seconds()))
+
+	return func(c *gin.Context) {
+		allowed, remaining, reset, wait := limiter.take(rateLimitKey(c), time.Now())
+
+		c.Header("RateLimit-Policy", policy)
+		c.Header("RateLimit-Limit", strconv.Itoa(requests))
+		c.Header("RateLimit-Remaining", strconv.Itoa(remaining))
+		c.Header("RateLimit-Reset", strconv.FormatInt(ceilSeconds(reset), 10))
+		if !allowed {
+			retryAfter := ceilSeconds(wait)
+			c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, please try again later", "retry_after": retryAfter})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// rateLimitKey identifies the caller a request counts against
+func rateLimitKey(c *gin.Context) string {
+	if value, exists := c.Get("apiKey"); exists {
+		if key, ok := value.(*models.APIKey); ok {
+			return "key:" + key.ID
+		}
+	}
+	if userID := c.GetString("userID"); userID != "" {
+		return "user:" + userID
+	}
+	return "ip:" + c.ClientIP()
+}
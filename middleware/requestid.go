@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"clipflow/logging"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request ID, both ways
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from clients or proxies to ones that
+// are safe to put in logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID gives every request an ID, reusing the one a proxy or client sent
+// in X-Request-ID if it looks sane. The ID is returned in the same header and
+// added to the request's context, so everything logged with that context,
+// including tasks the request starts, carries it.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		c.Set("requestID", id)
+		c.Header(RequestIDHeader, id)
+		c.Request = c.Request.WithContext(logging.With(c.Request.Context(), logging.RequestIDKey, id))
+		c.Next()
+	}
+}
+
+// RequestLogger logs each request once it has been handled, in place of gin's
+// own logger. Secrets in the query string are redacted like everything else.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", c.ClientIP(),
+			"bytes", c.Writer.Size(),
+		}
+		if query := c.Request.URL.RawQuery; query != "" {
+			attrs = append(attrs, "query", query)
+		}
+		if userID := c.GetString("userID"); userID != "" {
+			attrs = append(attrs, "user_id", userID)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+		slog.Log(c.Request.Context(), level, "Request handled", attrs...)
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"net/http"
+
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole only lets through callers whose account has the given role. It
+// must run after one of the auth middlewares. The role comes from the user
+// loaded for this request rather than the token's claims, so a demoted admin
+// loses access straight away instead of when their token expires.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get("user")
+		user, ok := value.(*models.User)
+		if !exists || !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			c.Abort()
+			return
+		}
+		if user.Role != role {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: requires the " + role + " role"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
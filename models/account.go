@@ -0,0 +1,136 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// anonymousEmailDomain is used for the placeholder emails of anonymous users
+const anonymousEmailDomain = "@clipflow.local"
+
+// IsAnonymous reports whether the user was created without credentials and
+// hasn't claimed the account yet
+func (u *User) IsAnonymous() bool {
+	return u.PasswordHash == "" && strings.HasSuffix(u.Email, anonymousEmailDomain)
+}
+
+// ClaimUser turns an anonymous user into a registered one. The device token
+// stops working, since the account now has a password.
+func (d *Database) ClaimUser(user *User) error {
+	user.UpdatedAt = time.Now()
+	_, err := d.db.Exec(`
+		UPDATE users SET email = ?, username = ?, password_hash = ?, email_verified = ?, device_token_hash = NULL, updated_at = ?
+		WHERE id = ?
+	`, user.Email, user.Username, user.PasswordHash, user.EmailVerified, user.UpdatedAt, user.ID)
+	if err != nil {
+		return err
+	}
+	user.DeviceTokenHash = ""
+	return nil
+}
+
+// ReclaimUnverifiedUser marks a user's email verified on behalf of whoever
+// proved they own it, after taking away every way in that the account's
+// registrant set up: its password, sessions, API keys, 2FA and outstanding
+// email tokens. Whoever registered the email first can't keep access to the
+// account its real owner goes on to use.
+func (d *Database) ReclaimUnverifiedUser(user *User) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	_, err = tx.Exec(`
+		UPDATE users SET password_hash = '', email_verified = 1, totp_enabled = 0, totp_secret = NULL, totp_last_step = 0, updated_at = ?
+		WHERE id = ?
+	`, now, user.ID)
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+		`UPDATE api_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`,
+	} {
+		if _, err := tx.Exec(query, now, user.ID); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"recovery_codes", "user_tokens"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, user.ID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	user.PasswordHash = ""
+	user.EmailVerified = true
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.UpdatedAt = now
+	return nil
+}
+
+// CountUserData returns how many tasks and assets a user owns
+func (d *Database) CountUserData(userID string) (tasks int, assets int, err error) {
+	err = d.db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM tasks WHERE user_id = ?), (SELECT COUNT(*) FROM assets WHERE user_id = ?)
+	`, userID, userID).Scan(&tasks, &assets)
+	return tasks, assets, err
+}
+
+// MergeUsers moves everything fromID owns to toID and deletes fromID. Its
+// sessions and API keys are revoked rather than moved, so nobody holding its
+// tokens gains access to the other account; it returns how many API keys were
+// revoked. Tables that belong to a user must be handled here too.
+func (d *Database) MergeUsers(fromID, toID string) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"tasks", "assets", "share_links", "upload_sessions", "render_usage", "user_identities"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET user_id = ? WHERE user_id = ?`, toID, fromID); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE workspaces SET created_by = ? WHERE created_by = ?`, toID, fromID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE workspace_invitations SET invited_by = ? WHERE invited_by = ?`, toID, fromID); err != nil {
+		return 0, err
+	}
+	// Where both were members of a workspace, toID keeps its own role
+	if _, err := tx.Exec(`UPDATE OR IGNORE workspace_members SET user_id = ? WHERE user_id = ?`, toID, fromID); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, now, fromID); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`UPDATE api_keys SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, now, fromID)
+	if err != nil {
+		return 0, err
+	}
+	revokedKeys, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// toID keeps its own quota, 2FA and pending tokens
+	for _, table := range []string{"workspace_members", "user_quotas", "recovery_codes", "user_tokens"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = ?`, fromID); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, fromID); err != nil {
+		return 0, err
+	}
+	return revokedKeys, tx.Commit()
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Disabled reports whether an admin has disabled the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
+}
+
+// UserFilter narrows down the users listed in the admin API
+type UserFilter struct {
+	Query    string // Matches email or username
+	Role     string
+	Disabled *bool
+	Limit    int
+	Offset   int
+}
+
+// TaskFilter narrows down the tasks listed in the admin API
+type TaskFilter struct {
+	Status string
+	UserID string
+	Limit  int
+	Offset int
+}
+
+func createRoleColumns(db *sql.DB) error {
+	// Add role columns to users if they don't exist (for existing databases)
+	for _, column := range []string{
+		`role TEXT NOT NULL DEFAULT 'user'`,
+		`disabled_at DATETIME`,
+	} {
+		_, err := db.Exec(`ALTER TABLE users ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchUsers returns one page of users matching the filter, newest first,
+// along with how many match in total
+func (d *Database) SearchUsers(filter UserFilter) ([]*User, int, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.Query != "" {
+		where = append(where, "(email LIKE ? ESCAPE '\\' OR username LIKE ? ESCAPE '\\')")
+		pattern := "%" + escapeLike(filter.Query) + "%"
+		args = append(args, pattern, pattern)
+	}
+	if filter.Role != "" {
+		where = append(where, "role = ?")
+		args = append(args, filter.Role)
+	}
+	if filter.Disabled != nil {
+		if *filter.Disabled {
+			where = append(where, "disabled_at IS NOT NULL")
+		} else {
+			where = append(where, "disabled_at IS NULL")
+		}
+	}
+	condition := strings.Join(where, " AND ")
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM users WHERE `+condition, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`SELECT `+userColumns+` FROM users WHERE `+condition+` ORDER BY created_at DESC LIMIT ? OFFSET ?`,
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// escapeLike makes user input match literally in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (d *Database) SetUserRole(userID, role string) error {
+	_, err := d.db.Exec(`UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, time.Now(), userID)
+	return err
+}
+
+// PromoteVerifiedUser makes the user with the given verified email an admin.
+// It returns false if there is no such user.
+func (d *Database) PromoteVerifiedUser(email string) (bool, error) {
+	result, err := d.db.Exec(`
+		UPDATE users SET role = ?, updated_at = ? WHERE email = ? AND email_verified = 1 AND role != ?
+	`, RoleAdmin, time.Now(), email, RoleAdmin)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetUserDisabled disables an account, signing it out everywhere, or enables
+// it again
+func (d *Database) SetUserDisabled(userID string, disabled bool) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if disabled {
+		_, err = tx.Exec(`UPDATE users SET disabled_at = ?, updated_at = ? WHERE id = ? AND disabled_at IS NULL`, now, now, userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, now, userID)
+	} else {
+		_, err = tx.Exec(`UPDATE users SET disabled_at = NULL, updated_at = ? WHERE id = ?`, now, userID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListTasks returns one page of tasks of any user matching the filter, newest
+// first, along with how many match in total
+func (d *Database) ListTasks(filter TaskFilter) ([]*Task, int, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	condition := strings.Join(where, " AND ")
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM tasks WHERE `+condition, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := d.db.Query(`SELECT `+taskColumns+` FROM tasks WHERE `+condition+` ORDER BY created_at DESC LIMIT ? OFFSET ?`,
+		append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	tasks, err := scanTasks(rows)
+	return tasks, total, err
+}
+
+// FailTask marks a pending or processing task as failed. It returns false if
+// the task had already finished.
+func (d *Database) FailTask(id, message string) (bool, error) {
+	result, err := d.db.Exec(`
+		UPDATE tasks SET status = 'failed', message = ?, completed_at = ?
+		WHERE id = ? AND status IN ('pending', 'processing')
+	`, message, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// QueueStats summarizes tasks by status
+type QueueStats struct {
+	Counts        map[string]int `json:"counts"` // Tasks by status
+	OldestPending *time.Time     `json:"oldest_pending,omitempty"`
+	OldestRunning *time.Time     `json:"oldest_processing,omitempty"`
+}
+
+func (d *Database) GetQueueStats() (*QueueStats, error) {
+	stats := &QueueStats{Counts: make(map[string]int)}
+	rows, err := d.db.Query(`SELECT status, COUNT(*) FROM tasks GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		stats.Counts[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for status, oldest := range map[string]**time.Time{"pending": &stats.OldestPending, "processing": &stats.OldestRunning} {
+		var createdAt time.Time
+		err := d.db.QueryRow(`SELECT created_at FROM tasks WHERE status = ? ORDER BY created_at LIMIT 1`, status).Scan(&createdAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		*oldest = &createdAt
+	}
+	return stats, nil
+}
+
+// CountUsers returns how many users there are, and how many are anonymous
+func (d *Database) CountUsers() (total int, anonymous int, err error) {
+	err = d.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN email LIKE ? THEN 1 ELSE 0 END), 0) FROM users
+	`, "%"+anonymousEmailDomain).Scan(&total, &anonymous)
+	return total, anonymous, err
+}
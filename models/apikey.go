@@ -0,0 +1,145 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// API key scopes. A key without scopes can do everything its owner can,
+// except manage keys, sessions and the account itself.
+const (
+	ScopeRead   = "read"   // List and fetch tasks, assets and files
+	ScopeUpload = "upload" // Upload, import, rename and delete assets
+	ScopeRender = "render" // Create, share and delete render tasks
+)
+
+// APIKeyScopes lists the scopes a key can be given
+var APIKeyScopes = []string{ScopeRead, ScopeUpload, ScopeRender}
+
+// APIKey lets scripts act as a user without a session
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // Start of the key, to tell keys apart
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	Key string `json:"key,omitempty"` // The key itself, only returned when it is created
+}
+
+// Active reports whether the key can still be used
+func (k *APIKey) Active() bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt)
+}
+
+// HasScope reports whether the key allows an action. Keys without scopes
+// allow everything.
+func (k *APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func createAPIKeyTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS api_keys (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			scopes TEXT NOT NULL DEFAULT '',
+			expires_at DATETIME,
+			last_used_at DATETIME,
+			revoked_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id)`)
+	return err
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	var scopes string
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.KeyHash, &scopes,
+		&key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = make([]string, 0)
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	return key, nil
+}
+
+// API key methods
+func (d *Database) CreateAPIKey(key *APIKey) error {
+	_, err := d.db.Exec(`
+		INSERT INTO api_keys (id, user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, key.ID, key.UserID, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), key.ExpiresAt, key.CreatedAt)
+	return err
+}
+
+func (d *Database) GetAPIKeyByID(id string) (*APIKey, error) {
+	return scanAPIKey(d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+func (d *Database) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	return scanAPIKey(d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+}
+
+// GetAPIKeysByUserID returns a user's keys, newest first, including revoked
+// and expired ones
+func (d *Database) GetAPIKeysByUserID(userID string) ([]*APIKey, error) {
+	rows, err := d.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records that a key was just used
+func (d *Database) TouchAPIKey(id string) error {
+	_, err := d.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, time.Now(), id)
+	return err
+}
+
+func (d *Database) RevokeAPIKey(id string) error {
+	_, err := d.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	return err
+}
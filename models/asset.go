@@ -0,0 +1,137 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Asset struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	WorkspaceID string     `json:"workspace_id,omitempty"` // Empty for assets outside any workspace
+	Name        string     `json:"name"`                   // Display name, defaults to the original filename
+	StoredName  string     `json:"stored_name"`            // Name of the file inside UploadsDir
+	Type        string     `json:"type"`                   // "video", "audio", "image" or "subtitle"
+	Size        int64      `json:"size"`
+	Duration    float64    `json:"duration,omitempty"` // Seconds of video or audio, 0 if unknown
+	URL         string     `json:"url"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Set while the asset is in the trash
+
+	DownloadURL string `json:"download_url,omitempty"` // Signed link to URL, not stored
+}
+
+func createAssetTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS assets (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			stored_name TEXT NOT NULL,
+			type TEXT NOT NULL,
+			size INTEGER DEFAULT 0,
+			url TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_assets_user_id ON assets(user_id)`)
+	return err
+}
+
+const assetColumns = `id, user_id, workspace_id, name, stored_name, type, size, duration, url, created_at, deleted_at`
+
+func scanAsset(row rowScanner) (*Asset, error) {
+	asset := &Asset{}
+	var workspaceID sql.NullString
+	err := row.Scan(&asset.ID, &asset.UserID, &workspaceID, &asset.Name, &asset.StoredName, &asset.Type, &asset.Size, &asset.Duration, &asset.URL, &asset.CreatedAt, &asset.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	asset.WorkspaceID = workspaceID.String
+	return asset, nil
+}
+
+// Asset methods
+func (d *Database) CreateAsset(asset *Asset) error {
+	_, err := d.db.Exec(`
+		INSERT INTO assets (id, user_id, workspace_id, name, stored_name, type, size, duration, url, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, asset.ID, asset.UserID, nullIfEmpty(asset.WorkspaceID), asset.Name, asset.StoredName, asset.Type, asset.Size, asset.Duration, asset.URL, asset.CreatedAt)
+	return err
+}
+
+func (d *Database) GetAssetByID(id string) (*Asset, error) {
+	return scanAsset(d.db.QueryRow(`SELECT `+assetColumns+` FROM assets WHERE id = ?`, id))
+}
+
+// GetAssetByURL looks up an asset by its public /uploads/... URL
+func (d *Database) GetAssetByURL(url string) (*Asset, error) {
+	return scanAsset(d.db.QueryRow(`SELECT `+assetColumns+` FROM assets WHERE url = ?`, url))
+}
+
+// GetAssetsByUserID returns one page of the assets a user uploaded outside any
+// workspace, newest first, along with the total number of matching assets.
+// Assets in the trash are left out. An empty assetType matches all types.
+func (d *Database) GetAssetsByUserID(userID, assetType string, limit, offset int) ([]*Asset, int, error) {
+	return d.getAssets(`user_id = ? AND workspace_id IS NULL`, userID, assetType, limit, offset)
+}
+
+// GetAssetsByWorkspaceID returns one page of a workspace's assets, like
+// GetAssetsByUserID
+func (d *Database) GetAssetsByWorkspaceID(workspaceID, assetType string, limit, offset int) ([]*Asset, int, error) {
+	return d.getAssets(`workspace_id = ?`, workspaceID, assetType, limit, offset)
+}
+
+func (d *Database) getAssets(condition, id, assetType string, limit, offset int) ([]*Asset, int, error) {
+	where := `WHERE ` + condition + ` AND deleted_at IS NULL`
+	args := []interface{}{id}
+	if assetType != "" {
+		where += ` AND type = ?`
+		args = append(args, assetType)
+	}
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM assets `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	assets, err := d.queryAssets(`SELECT `+assetColumns+` FROM assets `+where+` ORDER BY created_at DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return assets, total, nil
+}
+
+func (d *Database) queryAssets(query string, args ...interface{}) ([]*Asset, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := make([]*Asset, 0)
+	for rows.Next() {
+		asset, err := scanAsset(rows)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+func (d *Database) RenameAsset(id, name string) error {
+	_, err := d.db.Exec(`UPDATE assets SET name = ? WHERE id = ?`, name, id)
+	return err
+}
+
+func (d *Database) DeleteAsset(id string) error {
+	_, err := d.db.Exec(`DELETE FROM assets WHERE id = ?`, id)
+	return err
+}
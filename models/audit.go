@@ -0,0 +1,237 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Audit event actions
+const (
+	AuditLogin        = "login"
+	AuditLoginFailed  = "login.failed"
+	AuditRegister     = "register"
+	AuditTokenMinted  = "token.minted" // /api/me handed out an access token
+	AuditUpload       = "asset.upload"
+	AuditAssetDelete  = "asset.delete"
+	AuditTaskCreate   = "task.create"
+	AuditTaskDelete   = "task.delete"
+	AuditTrashRestore = "trash.restore"
+	AuditTrashPurge   = "trash.purge"
+	AuditShareCreate  = "share.create"
+	AuditShareRevoke  = "share.revoke"
+
+	AuditPasswordChange        = "password.change"
+	AuditPasswordReset         = "password.reset" // With a link from a reset email
+	AuditTwoFactorEnable       = "2fa.enable"
+	AuditTwoFactorDisable      = "2fa.disable"
+	AuditRecoveryCodesReplace  = "2fa.recovery_codes"
+	AuditAPIKeyCreate          = "api_key.create"
+	AuditAPIKeyRevoke          = "api_key.revoke"
+	AuditSessionRevoke         = "session.revoke"
+	AuditWorkspaceMemberUpdate = "workspace.member.update"
+	AuditWorkspaceMemberRemove = "workspace.member.remove"
+	AuditWorkspaceInvite       = "workspace.invite"
+	AuditWorkspaceInviteRevoke = "workspace.invite.revoke"
+	AuditWorkspaceJoin         = "workspace.join" // Accepted an invitation
+
+	AuditAdminUserUpdate  = "admin.user.update"
+	AuditAdminQuotaUpdate = "admin.quota.update"
+	AuditAdminTaskFail    = "admin.task.fail"
+	AuditAdminJanitorRun  = "admin.janitor.run"
+)
+
+// AuditEvent records who did what to which item, and from where. Events are
+// never changed or deleted once written.
+type AuditEvent struct {
+	ID         int64             `json:"id"`
+	ActorID    string            `json:"actor_id,omitempty"` // Empty when nobody was signed in, e.g. a failed login
+	IPAddress  string            `json:"ip_address"`
+	Action     string            `json:"action"`
+	TargetType string            `json:"target_type,omitempty"` // "user", "task", "asset", "share", "api_key", "session" or "workspace"
+	TargetID   string            `json:"target_id,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// AuditFilter narrows down the audit events listed in the admin API. An
+// Action ending in * matches every action starting with the rest of it.
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+	IPAddress  string
+	Since      *time.Time
+	Until      *time.Time
+	Limit      int
+	Offset     int
+}
+
+const auditEventColumns = `id, actor_id, ip_address, action, target_type, target_id, details, created_at`
+
+func createAuditTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			actor_id TEXT,
+			ip_address TEXT,
+			action TEXT NOT NULL,
+			target_type TEXT,
+			target_id TEXT,
+			details TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_action ON audit_events(action)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events(target_type, target_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at)`,
+	} {
+		if _, err := db.Exec(index); err != nil {
+			return err
+		}
+	}
+
+	// Refuse changes to events already written, so the log can only grow
+	for _, operation := range []string{"UPDATE", "DELETE"} {
+		_, err := db.Exec(`
+			CREATE TRIGGER IF NOT EXISTS audit_events_no_` + strings.ToLower(operation) + `
+			BEFORE ` + operation + ` ON audit_events
+			BEGIN
+				SELECT RAISE(ABORT, 'audit_events is append-only');
+			END
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) CreateAuditEvent(event *AuditEvent) error {
+	var details string
+	if len(event.Details) > 0 {
+		encoded, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		details = string(encoded)
+	}
+
+	result, err := d.db.Exec(`
+		INSERT INTO audit_events (actor_id, ip_address, action, target_type, target_id, details, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, nullIfEmpty(event.ActorID), event.IPAddress, event.Action, nullIfEmpty(event.TargetType), nullIfEmpty(event.TargetID), nullIfEmpty(details), event.CreatedAt)
+	if err != nil {
+		return err
+	}
+	event.ID, err = result.LastInsertId()
+	return err
+}
+
+// auditCondition builds the WHERE clause matching the filter
+func auditCondition(filter AuditFilter) (string, []interface{}) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	for _, field := range []struct{ column, value string }{
+		{"actor_id", filter.ActorID},
+		{"target_type", filter.TargetType},
+		{"target_id", filter.TargetID},
+		{"ip_address", filter.IPAddress},
+	} {
+		if field.value != "" {
+			where = append(where, field.column+" = ?")
+			args = append(args, field.value)
+		}
+	}
+	if prefix, ok := strings.CutSuffix(filter.Action, "*"); ok {
+		where = append(where, `action LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(prefix)+"%")
+	} else if filter.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Since != nil {
+		where = append(where, "created_at >= ?")
+		args = append(args, *filter.Since)
+	}
+	if filter.Until != nil {
+		where = append(where, "created_at < ?")
+		args = append(args, *filter.Until)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// SearchAuditEvents returns one page of audit events matching the filter,
+// newest first, along with how many match in total
+func (d *Database) SearchAuditEvents(filter AuditFilter) ([]*AuditEvent, int, error) {
+	condition, args := auditCondition(filter)
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE `+condition, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	events := make([]*AuditEvent, 0)
+	err := d.eachAuditEvent(`SELECT `+auditEventColumns+` FROM audit_events WHERE `+condition+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, filter.Limit, filter.Offset), func(event *AuditEvent) error {
+			events = append(events, event)
+			return nil
+		})
+	if err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// EachAuditEvent calls fn with every audit event matching the filter, oldest
+// first, ignoring its Limit and Offset. It stops at the first error fn returns.
+func (d *Database) EachAuditEvent(filter AuditFilter, fn func(*AuditEvent) error) error {
+	condition, args := auditCondition(filter)
+	return d.eachAuditEvent(`SELECT `+auditEventColumns+` FROM audit_events WHERE `+condition+` ORDER BY id`, args, fn)
+}
+
+func (d *Database) eachAuditEvent(query string, args []interface{}, fn func(*AuditEvent) error) error {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	event := &AuditEvent{}
+	var actorID, ipAddress, targetType, targetID, details sql.NullString
+	err := row.Scan(&event.ID, &actorID, &ipAddress, &event.Action, &targetType, &targetID, &details, &event.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	event.ActorID = actorID.String
+	event.IPAddress = ipAddress.String
+	event.TargetType = targetType.String
+	event.TargetID = targetID.String
+	if details.Valid && details.String != "" {
+		if err := json.Unmarshal([]byte(details.String), &event.Details); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
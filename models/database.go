@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"strings"
 	"time"
 
@@ -9,30 +10,48 @@ import (
 )
 
 type User struct {
-	ID           string    `json:"id"`
-	Email        string    `json:"email"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"-"` // Don't expose password hash in JSON
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	Username        string     `json:"username"`
+	PasswordHash    string     `json:"-"` // Don't expose password hash in JSON
+	DeviceTokenHash string     `json:"-"` // Identifies an anonymous user's browser
+	EmailVerified   bool       `json:"email_verified"`
+	TOTPEnabled     bool       `json:"two_factor_enabled"`
+	TOTPSecret      string     `json:"-"` // Set once enrollment starts, used once TOTPEnabled
+	TOTPLastStep    int64      `json:"-"` // Time step of the last accepted code, to stop replays
+	Role            string     `json:"role"`
+	DisabledAt      *time.Time `json:"disabled_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
 }
 
 type Task struct {
 	ID          string     `json:"id"`
 	UserID      string     `json:"user_id"`
+	WorkspaceID string     `json:"workspace_id,omitempty"` // Empty for tasks outside any workspace
+	Type        string     `json:"type"`                   // "render" or "import"
 	Status      string     `json:"status"`
 	Progress    int        `json:"progress"`
 	Message     string     `json:"message"`
 	OutputFile  string     `json:"output_file,omitempty"`
+	OutputSize  int64      `json:"output_size,omitempty"`  // Bytes, counted against the creator's storage quota
 	TaskDetails string     `json:"task_details,omitempty"` // JSON string containing input videos, options, etc.
 	CreatedAt   time.Time  `json:"created_at"`
 	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"` // Set while the task is in the trash
+
+	DownloadURL string `json:"download_url,omitempty"` // Signed link to OutputFile, not stored
 }
 
 type Database struct {
 	db *sql.DB
 }
 
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
 func NewDatabase(dbPath string) (*Database, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
@@ -90,6 +109,24 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	// Add type column if it doesn't exist (for existing databases)
+	_, err = db.Exec(`ALTER TABLE tasks ADD COLUMN type TEXT NOT NULL DEFAULT 'render'`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+
+	// Add device_token_hash column if it doesn't exist (for existing databases)
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN device_token_hash TEXT`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+
+	// Add email_verified column if it doesn't exist (for existing databases)
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT 0`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return err
+	}
+
 	// Create indexes
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_tasks_user_id ON tasks(user_id)`)
 	if err != nil {
@@ -106,109 +143,241 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_device_token_hash ON users(device_token_hash)`)
+	if err != nil {
+		return err
+	}
+
+	if err := createAssetTables(db); err != nil {
+		return err
+	}
+
+	if err := createUploadTables(db); err != nil {
+		return err
+	}
+
+	if err := createShareTables(db); err != nil {
+		return err
+	}
+
+	if err := createSessionTables(db); err != nil {
+		return err
+	}
+
+	if err := createAPIKeyTables(db); err != nil {
+		return err
+	}
+
+	if err := createUserTokenTables(db); err != nil {
+		return err
+	}
+
+	if err := createLoginAttemptTables(db); err != nil {
+		return err
+	}
+
+	if err := createTOTPTables(db); err != nil {
+		return err
+	}
+
+	if err := createIdentityTables(db); err != nil {
+		return err
+	}
+
+	if err := createRoleColumns(db); err != nil {
+		return err
+	}
+
+	if err := createWorkspaceTables(db); err != nil {
+		return err
+	}
+
+	if err := createQuotaTables(db); err != nil {
+		return err
+	}
+
+	if err := createTrashTables(db); err != nil {
+		return err
+	}
+
+	if err := createAuditTables(db); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+const userColumns = `id, email, username, password_hash, email_verified, totp_enabled, totp_secret, totp_last_step, role, disabled_at, created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	var totpSecret sql.NullString
+	err := row.Scan(&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.EmailVerified,
+		&user.TOTPEnabled, &totpSecret, &user.TOTPLastStep, &user.Role, &user.DisabledAt, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = totpSecret.String
+	return user, nil
+}
+
 // User methods
 func (d *Database) CreateUser(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
 	_, err := d.db.Exec(`
-		INSERT INTO users (id, email, username, password_hash, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, user.ID, user.Email, user.Username, user.PasswordHash, user.CreatedAt, user.UpdatedAt)
+		INSERT INTO users (id, email, username, password_hash, device_token_hash, email_verified, role, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, user.ID, user.Email, user.Username, user.PasswordHash, nullIfEmpty(user.DeviceTokenHash), user.EmailVerified, user.Role, user.CreatedAt, user.UpdatedAt)
 	return err
 }
 
-func (d *Database) GetUserByID(id string) (*User, error) {
-	user := &User{}
-	err := d.db.QueryRow(`
-		SELECT id, email, username, password_hash, created_at, updated_at
-		FROM users WHERE id = ?
-	`, id).Scan(&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+// GetUserByDeviceToken finds the anonymous user a device token was issued to
+func (d *Database) GetUserByDeviceToken(tokenHash string) (*User, error) {
+	user, err := scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE device_token_hash = ?`, tokenHash))
 	if err != nil {
 		return nil, err
 	}
+	user.DeviceTokenHash = tokenHash
 	return user, nil
 }
 
+func (d *Database) GetUserByID(id string) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
 func (d *Database) GetUserByEmail(email string) (*User, error) {
-	user := &User{}
-	err := d.db.QueryRow(`
-		SELECT id, email, username, password_hash, created_at, updated_at
-		FROM users WHERE email = ?
-	`, email).Scan(&user.ID, &user.Email, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
-	if err != nil {
-		return nil, err
-	}
-	return user, nil
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
 }
 
 func (d *Database) UpdateUser(user *User) error {
 	_, err := d.db.Exec(`
-		UPDATE users SET email = ?, username = ?, password_hash = ?, updated_at = ?
+		UPDATE users SET email = ?, username = ?, password_hash = ?, email_verified = ?, updated_at = ?
 		WHERE id = ?
-	`, user.Email, user.Username, user.PasswordHash, time.Now(), user.ID)
+	`, user.Email, user.Username, user.PasswordHash, user.EmailVerified, time.Now(), user.ID)
 	return err
 }
 
-// Task methods
-func (d *Database) CreateTask(task *Task) error {
-	_, err := d.db.Exec(`
-		INSERT INTO tasks (id, user_id, status, progress, message, output_file, task_details, created_at, completed_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, task.ID, task.UserID, task.Status, task.Progress, task.Message, task.OutputFile, task.TaskDetails, task.CreatedAt, task.CompletedAt)
-	return err
-}
+const taskColumns = `id, user_id, workspace_id, type, status, progress, message, output_file, output_size, task_details, created_at, completed_at, deleted_at`
 
-func (d *Database) GetTaskByID(id string) (*Task, error) {
+func scanTask(row rowScanner) (*Task, error) {
 	task := &Task{}
-	err := d.db.QueryRow(`
-		SELECT id, user_id, status, progress, message, output_file, task_details, created_at, completed_at
-		FROM tasks WHERE id = ?
-	`, id).Scan(&task.ID, &task.UserID, &task.Status, &task.Progress, &task.Message, &task.OutputFile, &task.TaskDetails, &task.CreatedAt, &task.CompletedAt)
+	var workspaceID sql.NullString
+	err := row.Scan(&task.ID, &task.UserID, &workspaceID, &task.Type, &task.Status, &task.Progress, &task.Message,
+		&task.OutputFile, &task.OutputSize, &task.TaskDetails, &task.CreatedAt, &task.CompletedAt, &task.DeletedAt)
 	if err != nil {
 		return nil, err
 	}
+	task.WorkspaceID = workspaceID.String
 	return task, nil
 }
 
-func (d *Database) GetTasksByUserID(userID string) ([]*Task, error) {
-	rows, err := d.db.Query(`
-		SELECT id, user_id, status, progress, message, output_file, task_details, created_at, completed_at
-		FROM tasks WHERE user_id = ? ORDER BY created_at DESC
-	`, userID)
-	if err != nil {
-		return nil, err
-	}
+func scanTasks(rows *sql.Rows) ([]*Task, error) {
 	defer rows.Close()
 
-	var tasks []*Task
+	tasks := make([]*Task, 0)
 	for rows.Next() {
-		task := &Task{}
-		err := rows.Scan(&task.ID, &task.UserID, &task.Status, &task.Progress, &task.Message, &task.OutputFile, &task.TaskDetails, &task.CreatedAt, &task.CompletedAt)
+		task, err := scanTask(rows)
 		if err != nil {
 			return nil, err
 		}
 		tasks = append(tasks, task)
 	}
-	if tasks == nil {
-		tasks = make([]*Task, 0)
-	}
-	return tasks, nil
+	return tasks, rows.Err()
 }
 
-func (d *Database) UpdateTask(task *Task) error {
+// Task methods
+func (d *Database) CreateTask(task *Task) error {
+	if task.Type == "" {
+		task.Type = "render"
+	}
 	_, err := d.db.Exec(`
-		UPDATE tasks SET status = ?, progress = ?, message = ?, output_file = ?, task_details = ?, completed_at = ?
-		WHERE id = ?
-	`, task.Status, task.Progress, task.Message, task.OutputFile, task.TaskDetails, task.CompletedAt, task.ID)
+		INSERT INTO tasks (id, user_id, workspace_id, type, status, progress, message, output_file, task_details, created_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, task.ID, task.UserID, nullIfEmpty(task.WorkspaceID), task.Type, task.Status, task.Progress, task.Message, task.OutputFile, task.TaskDetails, task.CreatedAt, task.CompletedAt)
 	return err
 }
 
+func (d *Database) GetTaskByID(id string) (*Task, error) {
+	return scanTask(d.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+}
+
+// GetTaskByOutputFile finds the task that produced an output file
+func (d *Database) GetTaskByOutputFile(outputFile string) (*Task, error) {
+	return scanTask(d.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE output_file = ?`, outputFile))
+}
+
+// GetTasksByUserID returns the tasks a user created outside any workspace,
+// newest first, leaving out those in the trash
+func (d *Database) GetTasksByUserID(userID string) ([]*Task, error) {
+	rows, err := d.db.Query(`
+		SELECT `+taskColumns+` FROM tasks WHERE user_id = ? AND workspace_id IS NULL AND deleted_at IS NULL ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTasks(rows)
+}
+
+// GetTasksByWorkspaceID returns the tasks in a workspace that aren't in the
+// trash, newest first
+func (d *Database) GetTasksByWorkspaceID(workspaceID string) ([]*Task, error) {
+	rows, err := d.db.Query(`
+		SELECT `+taskColumns+` FROM tasks WHERE workspace_id = ? AND deleted_at IS NULL ORDER BY created_at DESC
+	`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTasks(rows)
+}
+
+// CountActiveTasksByUserID returns how many of a user's tasks are pending or
+// processing
+func (d *Database) CountActiveTasksByUserID(userID string) (int, error) {
+	var count int
+	err := d.db.QueryRow(`
+		SELECT COUNT(*) FROM tasks WHERE user_id = ? AND status IN ('pending', 'processing')
+	`, userID).Scan(&count)
+	return count, err
+}
+
+// ErrTaskFinished is returned by UpdateTask for a task that is no longer
+// pending or processing, e.g. because an administrator failed it
+var ErrTaskFinished = errors.New("task has already finished")
+
+// UpdateTask saves a task's progress. It only updates tasks that are still
+// pending or processing, so that a task failed from elsewhere isn't revived
+// by the pipeline still running it.
+func (d *Database) UpdateTask(task *Task) error {
+	result, err := d.db.Exec(`
+		UPDATE tasks SET status = ?, progress = ?, message = ?, output_file = ?, output_size = ?, task_details = ?, completed_at = ?
+		WHERE id = ? AND status IN ('pending', 'processing')
+	`, task.Status, task.Progress, task.Message, task.OutputFile, task.OutputSize, task.TaskDetails, task.CompletedAt, task.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrTaskFinished
+	}
+	return nil
+}
+
 func (d *Database) DeleteTask(id string) error {
 	_, err := d.db.Exec(`DELETE FROM tasks WHERE id = ?`, id)
 	return err
 }
 
+// nullIfEmpty stores empty strings as NULL, so they don't collide in unique indexes
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
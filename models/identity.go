@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UserIdentity links a user to an account at an OpenID Connect provider
+type UserIdentity struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCLogin is a sign-in waiting for the user to come back from the provider,
+// found by the hash of the state it was sent off with
+type OIDCLogin struct {
+	StateHash string
+	Nonce     string
+	Verifier  string // PKCE code verifier
+	Redirect  string // Page to return to afterwards
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+func createIdentityTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_identities (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			issuer TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (issuer, subject),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS oidc_logins (
+			state_hash TEXT PRIMARY KEY,
+			nonce TEXT NOT NULL,
+			verifier TEXT NOT NULL,
+			redirect TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// Identity methods
+func (d *Database) CreateUserIdentity(identity *UserIdentity) error {
+	_, err := d.db.Exec(`
+		INSERT INTO user_identities (id, user_id, issuer, subject, email, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, identity.ID, identity.UserID, identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt)
+	return err
+}
+
+// GetUserByIdentity finds the user linked to a provider account
+func (d *Database) GetUserByIdentity(issuer, subject string) (*User, error) {
+	return scanUser(d.db.QueryRow(`
+		SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?)
+	`, issuer, subject))
+}
+
+// CreateOIDCLogin stores a sign-in that is starting, clearing out those that
+// were abandoned at the provider
+func (d *Database) CreateOIDCLogin(login *OIDCLogin) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM oidc_logins WHERE expires_at < ?`, time.Now()); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO oidc_logins (state_hash, nonce, verifier, redirect, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, login.StateHash, login.Nonce, login.Verifier, login.Redirect, login.ExpiresAt, login.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeOIDCLogin removes a sign-in and returns it. It fails with
+// sql.ErrNoRows if there is none for the state or it has expired, so each
+// state works once.
+func (d *Database) ConsumeOIDCLogin(stateHash string) (*OIDCLogin, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	login := &OIDCLogin{}
+	err = tx.QueryRow(`
+		SELECT state_hash, nonce, verifier, redirect, expires_at, created_at
+		FROM oidc_logins WHERE state_hash = ?
+	`, stateHash).Scan(&login.StateHash, &login.Nonce, &login.Verifier, &login.Redirect, &login.ExpiresAt, &login.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`DELETE FROM oidc_logins WHERE state_hash = ?`, stateHash)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if time.Now().After(login.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return login, nil
+}
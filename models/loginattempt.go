@@ -0,0 +1,111 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Reasons a login attempt failed
+const (
+	LoginFailureUnknownEmail  = "unknown_email"
+	LoginFailureWrongPassword = "wrong_password"
+	LoginFailureWrongCode     = "wrong_code" // Wrong second factor code
+	LoginFailureThrottled     = "throttled"
+
+	LoginFailureWrongSharePassword = "wrong_share_password" // Wrong password for a share link
+)
+
+// LoginAttempt is the audit record of a failed login
+type LoginAttempt struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	UserID    string    `json:"user_id,omitempty"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginThrottle counts recent failed logins for one account or IP address
+type LoginThrottle struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func createLoginAttemptTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			id TEXT PRIMARY KEY,
+			email TEXT NOT NULL,
+			user_id TEXT,
+			ip_address TEXT,
+			user_agent TEXT,
+			reason TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts(email)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_throttles (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_failure_at DATETIME NOT NULL,
+			locked_until DATETIME
+		)
+	`)
+	return err
+}
+
+// Login attempt methods
+func (d *Database) CreateLoginAttempt(attempt *LoginAttempt) error {
+	_, err := d.db.Exec(`
+		INSERT INTO login_attempts (id, email, user_id, ip_address, user_agent, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, attempt.ID, attempt.Email, nullIfEmpty(attempt.UserID), attempt.IPAddress, attempt.UserAgent, attempt.Reason, attempt.CreatedAt)
+	return err
+}
+
+// GetLoginThrottle returns the failure count for a key, or an empty one if it
+// has none
+func (d *Database) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Key: key}
+	err := d.db.QueryRow(`
+		SELECT failures, last_failure_at, locked_until FROM login_throttles WHERE key = ?
+	`, key).Scan(&throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return throttle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return throttle, nil
+}
+
+func (d *Database) SaveLoginThrottle(throttle *LoginThrottle) error {
+	_, err := d.db.Exec(`
+		INSERT INTO login_throttles (key, failures, last_failure_at, locked_until)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			failures = excluded.failures,
+			last_failure_at = excluded.last_failure_at,
+			locked_until = excluded.locked_until
+	`, throttle.Key, throttle.Failures, throttle.LastFailureAt, throttle.LockedUntil)
+	return err
+}
+
+// DeleteLoginThrottle forgets a key's failures, after a successful login
+func (d *Database) DeleteLoginThrottle(key string) error {
+	_, err := d.db.Exec(`DELETE FROM login_throttles WHERE key = ?`, key)
+	return err
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Quota limits what a user can store and render. Zero means no limit.
+type Quota struct {
+	StorageBytes         int64 `json:"storage_bytes"`          // Uploaded assets plus rendered outputs
+	MaxOutputSeconds     int64 `json:"max_output_seconds"`     // Longest video a single render can produce
+	MonthlyRenderMinutes int64 `json:"monthly_render_minutes"` // Minutes of output rendered per calendar month (UTC)
+}
+
+// QuotaOverride replaces some of the default limits for one user. Nil fields
+// keep the default.
+type QuotaOverride struct {
+	StorageBytes         *int64 `json:"storage_bytes"`
+	MaxOutputSeconds     *int64 `json:"max_output_seconds"`
+	MonthlyRenderMinutes *int64 `json:"monthly_render_minutes"`
+}
+
+// Apply returns the defaults with the overridden limits replaced
+func (o *QuotaOverride) Apply(defaults Quota) Quota {
+	quota := defaults
+	if o.StorageBytes != nil {
+		quota.StorageBytes = *o.StorageBytes
+	}
+	if o.MaxOutputSeconds != nil {
+		quota.MaxOutputSeconds = *o.MaxOutputSeconds
+	}
+	if o.MonthlyRenderMinutes != nil {
+		quota.MonthlyRenderMinutes = *o.MonthlyRenderMinutes
+	}
+	return quota
+}
+
+func createQuotaTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_quotas (
+			user_id TEXT PRIMARY KEY,
+			storage_bytes INTEGER,
+			max_output_seconds INTEGER,
+			monthly_render_minutes INTEGER,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// One row per render, holding its estimated length while it runs and its
+	// actual length once it has completed. Failed renders don't count.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS render_usage (
+			task_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			seconds REAL NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_render_usage_user_id ON render_usage(user_id, created_at)`)
+	if err != nil {
+		return err
+	}
+
+	// Add size and duration columns if they don't exist (for existing databases)
+	for _, column := range []string{
+		`tasks ADD COLUMN output_size INTEGER DEFAULT 0`,
+		`assets ADD COLUMN duration REAL DEFAULT 0`,
+	} {
+		_, err := db.Exec(`ALTER TABLE ` + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetQuotaOverride returns the limits set for a user, or an empty override
+// when there are none
+func (d *Database) GetQuotaOverride(userID string) (*QuotaOverride, error) {
+	var storageBytes, maxOutputSeconds, monthlyRenderMinutes sql.NullInt64
+	err := d.db.QueryRow(`
+		SELECT storage_bytes, max_output_seconds, monthly_render_minutes FROM user_quotas WHERE user_id = ?
+	`, userID).Scan(&storageBytes, &maxOutputSeconds, &monthlyRenderMinutes)
+	if err == sql.ErrNoRows {
+		return &QuotaOverride{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaOverride{
+		StorageBytes:         nullInt64Ptr(storageBytes),
+		MaxOutputSeconds:     nullInt64Ptr(maxOutputSeconds),
+		MonthlyRenderMinutes: nullInt64Ptr(monthlyRenderMinutes),
+	}, nil
+}
+
+// SetQuotaOverride replaces a user's limits. An override with no fields set
+// removes it, returning the user to the defaults.
+func (d *Database) SetQuotaOverride(userID string, override *QuotaOverride) error {
+	if override.StorageBytes == nil && override.MaxOutputSeconds == nil && override.MonthlyRenderMinutes == nil {
+		_, err := d.db.Exec(`DELETE FROM user_quotas WHERE user_id = ?`, userID)
+		return err
+	}
+	_, err := d.db.Exec(`
+		INSERT INTO user_quotas (user_id, storage_bytes, max_output_seconds, monthly_render_minutes, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			storage_bytes = excluded.storage_bytes,
+			max_output_seconds = excluded.max_output_seconds,
+			monthly_render_minutes = excluded.monthly_render_minutes,
+			updated_at = excluded.updated_at
+	`, userID, override.StorageBytes, override.MaxOutputSeconds, override.MonthlyRenderMinutes, time.Now())
+	return err
+}
+
+// GetStorageUsed adds up the sizes of the assets a user uploaded and the
+// outputs of their renders, including those in workspaces
+func (d *Database) GetStorageUsed(userID string) (int64, error) {
+	var used int64
+	err := d.db.QueryRow(`
+		SELECT (SELECT COALESCE(SUM(size), 0) FROM assets WHERE user_id = ?)
+			+ (SELECT COALESCE(SUM(output_size), 0) FROM tasks WHERE user_id = ?)
+	`, userID, userID).Scan(&used)
+	return used, err
+}
+
+// GetRenderSecondsSince adds up the output a user has rendered, or has
+// renders running for, since the given time. Renders that were failed after
+// the fact, e.g. by an admin, stop counting too; deleted ones still count.
+func (d *Database) GetRenderSecondsSince(userID string, since time.Time) (float64, error) {
+	var seconds float64
+	err := d.db.QueryRow(`
+		SELECT COALESCE(SUM(r.seconds), 0) FROM render_usage r
+		LEFT JOIN tasks t ON t.id = r.task_id
+		WHERE r.user_id = ? AND r.created_at >= ? AND (t.status IS NULL OR t.status != 'failed')
+	`, userID, since).Scan(&seconds)
+	return seconds, err
+}
+
+// ReserveRenderUsage counts a render's estimated length against the user as
+// soon as it starts, so renders running at once can't exceed the quota
+func (d *Database) ReserveRenderUsage(taskID, userID string, seconds float64) error {
+	_, err := d.db.Exec(`
+		INSERT INTO render_usage (task_id, user_id, seconds, created_at) VALUES (?, ?, ?, ?)
+	`, taskID, userID, seconds, time.Now())
+	return err
+}
+
+// SettleRenderUsage replaces the estimate with the length actually rendered
+func (d *Database) SettleRenderUsage(taskID string, seconds float64) error {
+	_, err := d.db.Exec(`UPDATE render_usage SET seconds = ? WHERE task_id = ?`, seconds, taskID)
+	return err
+}
+
+// ReleaseRenderUsage stops counting a render that failed
+func (d *Database) ReleaseRenderUsage(taskID string) error {
+	_, err := d.db.Exec(`DELETE FROM render_usage WHERE task_id = ?`, taskID)
+	return err
+}
+
+// SetAssetDuration records the length of an asset probed after it was uploaded
+func (d *Database) SetAssetDuration(id string, seconds float64) error {
+	_, err := d.db.Exec(`UPDATE assets SET duration = ? WHERE id = ?`, seconds, id)
+	return err
+}
+
+func nullInt64Ptr(value sql.NullInt64) *int64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Int64
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// anonymousUserCondition matches the users IsAnonymous reports as anonymous,
+// with u as the users table
+const anonymousUserCondition = `(u.password_hash = '' AND u.email LIKE '%` + anonymousEmailDomain + `')`
+
+// GetExpiredTasks returns the finished tasks created before the given time by
+// anonymous or by registered users
+func (d *Database) GetExpiredTasks(anonymous bool, before time.Time) ([]*Task, error) {
+	rows, err := d.db.Query(`
+		SELECT `+prefixColumns("t", taskColumns)+` FROM tasks t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.status NOT IN ('pending', 'processing') AND t.created_at < ? AND `+anonymousUserCondition+` = ?
+		ORDER BY t.created_at
+	`, before, anonymous)
+	if err != nil {
+		return nil, err
+	}
+	return scanTasks(rows)
+}
+
+// GetExpiredAssets returns the assets uploaded before the given time by
+// anonymous or by registered users. Assets that a pending or processing task
+// uses are left out until it finishes; tasks refer to them by URL, or by the
+// stored name at the end of it, somewhere in their details.
+func (d *Database) GetExpiredAssets(anonymous bool, before time.Time) ([]*Asset, error) {
+	return d.queryAssets(`
+		SELECT `+prefixColumns("a", assetColumns)+` FROM assets a
+		JOIN users u ON u.id = a.user_id
+		WHERE a.created_at < ? AND `+anonymousUserCondition+` = ?
+		AND NOT EXISTS (
+			SELECT 1 FROM tasks t
+			WHERE t.status IN ('pending', 'processing') AND a.stored_name <> '' AND instr(t.task_details, a.stored_name) > 0
+		)
+		ORDER BY a.created_at
+	`, before, anonymous)
+}
+
+// GetStaleUploadSessions returns resumable uploads that haven't received data
+// since the given time: those that were never finished, and finished ones
+// whose session is only kept so the client can check the upload is complete
+func (d *Database) GetStaleUploadSessions(before time.Time) ([]*UploadSession, error) {
+	rows, err := d.db.Query(`
+		SELECT id, user_id, workspace_id, filename, content_type, length, upload_offset, asset_id, created_at, updated_at
+		FROM upload_sessions WHERE updated_at < ?
+	`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*UploadSession
+	for rows.Next() {
+		upload := &UploadSession{}
+		var workspaceID, assetID sql.NullString
+		err := rows.Scan(&upload.ID, &upload.UserID, &workspaceID, &upload.Filename, &upload.ContentType, &upload.Length, &upload.Offset, &assetID, &upload.CreatedAt, &upload.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		upload.WorkspaceID = workspaceID.String
+		upload.AssetID = assetID.String
+		uploads = append(uploads, upload)
+	}
+	return uploads, rows.Err()
+}
+
+// PrunedLoginRecords counts the rows PruneLoginRecords deleted
+type PrunedLoginRecords struct {
+	Attempts  int64 // Failed logins recorded before the cutoff
+	Throttles int64 // Throttles whose failures are forgotten and lockout over
+	Tokens    int64 // Email tokens that expired or were used before the cutoff
+}
+
+// PruneLoginRecords deletes login attempts and used or expired email tokens
+// from before the given time, and throttles that no longer hold anyone back:
+// their lockout has ended, or they aren't locked and their last failure was
+// before throttlesBefore. On a dry run it only counts them.
+func (d *Database) PruneLoginRecords(before, throttlesBefore time.Time, dryRun bool) (*PrunedLoginRecords, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	pruned := &PrunedLoginRecords{}
+	now := time.Now()
+	for _, step := range []struct {
+		count *int64
+		query string
+		args  []interface{}
+	}{
+		{&pruned.Attempts, `DELETE FROM login_attempts WHERE created_at < ?`, []interface{}{before}},
+		{&pruned.Throttles, `DELETE FROM login_throttles WHERE (locked_until IS NOT NULL AND locked_until < ?) OR (locked_until IS NULL AND last_failure_at < ?)`, []interface{}{now, throttlesBefore}},
+		{&pruned.Tokens, `DELETE FROM user_tokens WHERE expires_at < ? OR used_at < ?`, []interface{}{before, before}},
+	} {
+		result, err := tx.Exec(step.query, step.args...)
+		if err != nil {
+			return nil, err
+		}
+		if *step.count, err = result.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return pruned, nil
+	}
+	return pruned, tx.Commit()
+}
+
+// PruneSessions deletes sessions that expired or were revoked before the
+// given time. On a dry run it only counts them.
+func (d *Database) PruneSessions(before time.Time, dryRun bool) (int64, error) {
+	if dryRun {
+		var count int64
+		err := d.db.QueryRow(`SELECT COUNT(*) FROM sessions WHERE expires_at < ? OR revoked_at < ?`, before, before).Scan(&count)
+		return count, err
+	}
+	result, err := d.db.Exec(`DELETE FROM sessions WHERE expires_at < ? OR revoked_at < ?`, before, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// prefixColumns qualifies each of a comma-separated list of columns with a
+// table name, for queries that join another table with the same columns
+func prefixColumns(table, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = table + "." + name
+	}
+	return strings.Join(names, ", ")
+}
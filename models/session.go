@@ -0,0 +1,167 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Session is one signed-in device. Access tokens name their session, so
+// revoking it cuts the device off as soon as its access token is next used.
+type Session struct {
+	ID                string     `json:"id"`
+	UserID            string     `json:"user_id"`
+	RefreshTokenHash  string     `json:"-"`
+	PreviousTokenHash string     `json:"-"` // The refresh token this one replaced, to detect reuse
+	UserAgent         string     `json:"user_agent"`
+	IPAddress         string     `json:"ip_address"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        time.Time  `json:"last_used_at"`
+	ExpiresAt         time.Time  `json:"expires_at"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+
+	Current bool `json:"current"` // Whether this is the caller's session, not stored
+}
+
+// Active reports whether the session can still be used
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+func createSessionTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			refresh_token_hash TEXT UNIQUE NOT NULL,
+			previous_token_hash TEXT,
+			user_agent TEXT,
+			ip_address TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_previous_token_hash ON sessions(previous_token_hash)`)
+	return err
+}
+
+const sessionColumns = `id, user_id, refresh_token_hash, previous_token_hash, user_agent, ip_address, created_at, last_used_at, expires_at, revoked_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	session := &Session{}
+	var previousTokenHash, userAgent, ipAddress sql.NullString
+	err := row.Scan(&session.ID, &session.UserID, &session.RefreshTokenHash, &previousTokenHash, &userAgent, &ipAddress,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt, &session.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	session.PreviousTokenHash = previousTokenHash.String
+	session.UserAgent = userAgent.String
+	session.IPAddress = ipAddress.String
+	return session, nil
+}
+
+// Session methods
+func (d *Database) CreateSession(session *Session) error {
+	_, err := d.db.Exec(`
+		INSERT INTO sessions (id, user_id, refresh_token_hash, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, session.ID, session.UserID, session.RefreshTokenHash, session.UserAgent, session.IPAddress, session.CreatedAt, session.LastUsedAt, session.ExpiresAt)
+	return err
+}
+
+func (d *Database) GetSessionByID(id string) (*Session, error) {
+	return scanSession(d.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+
+func (d *Database) GetSessionByRefreshToken(tokenHash string) (*Session, error) {
+	return scanSession(d.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE refresh_token_hash = ?`, tokenHash))
+}
+
+// GetSessionByPreviousRefreshToken finds the session a refresh token was
+// rotated out of. Seeing one used again means it has leaked.
+func (d *Database) GetSessionByPreviousRefreshToken(tokenHash string) (*Session, error) {
+	return scanSession(d.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE previous_token_hash = ?`, tokenHash))
+}
+
+// GetActiveSessionsByUserID returns a user's unexpired, unrevoked sessions,
+// most recently used first
+func (d *Database) GetActiveSessionsByUserID(userID string) ([]*Session, error) {
+	rows, err := d.db.Query(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY last_used_at DESC
+	`, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*Session, 0)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RotateSessionRefreshToken replaces a session's refresh token, remembering
+// the old one so its reuse can be detected. It only succeeds if the session
+// still has the token it was read with, so of two refreshes racing with the
+// same token only one wins; false means the token was already rotated.
+func (d *Database) RotateSessionRefreshToken(session *Session, newTokenHash string, expiresAt time.Time) (bool, error) {
+	now := time.Now()
+	result, err := d.db.Exec(`
+		UPDATE sessions SET refresh_token_hash = ?, previous_token_hash = ?, last_used_at = ?, expires_at = ?
+		WHERE id = ? AND refresh_token_hash = ? AND revoked_at IS NULL
+	`, newTokenHash, session.RefreshTokenHash, now, expiresAt, session.ID, session.RefreshTokenHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+	session.PreviousTokenHash = session.RefreshTokenHash
+	session.RefreshTokenHash = newTokenHash
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+	return true, nil
+}
+
+// TouchSession records that a session was just used
+func (d *Database) TouchSession(id string) error {
+	_, err := d.db.Exec(`UPDATE sessions SET last_used_at = ? WHERE id = ?`, time.Now(), id)
+	return err
+}
+
+func (d *Database) RevokeSession(id string) error {
+	_, err := d.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// RevokeUserSessions signs a user out everywhere
+func (d *Database) RevokeUserSessions(userID string) error {
+	_, err := d.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, time.Now(), userID)
+	return err
+}
+
+// RevokeOtherUserSessions signs a user out everywhere except the given session
+func (d *Database) RevokeOtherUserSessions(userID, keepSessionID string) error {
+	_, err := d.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL`, time.Now(), userID, keepSessionID)
+	return err
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ShareLink gives people without an account access to a finished render
+type ShareLink struct {
+	ID            string     `json:"id"`
+	TaskID        string     `json:"task_id"`
+	UserID        string     `json:"user_id"`
+	PasswordHash  string     `json:"-"`
+	HasPassword   bool       `json:"has_password"`
+	AllowDownload bool       `json:"allow_download"`
+	Views         int        `json:"views"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	URL string `json:"url,omitempty"` // Watch page URL, not stored
+}
+
+// Active reports whether the link can still be used
+func (s *ShareLink) Active() bool {
+	if s.RevokedAt != nil {
+		return false
+	}
+	return s.ExpiresAt == nil || time.Now().Before(*s.ExpiresAt)
+}
+
+func createShareTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS share_links (
+			id TEXT PRIMARY KEY,
+			task_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			password_hash TEXT NOT NULL DEFAULT '',
+			allow_download BOOLEAN NOT NULL DEFAULT 0,
+			views INTEGER NOT NULL DEFAULT 0,
+			expires_at DATETIME,
+			revoked_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (task_id) REFERENCES tasks(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_share_links_task_id ON share_links(task_id)`)
+	return err
+}
+
+const shareLinkColumns = `id, task_id, user_id, password_hash, allow_download, views, expires_at, revoked_at, created_at`
+
+func scanShareLink(row rowScanner) (*ShareLink, error) {
+	share := &ShareLink{}
+	err := row.Scan(&share.ID, &share.TaskID, &share.UserID, &share.PasswordHash, &share.AllowDownload, &share.Views,
+		&share.ExpiresAt, &share.RevokedAt, &share.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	share.HasPassword = share.PasswordHash != ""
+	return share, nil
+}
+
+// Share link methods
+func (d *Database) CreateShareLink(share *ShareLink) error {
+	_, err := d.db.Exec(`
+		INSERT INTO share_links (id, task_id, user_id, password_hash, allow_download, views, expires_at, revoked_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, share.ID, share.TaskID, share.UserID, share.PasswordHash, share.AllowDownload, share.Views, share.ExpiresAt, share.RevokedAt, share.CreatedAt)
+	return err
+}
+
+func (d *Database) GetShareLinkByID(id string) (*ShareLink, error) {
+	return scanShareLink(d.db.QueryRow(`SELECT `+shareLinkColumns+` FROM share_links WHERE id = ?`, id))
+}
+
+// GetShareLinksByTaskID returns all links for a task, newest first, including
+// revoked and expired ones
+func (d *Database) GetShareLinksByTaskID(taskID string) ([]*ShareLink, error) {
+	rows, err := d.db.Query(`SELECT `+shareLinkColumns+` FROM share_links WHERE task_id = ? ORDER BY created_at DESC`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*ShareLink, 0)
+	for rows.Next() {
+		share, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
+func (d *Database) RevokeShareLink(id string) error {
+	_, err := d.db.Exec(`UPDATE share_links SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// IncrementShareViews counts one view of the watch page
+func (d *Database) IncrementShareViews(id string) error {
+	_, err := d.db.Exec(`UPDATE share_links SET views = views + 1 WHERE id = ?`, id)
+	return err
+}
+
+func (d *Database) DeleteShareLinksByTaskID(taskID string) error {
+	_, err := d.db.Exec(`DELETE FROM share_links WHERE task_id = ?`, taskID)
+	return err
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Single-use token that lets a user who passed the password check finish
+// logging in with a second factor
+const TokenTwoFactorChallenge = "two_factor_challenge"
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// user's authenticator is lost. Only its hash is stored.
+type RecoveryCode struct {
+	ID        string
+	UserID    string
+	CodeHash  string
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func createTOTPTables(db *sql.DB) error {
+	// Add TOTP columns to users if they don't exist (for existing databases)
+	for _, column := range []string{
+		`totp_enabled BOOLEAN NOT NULL DEFAULT 0`,
+		`totp_secret TEXT`,
+		`totp_last_step INTEGER NOT NULL DEFAULT 0`,
+	} {
+		_, err := db.Exec(`ALTER TABLE users ADD COLUMN ` + column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS recovery_codes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id)`)
+	return err
+}
+
+// SetTOTPSecret starts enrollment with a new secret. 2FA stays off until
+// EnableTOTP confirms the user's authenticator has it.
+func (d *Database) SetTOTPSecret(userID, secret string) error {
+	_, err := d.db.Exec(`
+		UPDATE users SET totp_secret = ?, totp_last_step = 0, updated_at = ? WHERE id = ? AND totp_enabled = 0
+	`, secret, time.Now(), userID)
+	return err
+}
+
+// EnableTOTP turns on 2FA and replaces the user's recovery codes
+func (d *Database) EnableTOTP(userID string, codes []*RecoveryCode) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE users SET totp_enabled = 1, updated_at = ? WHERE id = ?`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off 2FA, forgetting the secret and recovery codes
+func (d *Database) DisableTOTP(userID string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0, updated_at = ? WHERE id = ?
+	`, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code from the given time step was accepted. It
+// returns false if a code from that step or a later one was already used, so
+// that each code works once.
+func (d *Database) UseTOTPStep(userID string, step int64) (bool, error) {
+	result, err := d.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new ones
+func (d *Database) ReplaceRecoveryCodes(userID string, codes []*RecoveryCode) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string, codes []*RecoveryCode) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(`
+			INSERT INTO recovery_codes (id, user_id, code_hash, created_at) VALUES (?, ?, ?, ?)
+		`, code.ID, userID, code.CodeHash, code.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used. It
+// returns false if the user has no such unused code.
+func (d *Database) UseRecoveryCode(userID, codeHash string) (bool, error) {
+	result, err := d.db.Exec(`
+		UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left
+func (d *Database) CountRecoveryCodes(userID string) (int, error) {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,174 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// FileDeletion is a stored file waiting for the janitor to delete it, after
+// the task or asset it belonged to was purged from the trash
+type FileDeletion struct {
+	ID        int64
+	Store     string // "uploads" or "output"
+	Key       string
+	CreatedAt time.Time
+}
+
+func createTrashTables(db *sql.DB) error {
+	// Add deleted_at columns if they don't exist (for existing databases)
+	for _, table := range []string{"tasks", "assets"} {
+		_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN deleted_at DATETIME`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_deleted_at ON ` + table + `(deleted_at)`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS file_deletions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			store TEXT NOT NULL,
+			key TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	return err
+}
+
+// TrashTask moves a task to the trash. Its output is kept until the trash is
+// emptied.
+func (d *Database) TrashTask(id string) error {
+	_, err := d.db.Exec(`UPDATE tasks SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// RestoreTask takes a task back out of the trash
+func (d *Database) RestoreTask(id string) error {
+	_, err := d.db.Exec(`UPDATE tasks SET deleted_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// TrashAsset moves an asset to the trash. Its file is kept until the trash is
+// emptied.
+func (d *Database) TrashAsset(id string) error {
+	_, err := d.db.Exec(`UPDATE assets SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// RestoreAsset takes an asset back out of the trash
+func (d *Database) RestoreAsset(id string) error {
+	_, err := d.db.Exec(`UPDATE assets SET deleted_at = NULL WHERE id = ?`, id)
+	return err
+}
+
+// GetTrashedTasks returns the tasks in a user's trash, or in a workspace's
+// when workspaceID is set, most recently deleted first
+func (d *Database) GetTrashedTasks(userID, workspaceID string) ([]*Task, error) {
+	condition, id := trashScope(userID, workspaceID)
+	rows, err := d.db.Query(`
+		SELECT `+taskColumns+` FROM tasks WHERE `+condition+` AND deleted_at IS NOT NULL ORDER BY deleted_at DESC
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanTasks(rows)
+}
+
+// GetTrashedAssets returns the assets in a user's or workspace's trash, like
+// GetTrashedTasks
+func (d *Database) GetTrashedAssets(userID, workspaceID string) ([]*Asset, error) {
+	condition, id := trashScope(userID, workspaceID)
+	return d.queryAssets(`
+		SELECT `+assetColumns+` FROM assets WHERE `+condition+` AND deleted_at IS NOT NULL ORDER BY deleted_at DESC
+	`, id)
+}
+
+// GetTasksTrashedBefore returns the tasks that went into the trash before the
+// given time
+func (d *Database) GetTasksTrashedBefore(before time.Time) ([]*Task, error) {
+	rows, err := d.db.Query(`SELECT `+taskColumns+` FROM tasks WHERE deleted_at < ? ORDER BY deleted_at`, before)
+	if err != nil {
+		return nil, err
+	}
+	return scanTasks(rows)
+}
+
+// GetAssetsTrashedBefore returns the assets that went into the trash before
+// the given time
+func (d *Database) GetAssetsTrashedBefore(before time.Time) ([]*Asset, error) {
+	return d.queryAssets(`SELECT `+assetColumns+` FROM assets WHERE deleted_at < ? ORDER BY deleted_at`, before)
+}
+
+// PurgeTask deletes a task and its share links for good, leaving its output
+// for the janitor to delete
+func (d *Database) PurgeTask(id, outputKey string) error {
+	return d.purge(`tasks`, id, "output", outputKey, `DELETE FROM share_links WHERE task_id = ?`)
+}
+
+// PurgeAsset deletes an asset for good, leaving its file for the janitor to
+// delete
+func (d *Database) PurgeAsset(id, storedName string) error {
+	return d.purge(`assets`, id, "uploads", storedName, "")
+}
+
+func (d *Database) purge(table, id, store, key, cleanup string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM `+table+` WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if cleanup != "" {
+		if _, err := tx.Exec(cleanup, id); err != nil {
+			return err
+		}
+	}
+	if key != "" {
+		_, err := tx.Exec(`INSERT INTO file_deletions (store, key, created_at) VALUES (?, ?, ?)`, store, key, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetFileDeletions returns the files waiting to be deleted, oldest first
+func (d *Database) GetFileDeletions() ([]*FileDeletion, error) {
+	rows, err := d.db.Query(`SELECT id, store, key, created_at FROM file_deletions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deletions []*FileDeletion
+	for rows.Next() {
+		deletion := &FileDeletion{}
+		if err := rows.Scan(&deletion.ID, &deletion.Store, &deletion.Key, &deletion.CreatedAt); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, deletion)
+	}
+	return deletions, rows.Err()
+}
+
+// DeleteFileDeletion forgets a file once it has been deleted
+func (d *Database) DeleteFileDeletion(id int64) error {
+	_, err := d.db.Exec(`DELETE FROM file_deletions WHERE id = ?`, id)
+	return err
+}
+
+// trashScope returns the condition selecting a user's own items, or a
+// workspace's when workspaceID is set
+func trashScope(userID, workspaceID string) (string, string) {
+	if workspaceID != "" {
+		return `workspace_id = ?`, workspaceID
+	}
+	return `user_id = ? AND workspace_id IS NULL`, userID
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UploadSession tracks a resumable (tus) upload while its chunks arrive
+type UploadSession struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	WorkspaceID string    `json:"workspace_id,omitempty"` // Where the finished asset goes
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Length      int64     `json:"length"`
+	Offset      int64     `json:"offset"`
+	AssetID     string    `json:"asset_id,omitempty"` // Set once the upload is complete
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func createUploadTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS upload_sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			content_type TEXT,
+			length INTEGER NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			asset_id TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	return err
+}
+
+// Upload session methods
+func (d *Database) CreateUploadSession(upload *UploadSession) error {
+	_, err := d.db.Exec(`
+		INSERT INTO upload_sessions (id, user_id, workspace_id, filename, content_type, length, upload_offset, asset_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, upload.ID, upload.UserID, nullIfEmpty(upload.WorkspaceID), upload.Filename, upload.ContentType, upload.Length, upload.Offset, upload.AssetID, upload.CreatedAt, upload.UpdatedAt)
+	return err
+}
+
+func (d *Database) GetUploadSession(id string) (*UploadSession, error) {
+	upload := &UploadSession{}
+	var workspaceID, assetID sql.NullString
+	err := d.db.QueryRow(`
+		SELECT id, user_id, workspace_id, filename, content_type, length, upload_offset, asset_id, created_at, updated_at
+		FROM upload_sessions WHERE id = ?
+	`, id).Scan(&upload.ID, &upload.UserID, &workspaceID, &upload.Filename, &upload.ContentType, &upload.Length, &upload.Offset, &assetID, &upload.CreatedAt, &upload.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	upload.WorkspaceID = workspaceID.String
+	upload.AssetID = assetID.String
+	return upload, nil
+}
+
+func (d *Database) UpdateUploadSession(upload *UploadSession) error {
+	upload.UpdatedAt = time.Now()
+	_, err := d.db.Exec(`
+		UPDATE upload_sessions SET upload_offset = ?, asset_id = ?, updated_at = ?
+		WHERE id = ?
+	`, upload.Offset, upload.AssetID, upload.UpdatedAt, upload.ID)
+	return err
+}
+
+func (d *Database) DeleteUploadSession(id string) error {
+	_, err := d.db.Exec(`DELETE FROM upload_sessions WHERE id = ?`, id)
+	return err
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Purposes of single-use tokens
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+	TokenOIDCLogin         = "oidc_login" // Handed to the app after single sign-on, to trade for tokens
+)
+
+// UserToken is a single-use, expiring secret emailed to a user, or handed to
+// the app after single sign-on. Only its hash is stored.
+type UserToken struct {
+	ID        string
+	UserID    string
+	Purpose   string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func createUserTokenTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS user_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens(user_id)`)
+	return err
+}
+
+// CreateUserToken stores a new token, invalidating any unused tokens the user
+// already has for the same purpose
+func (d *Database) CreateUserToken(token *UserToken) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM user_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL`, token.UserID, token.Purpose)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO user_tokens (id, user_id, purpose, token_hash, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, token.ID, token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumeUserToken marks a token as used and returns it. It fails with
+// sql.ErrNoRows if the token doesn't exist, has the wrong purpose, has
+// expired or was already used, so each token works exactly once.
+func (d *Database) ConsumeUserToken(tokenHash, purpose string) (*UserToken, error) {
+	now := time.Now()
+	result, err := d.db.Exec(`
+		UPDATE user_tokens SET used_at = ?
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	`, now, tokenHash, purpose, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	token := &UserToken{}
+	err = d.db.QueryRow(`
+		SELECT id, user_id, purpose, token_hash, expires_at, used_at, created_at
+		FROM user_tokens WHERE token_hash = ?
+	`, tokenHash).Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetUserToken returns a token that can still be used, without using it up
+func (d *Database) GetUserToken(tokenHash, purpose string) (*UserToken, error) {
+	token := &UserToken{}
+	err := d.db.QueryRow(`
+		SELECT id, user_id, purpose, token_hash, expires_at, used_at, created_at
+		FROM user_tokens WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	`, tokenHash, purpose, time.Now()).Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
@@ -0,0 +1,411 @@
+package models
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Workspace roles, from least to most privileged
+const (
+	WorkspaceViewer = "viewer" // Sees the workspace's tasks and assets
+	WorkspaceEditor = "editor" // Also uploads, renders, shares and deletes
+	WorkspaceOwner  = "owner"  // Also manages the workspace and its members
+)
+
+var workspaceRoleRanks = map[string]int{
+	WorkspaceViewer: 1,
+	WorkspaceEditor: 2,
+	WorkspaceOwner:  3,
+}
+
+// ValidWorkspaceRole reports whether role is one of the workspace roles
+func ValidWorkspaceRole(role string) bool {
+	return workspaceRoleRanks[role] > 0
+}
+
+// WorkspaceRoleAtLeast reports whether role grants everything required does
+func WorkspaceRoleAtLeast(role, required string) bool {
+	return ValidWorkspaceRole(role) && workspaceRoleRanks[role] >= workspaceRoleRanks[required]
+}
+
+// Workspace is a group of users sharing tasks and assets. Tasks and assets
+// outside any workspace belong to the user who created them.
+type Workspace struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Role string `json:"role,omitempty"` // The caller's role, not stored
+}
+
+type WorkspaceMember struct {
+	WorkspaceID string    `json:"workspace_id"`
+	UserID      string    `json:"user_id"`
+	Email       string    `json:"email"`
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// WorkspaceInvitation lets someone join a workspace. Invitations sent to an
+// email can be used once, by that address; link invitations work for anyone
+// until they expire or are revoked.
+type WorkspaceInvitation struct {
+	ID          string     `json:"id"`
+	WorkspaceID string     `json:"workspace_id"`
+	Email       string     `json:"email,omitempty"`
+	Role        string     `json:"role"`
+	TokenHash   string     `json:"-"`
+	InvitedBy   string     `json:"invited_by"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// Active reports whether the invitation can still be accepted
+func (i *WorkspaceInvitation) Active() bool {
+	return i.AcceptedAt == nil && i.RevokedAt == nil && time.Now().Before(i.ExpiresAt)
+}
+
+func createWorkspaceTables(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS workspaces (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (created_by) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS workspace_members (
+			workspace_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (workspace_id, user_id),
+			FOREIGN KEY (workspace_id) REFERENCES workspaces(id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_workspace_members_user_id ON workspace_members(user_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS workspace_invitations (
+			id TEXT PRIMARY KEY,
+			workspace_id TEXT NOT NULL,
+			email TEXT,
+			role TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			invited_by TEXT NOT NULL,
+			expires_at DATETIME NOT NULL,
+			accepted_at DATETIME,
+			revoked_at DATETIME,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (workspace_id) REFERENCES workspaces(id),
+			FOREIGN KEY (invited_by) REFERENCES users(id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_workspace_invitations_workspace_id ON workspace_invitations(workspace_id)`)
+	if err != nil {
+		return err
+	}
+
+	// Tasks, assets and uploads outside a workspace keep a NULL workspace_id
+	for _, table := range []string{"tasks", "assets", "upload_sessions"} {
+		_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN workspace_id TEXT REFERENCES workspaces(id)`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_` + table + `_workspace_id ON ` + table + `(workspace_id)`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Workspace methods
+
+// CreateWorkspace creates a workspace with its creator as the owner
+func (d *Database) CreateWorkspace(workspace *Workspace) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO workspaces (id, name, created_by, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, workspace.ID, workspace.Name, workspace.CreatedBy, workspace.CreatedAt, workspace.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at)
+		VALUES (?, ?, ?, ?)
+	`, workspace.ID, workspace.CreatedBy, WorkspaceOwner, workspace.CreatedAt)
+	if err != nil {
+		return err
+	}
+	workspace.Role = WorkspaceOwner
+	return tx.Commit()
+}
+
+func (d *Database) GetWorkspaceByID(id string) (*Workspace, error) {
+	workspace := &Workspace{}
+	err := d.db.QueryRow(`
+		SELECT id, name, created_by, created_at, updated_at FROM workspaces WHERE id = ?
+	`, id).Scan(&workspace.ID, &workspace.Name, &workspace.CreatedBy, &workspace.CreatedAt, &workspace.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return workspace, nil
+}
+
+// GetWorkspacesByUserID returns the workspaces a user belongs to, with their
+// role in each, ordered by name
+func (d *Database) GetWorkspacesByUserID(userID string) ([]*Workspace, error) {
+	rows, err := d.db.Query(`
+		SELECT w.id, w.name, w.created_by, w.created_at, w.updated_at, m.role
+		FROM workspaces w JOIN workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id = ? ORDER BY w.name COLLATE NOCASE
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := make([]*Workspace, 0)
+	for rows.Next() {
+		workspace := &Workspace{}
+		err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.CreatedBy, &workspace.CreatedAt, &workspace.UpdatedAt, &workspace.Role)
+		if err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, rows.Err()
+}
+
+func (d *Database) RenameWorkspace(id, name string) error {
+	_, err := d.db.Exec(`UPDATE workspaces SET name = ?, updated_at = ? WHERE id = ?`, name, time.Now(), id)
+	return err
+}
+
+// DeleteWorkspace removes a workspace along with its members and invitations.
+// Its tasks, assets and uploads go back to the users who created them.
+func (d *Database) DeleteWorkspace(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"tasks", "assets", "upload_sessions"} {
+		if _, err := tx.Exec(`UPDATE `+table+` SET workspace_id = NULL WHERE workspace_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	for _, table := range []string{"workspace_members", "workspace_invitations"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE workspace_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM workspaces WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Workspace member methods
+
+// GetWorkspaceRole returns a user's role in a workspace, or sql.ErrNoRows if
+// they aren't a member
+func (d *Database) GetWorkspaceRole(workspaceID, userID string) (string, error) {
+	var role string
+	err := d.db.QueryRow(`
+		SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?
+	`, workspaceID, userID).Scan(&role)
+	return role, err
+}
+
+// GetWorkspaceMembers returns a workspace's members, owners first
+func (d *Database) GetWorkspaceMembers(workspaceID string) ([]*WorkspaceMember, error) {
+	rows, err := d.db.Query(`
+		SELECT m.workspace_id, m.user_id, u.email, u.username, m.role, m.created_at
+		FROM workspace_members m JOIN users u ON u.id = m.user_id
+		WHERE m.workspace_id = ?
+		ORDER BY CASE m.role WHEN 'owner' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END, m.created_at
+	`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*WorkspaceMember, 0)
+	for rows.Next() {
+		member := &WorkspaceMember{}
+		err := rows.Scan(&member.WorkspaceID, &member.UserID, &member.Email, &member.Username, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// CountWorkspaceOwners returns how many owners a workspace has, so the last
+// one can't leave it ownerless
+func (d *Database) CountWorkspaceOwners(workspaceID string) (int, error) {
+	var owners int
+	err := d.db.QueryRow(`
+		SELECT COUNT(*) FROM workspace_members WHERE workspace_id = ? AND role = ?
+	`, workspaceID, WorkspaceOwner).Scan(&owners)
+	return owners, err
+}
+
+func (d *Database) SetWorkspaceMemberRole(workspaceID, userID, role string) error {
+	_, err := d.db.Exec(`
+		UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?
+	`, role, workspaceID, userID)
+	return err
+}
+
+func (d *Database) RemoveWorkspaceMember(workspaceID, userID string) error {
+	_, err := d.db.Exec(`DELETE FROM workspace_members WHERE workspace_id = ? AND user_id = ?`, workspaceID, userID)
+	return err
+}
+
+// Workspace invitation methods
+func (d *Database) CreateWorkspaceInvitation(invitation *WorkspaceInvitation) error {
+	_, err := d.db.Exec(`
+		INSERT INTO workspace_invitations (id, workspace_id, email, role, token_hash, invited_by, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, invitation.ID, invitation.WorkspaceID, nullIfEmpty(invitation.Email), invitation.Role, invitation.TokenHash,
+		invitation.InvitedBy, invitation.ExpiresAt, invitation.CreatedAt)
+	return err
+}
+
+const workspaceInvitationColumns = `id, workspace_id, email, role, token_hash, invited_by, expires_at, accepted_at, revoked_at, created_at`
+
+func scanWorkspaceInvitation(row rowScanner) (*WorkspaceInvitation, error) {
+	invitation := &WorkspaceInvitation{}
+	var email sql.NullString
+	err := row.Scan(&invitation.ID, &invitation.WorkspaceID, &email, &invitation.Role, &invitation.TokenHash,
+		&invitation.InvitedBy, &invitation.ExpiresAt, &invitation.AcceptedAt, &invitation.RevokedAt, &invitation.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	invitation.Email = email.String
+	return invitation, nil
+}
+
+func (d *Database) GetWorkspaceInvitationByID(id string) (*WorkspaceInvitation, error) {
+	return scanWorkspaceInvitation(d.db.QueryRow(`SELECT `+workspaceInvitationColumns+` FROM workspace_invitations WHERE id = ?`, id))
+}
+
+func (d *Database) GetWorkspaceInvitationByToken(tokenHash string) (*WorkspaceInvitation, error) {
+	return scanWorkspaceInvitation(d.db.QueryRow(`SELECT `+workspaceInvitationColumns+` FROM workspace_invitations WHERE token_hash = ?`, tokenHash))
+}
+
+// GetActiveWorkspaceInvitations returns a workspace's invitations that can
+// still be accepted, newest first
+func (d *Database) GetActiveWorkspaceInvitations(workspaceID string) ([]*WorkspaceInvitation, error) {
+	rows, err := d.db.Query(`
+		SELECT `+workspaceInvitationColumns+` FROM workspace_invitations
+		WHERE workspace_id = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY created_at DESC
+	`, workspaceID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := make([]*WorkspaceInvitation, 0)
+	for rows.Next() {
+		invitation, err := scanWorkspaceInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+func (d *Database) RevokeWorkspaceInvitation(id string) error {
+	_, err := d.db.Exec(`UPDATE workspace_invitations SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now(), id)
+	return err
+}
+
+// AcceptWorkspaceInvitation adds the user to the invitation's workspace.
+// Email invitations are used up; members who already belong keep their role
+// unless the invitation grants a higher one. It returns the user's role.
+func (d *Database) AcceptWorkspaceInvitation(invitation *WorkspaceInvitation, userID string) (string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if invitation.Email != "" {
+		result, err := tx.Exec(`
+			UPDATE workspace_invitations SET accepted_at = ?
+			WHERE id = ? AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?
+		`, now, invitation.ID, now)
+		if err != nil {
+			return "", err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return "", err
+		} else if n == 0 {
+			return "", sql.ErrNoRows
+		}
+	}
+
+	role := invitation.Role
+	var current string
+	err = tx.QueryRow(`
+		SELECT role FROM workspace_members WHERE workspace_id = ? AND user_id = ?
+	`, invitation.WorkspaceID, userID).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`
+			INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES (?, ?, ?, ?)
+		`, invitation.WorkspaceID, userID, role, now)
+	case err != nil:
+		return "", err
+	case WorkspaceRoleAtLeast(current, role):
+		role = current
+	default:
+		_, err = tx.Exec(`
+			UPDATE workspace_members SET role = ? WHERE workspace_id = ? AND user_id = ?
+		`, role, invitation.WorkspaceID, userID)
+	}
+	if err != nil {
+		return "", err
+	}
+	return role, tx.Commit()
+}
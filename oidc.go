@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/config"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	// oidcStateCookie ties the provider's callback to the browser that started
+	// the login, so nobody can slip their own login into someone else's browser
+	oidcStateCookie  = "clipflow_oidc_state"
+	oidcLoginTimeout = 10 * time.Minute // How long the user has to sign in at the provider
+	oidcLoginCodeTTL = time.Minute      // How long the app has to exchange the code for tokens
+)
+
+type OIDCExchangeRequest struct {
+	Code           string `json:"code" binding:"required"`
+	MergeAnonymous bool   `json:"merge_anonymous"`
+}
+
+// oidcDiscovery keeps the provider's configuration once it has been fetched.
+// Logins in progress are kept in the database, so any instance can finish them.
+var oidcDiscovery struct {
+	sync.Mutex
+	provider *auth.OIDCProvider
+}
+
+func oidcEnabled() bool {
+	return config.AppConfig.OIDC.IssuerURL != ""
+}
+
+// getOIDCProvider returns the configured provider, running discovery the first
+// time. A failed discovery is retried on the next login.
+func getOIDCProvider(ctx context.Context) (*auth.OIDCProvider, error) {
+	oidcDiscovery.Lock()
+	defer oidcDiscovery.Unlock()
+
+	if oidcDiscovery.provider != nil {
+		return oidcDiscovery.provider, nil
+	}
+	oidcConfig := config.AppConfig.OIDC
+	provider, err := auth.NewOIDCProvider(ctx, auth.OIDCConfig{
+		IssuerURL:    oidcConfig.IssuerURL,
+		ClientID:     oidcConfig.ClientID,
+		ClientSecret: oidcConfig.ClientSecret,
+		Scopes:       oidcConfig.Scopes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	oidcDiscovery.provider = provider
+	return provider, nil
+}
+
+func oidcRedirectURL() string {
+	if redirectURL := config.AppConfig.OIDC.RedirectURL; redirectURL != "" {
+		return redirectURL
+	}
+	return publicBaseURL() + "/api/auth/oidc/callback"
+}
+
+// localRedirectPath only lets logins return to a path on this site
+func localRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// redirectLoginError sends the browser back to the app with an error message
+func redirectLoginError(c *gin.Context, message string) {
+	c.Redirect(http.StatusFound, "/?"+url.Values{"login_error": {message}}.Encode())
+}
+
+func authProvidersHandler(c *gin.Context) {
+	providers := gin.H{}
+	if oidcEnabled() {
+		providers["oidc"] = gin.H{
+			"name":      config.AppConfig.OIDC.ProviderName,
+			"login_url": "/api/auth/oidc/login",
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"password": true, "providers": providers})
+}
+
+// oidcLoginHandler sends the browser to the provider to sign in. ?redirect=
+// names the page to come back to.
+func oidcLoginHandler(c *gin.Context) {
+	if !oidcEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Single sign-on is not configured"})
+		return
+	}
+
+	provider, err := getOIDCProvider(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to reach OIDC provider", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Single sign-on provider is unavailable"})
+		return
+	}
+
+	state, errState := auth.NewOpaqueToken()
+	nonce, errNonce := auth.NewOpaqueToken()
+	verifier, errVerifier := auth.NewOpaqueToken()
+	if errState != nil || errNonce != nil || errVerifier != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	now := time.Now()
+	err = db.CreateOIDCLogin(&models.OIDCLogin{
+		StateHash: auth.HashOpaqueToken(state),
+		Nonce:     nonce,
+		Verifier:  verifier,
+		Redirect:  localRedirectPath(c.Query("redirect")),
+		ExpiresAt: now.Add(oidcLoginTimeout),
+		CreatedAt: now,
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to store OIDC login", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign-in"})
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcLoginTimeout.Seconds()), "/api/auth/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(oidcRedirectURL(), state, nonce, verifier))
+}
+
+// oidcCallbackHandler finishes the sign-in at the provider, finds or creates
+// the user, and sends the browser back to the app with a one-time login code
+// in the URL fragment
+func oidcCallbackHandler(c *gin.Context) {
+	state := c.Query("state")
+	cookieState, _ := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/api/auth/oidc", "", c.Request.TLS != nil, true)
+
+	if state == "" || cookieState != state {
+		redirectLoginError(c, "Sign-in expired, please try again")
+		return
+	}
+	pending, err := db.ConsumeOIDCLogin(auth.HashOpaqueToken(state))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to look up OIDC login", "error", err)
+		}
+		redirectLoginError(c, "Sign-in expired, please try again")
+		return
+	}
+	if errorCode := c.Query("error"); errorCode != "" {
+		slog.WarnContext(c.Request.Context(), "OIDC provider returned an error", "error", errorCode, "description", c.Query("error_description"))
+		redirectLoginError(c, "Sign-in was cancelled or refused")
+		return
+	}
+
+	provider, err := getOIDCProvider(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to reach OIDC provider", "error", err)
+		redirectLoginError(c, "Single sign-on provider is unavailable")
+		return
+	}
+	identity, err := provider.Exchange(c.Request.Context(), oidcRedirectURL(), c.Query("code"), pending.Verifier, pending.Nonce)
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "OIDC sign-in failed", "error", err)
+		redirectLoginError(c, "Sign-in failed")
+		return
+	}
+
+	user, err := userForOIDCIdentity(identity)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to find user for OIDC subject", "subject", identity.Subject, "error", err)
+		if errors.Is(err, errOIDCEmailUnverified) {
+			redirectLoginError(c, "Your sign-in provider hasn't verified your email address")
+			return
+		}
+		redirectLoginError(c, "Sign-in failed")
+		return
+	}
+
+	code, err := auth.NewOpaqueToken()
+	if err != nil {
+		redirectLoginError(c, "Sign-in failed")
+		return
+	}
+	// The code goes in the URL fragment in place of the tokens themselves,
+	// which keeps them out of URLs
+	now := time.Now()
+	err = db.CreateUserToken(&models.UserToken{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Purpose:   models.TokenOIDCLogin,
+		TokenHash: auth.HashOpaqueToken(code),
+		ExpiresAt: now.Add(oidcLoginCodeTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to store OIDC login code", "user_id", user.ID, "error", err)
+		redirectLoginError(c, "Sign-in failed")
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "User signed in through OIDC", "user_id", user.ID)
+	c.Redirect(http.StatusFound, pending.Redirect+"#"+url.Values{"login_code": {code}}.Encode())
+}
+
+// oidcExchangeHandler trades a login code from the callback for the same
+// response /api/login gives, including the 2FA challenge if the account has it
+func oidcExchangeHandler(c *gin.Context) {
+	var req OIDCExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	loginCode, err := db.ConsumeUserToken(auth.HashOpaqueToken(req.Code), models.TokenOIDCLogin)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to consume OIDC login code", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code"})
+		return
+	}
+	user, err := db.GetUserByID(loginCode.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		startTwoFactorChallenge(c, user)
+		return
+	}
+	completeLogin(c, user, req.MergeAnonymous)
+}
+
+var errOIDCEmailUnverified = errors.New("provider did not verify the email")
+
+// userForOIDCIdentity returns the user linked to a provider account. The first
+// time, the account is linked to the user with the same email, or a new user
+// is created, but only if the provider vouches for the email.
+func userForOIDCIdentity(identity *auth.OIDCIdentity) (*models.User, error) {
+	if user, err := db.GetUserByIdentity(identity.Issuer, identity.Subject); err == nil {
+		return user, nil
+	}
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, errOIDCEmailUnverified
+	}
+
+	user, err := db.GetUserByEmail(identity.Email)
+	if err == nil {
+		if user.IsAnonymous() {
+			return nil, fmt.Errorf("email %s belongs to an anonymous user", identity.Email)
+		}
+		if !user.EmailVerified {
+			// Whoever registered the address never proved they own it, so
+			// nothing they set up on the account may outlive the link
+			if err := db.ReclaimUnverifiedUser(user); err != nil {
+				return nil, err
+			}
+			slog.Info("Reset the credentials of an unverified user before linking it to OIDC", "user_id", user.ID, "subject", identity.Subject)
+		}
+	} else {
+		user, err = createOIDCUser(identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = db.CreateUserIdentity(&models.UserIdentity{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		Issuer:    identity.Issuer,
+		Subject:   identity.Subject,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Linked OIDC subject to user", "subject", identity.Subject, "user_id", user.ID)
+	return user, nil
+}
+
+// createOIDCUser registers a user who signs in only through the provider. They
+// have no password until they set one with a password reset.
+func createOIDCUser(identity *auth.OIDCIdentity) (*models.User, error) {
+	username := identity.PreferredUsername
+	if username == "" {
+		username = identity.Name
+	}
+	if username == "" {
+		username, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	for attempt := 0; ; attempt++ {
+		candidate := username
+		if attempt > 0 {
+			candidate = fmt.Sprintf("%s_%s", username, uuid.New().String()[:4])
+		}
+		user := &models.User{
+			ID:            uuid.New().String(),
+			Email:         identity.Email,
+			Username:      candidate,
+			EmailVerified: true,
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+		err := db.CreateUser(user)
+		if err == nil {
+			return user, nil
+		}
+		if attempt >= 3 || !strings.Contains(err.Error(), "UNIQUE constraint failed: users.username") {
+			return nil, err
+		}
+	}
+}
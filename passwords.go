@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/config"
+	"clipflow/mail"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// mailer sends password reset and verification emails
+var mailer mail.Mailer
+
+// newMailer creates the configured mail backend
+func newMailer() (mail.Mailer, error) {
+	mailConfig := config.AppConfig.Mail
+	switch mailConfig.Backend {
+	case "smtp":
+		// Links in real emails must not depend on how the server was reached
+		if config.AppConfig.Server.PublicURL == "" {
+			return nil, errors.New("PUBLIC_URL must be set to send email over SMTP")
+		}
+		return mail.NewSMTP(mail.SMTPConfig{
+			Host:     mailConfig.SMTPHost,
+			Port:     mailConfig.SMTPPort,
+			Username: mailConfig.SMTPUsername,
+			Password: mailConfig.SMTPPassword,
+			From:     mailConfig.From,
+		})
+	case "file":
+		return mail.NewFile(mailConfig.FileDir, mailConfig.From)
+	case "log", "":
+		return mail.NewLog(), nil
+	}
+	return nil, errors.New("unknown mail backend: " + mailConfig.Backend)
+}
+
+// sendMail delivers an email in the background so that slow mail servers
+// don't hold up the request, or reveal whether an address has an account
+func sendMail(msg mail.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Failed to send email", "subject", msg.Subject, "to", msg.To, "error", err)
+		}
+	}()
+}
+
+// publicBaseURL returns the base URL for links in emails and other links
+// that carry secrets. It comes from PUBLIC_URL, or the address the server
+// listens on when that isn't set, and never from the request, so a forged Host
+// or X-Forwarded-Proto header can't send a reset token to someone else's site.
+func publicBaseURL() string {
+	if publicURL := config.AppConfig.Server.PublicURL; publicURL != "" {
+		return publicURL
+	}
+	return fmt.Sprintf("http://%s:%s", config.AppConfig.Server.Host, config.AppConfig.Server.Port)
+}
+
+// issueUserToken creates a single-use token for the user and returns it. Only
+// its hash is stored.
+func issueUserToken(userID, purpose string, ttl time.Duration) (string, error) {
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = db.CreateUserToken(&models.UserToken{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: auth.HashOpaqueToken(token),
+		ExpiresAt: now.Add(ttl),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendVerificationEmail emails the user a link that confirms they own their
+// address
+func sendVerificationEmail(c *gin.Context, user *models.User) error {
+	ttl := time.Duration(config.AppConfig.Mail.EmailVerificationTTL) * time.Second
+	token, err := issueUserToken(user.ID, models.TokenEmailVerification, ttl)
+	if err != nil {
+		return err
+	}
+
+	link := publicBaseURL() + "/verify-email?token=" + token
+	sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your Clipflow email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you didn't create a Clipflow account, you can ignore this email.\n",
+			user.Username, link, formatTTL(ttl)),
+	})
+	return nil
+}
+
+// formatTTL describes a token lifetime for an email, e.g. "1 hour" or "7 days"
+func formatTTL(ttl time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case ttl >= 24*time.Hour && ttl%(24*time.Hour) == 0:
+		return plural(int(ttl/(24*time.Hour)), "day")
+	case ttl >= time.Hour && ttl%time.Hour == 0:
+		return plural(int(ttl/time.Hour), "hour")
+	}
+	return plural(int(ttl/time.Minute), "minute")
+}
+
+// changePasswordHandler sets a new password after confirming the current one,
+// and signs out every other device
+func changePasswordHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := db.GetUserByID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+	if user.IsAnonymous() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Anonymous accounts have no password, claim the account first"})
+		return
+	}
+	if !auth.CheckPassword(req.CurrentPassword, user.PasswordHash) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	user.PasswordHash, err = auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+		return
+	}
+	if err := db.UpdateUser(user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to change password", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	if err := db.RevokeOtherUserSessions(user.ID, c.GetString("sessionID")); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke other sessions", "user_id", user.ID, "error", err)
+	}
+
+	slog.InfoContext(c.Request.Context(), "User changed their password", "user_id", user.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditPasswordChange, TargetType: "user", TargetID: user.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// forgotPasswordHandler emails a password reset link. It answers the same way
+// whether or not the address has an account.
+func forgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "If an account exists for this email, a password reset link has been sent"}
+
+	user, err := db.GetUserByEmail(req.Email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to look up user for password reset", "error", err)
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if user.IsAnonymous() {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	ttl := time.Duration(config.AppConfig.Mail.PasswordResetTTL) * time.Second
+	token, err := issueUserToken(user.ID, models.TokenPasswordReset, ttl)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create password reset token", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	link := publicBaseURL() + "/reset-password?token=" + token
+	sendMail(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Clipflow password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your Clipflow account. "+
+			"To choose a new password, open this link:\n\n%s\n\n"+
+			"The link expires in %s and can only be used once. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, link, formatTTL(ttl)),
+	})
+
+	slog.InfoContext(c.Request.Context(), "Password reset requested", "user_id", user.ID)
+	c.JSON(http.StatusOK, response)
+}
+
+// resetPasswordHandler sets a new password using a token from a reset email.
+// Every session is signed out, since whoever held them may not be the owner.
+func resetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := db.ConsumeUserToken(auth.HashOpaqueToken(req.Token), models.TokenPasswordReset)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to consume password reset token", "error", err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	user, err := db.GetUserByID(token.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset link"})
+		return
+	}
+
+	user.PasswordHash, err = auth.HashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+		return
+	}
+	// The reset link arrived by email, which proves the address works
+	user.EmailVerified = true
+	if err := db.UpdateUser(user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to reset password", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	if err := db.RevokeUserSessions(user.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke sessions", "user_id", user.ID, "error", err)
+	}
+
+	slog.InfoContext(c.Request.Context(), "User reset their password", "user_id", user.ID)
+	recordAudit(c, models.AuditEvent{ActorID: user.ID, Action: models.AuditPasswordReset, TargetType: "user", TargetID: user.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully, please log in"})
+}
+
+// verifyEmail marks the owner of an email verification token as verified
+func verifyEmail(rawToken string) (*models.User, error) {
+	token, err := db.ConsumeUserToken(auth.HashOpaqueToken(rawToken), models.TokenEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.GetUserByID(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+	user.EmailVerified = true
+	if err := db.UpdateUser(user); err != nil {
+		return nil, err
+	}
+	slog.Info("User verified their email", "user_id", user.ID)
+	return user, nil
+}
+
+func verifyEmailHandler(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := verifyEmail(req.Token)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to verify email", "error", err)
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully", "user": user})
+}
+
+// verifyEmailPageHandler handles the link in verification emails, sending the
+// browser back to the app with the outcome
+func verifyEmailPageHandler(c *gin.Context) {
+	if _, err := verifyEmail(c.Query("token")); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to verify email", "error", err)
+		}
+		c.Redirect(http.StatusFound, "/?email_verified=0")
+		return
+	}
+	c.Redirect(http.StatusFound, "/?email_verified=1")
+}
+
+// resendVerificationHandler sends a fresh verification email, replacing any
+// earlier link
+func resendVerificationHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	user, err := db.GetUserByID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return
+	}
+	if user.IsAnonymous() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Anonymous accounts have no email, claim the account first"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(c, user); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to send verification email", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// resetPasswordPageHandler serves the form that reset emails link to
+func resetPasswordPageHandler(c *gin.Context) {
+	htmlContent, err := os.ReadFile("./reset-password.html")
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to load reset-password.html", "error", err)
+		c.String(http.StatusInternalServerError, "Error loading reset password page")
+		return
+	}
+	c.Header("Content-Type", "text/html")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Data(http.StatusOK, "text/html", htmlContent)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"clipflow/config"
+	"clipflow/models"
+	"clipflow/storage"
+	"clipflow/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StorageUsage is how many bytes a user stores against their limit
+type StorageUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"` // 0 for no limit
+}
+
+// RenderUsage is how many minutes of output a user has rendered this month,
+// including renders still running
+type RenderUsage struct {
+	Used        float64   `json:"used"`
+	Limit       int64     `json:"limit"` // 0 for no limit
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+}
+
+type UsageResponse struct {
+	Storage          StorageUsage `json:"storage"`
+	RenderMinutes    RenderUsage  `json:"render_minutes"`
+	MaxOutputSeconds int64        `json:"max_output_seconds"` // 0 for no limit
+}
+
+// defaultQuota returns the configured limits that apply to every user
+func defaultQuota() models.Quota {
+	return models.Quota{
+		StorageBytes:         config.AppConfig.Quota.StorageBytes,
+		MaxOutputSeconds:     config.AppConfig.Quota.MaxOutputSeconds,
+		MonthlyRenderMinutes: config.AppConfig.Quota.MonthlyRenderMinutes,
+	}
+}
+
+// quotaFor returns the limits that apply to a user: the defaults, with any an
+// admin has set for them
+func quotaFor(userID string) (models.Quota, error) {
+	override, err := db.GetQuotaOverride(userID)
+	if err != nil {
+		return models.Quota{}, err
+	}
+	return override.Apply(defaultQuota()), nil
+}
+
+// renderPeriod returns the calendar month, in UTC, that render minutes are
+// counted over
+func renderPeriod(now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// renderSecondsThisMonth adds up what a user has rendered in the current period
+func renderSecondsThisMonth(userID string) (float64, error) {
+	start, _ := renderPeriod(time.Now())
+	// Times are stored in local time, so compare in it too
+	return db.GetRenderSecondsSince(userID, start.Local())
+}
+
+// storageQuotaExceeded checks whether adding the given number of bytes would
+// take a user over their storage limit, returning why if so. Adding 0 checks
+// that there is any room left.
+func storageQuotaExceeded(userID string, adding int64) (string, error) {
+	quota, err := quotaFor(userID)
+	if err != nil || quota.StorageBytes <= 0 {
+		return "", err
+	}
+	used, err := db.GetStorageUsed(userID)
+	if err != nil {
+		return "", err
+	}
+	if adding == 0 && used >= quota.StorageBytes {
+		return fmt.Sprintf("Your storage quota is full (%s of %s used), delete some assets or renders first",
+			formatBytes(used), formatBytes(quota.StorageBytes)), nil
+	}
+	if used+adding > quota.StorageBytes {
+		return fmt.Sprintf("This %s file would exceed your storage quota (%s of %s used)",
+			formatBytes(adding), formatBytes(used), formatBytes(quota.StorageBytes)), nil
+	}
+	return "", nil
+}
+
+// checkStorageQuota refuses a request that would take the user over their
+// storage limit, writing the error response itself
+func checkStorageQuota(c *gin.Context, userID string, adding int64) bool {
+	reason, err := storageQuotaExceeded(userID, adding)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to check storage quota", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check storage quota"})
+		return false
+	}
+	if reason != "" {
+		slog.WarnContext(c.Request.Context(), "Request refused by storage quota", "user_id", userID, "reason", reason)
+		c.JSON(http.StatusForbidden, gin.H{"error": reason, "quota": "storage"})
+		return false
+	}
+	return true
+}
+
+// checkRenderQuota refuses a render of the given estimated length when it is
+// longer than the user may render at once, or than they have left this month,
+// writing the error response itself. Hold taskLocks for the user from the
+// check until the render's usage is reserved.
+func checkRenderQuota(c *gin.Context, userID string, seconds float64) bool {
+	quota, err := quotaFor(userID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get quota", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check render quota"})
+		return false
+	}
+
+	if quota.MaxOutputSeconds > 0 && seconds > float64(quota.MaxOutputSeconds) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("This video would be %s long, longer than the %s allowed per render",
+				formatSeconds(seconds), formatSeconds(float64(quota.MaxOutputSeconds))),
+			"quota": "max_output_seconds",
+		})
+		return false
+	}
+
+	if quota.MonthlyRenderMinutes > 0 {
+		used, err := renderSecondsThisMonth(userID)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to get render usage", "user_id", userID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check render quota"})
+			return false
+		}
+		limit := float64(quota.MonthlyRenderMinutes * 60)
+		if used+seconds > limit {
+			_, end := renderPeriod(time.Now())
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("This video would be %s long, but only %s of your %d monthly render minutes are left until %s",
+					formatSeconds(seconds), formatSeconds(math.Max(0, limit-used)), quota.MonthlyRenderMinutes, end.Format("January 2")),
+				"quota": "monthly_render_minutes",
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// assetDuration returns an asset's length in seconds. Assets uploaded before
+// lengths were recorded are probed now, and the result kept.
+func assetDuration(ctx context.Context, asset *models.Asset) float64 {
+	if asset.Duration > 0 {
+		return asset.Duration
+	}
+	localPath, cleanup, err := storage.Localize(ctx, uploadStore, asset.StoredName, config.AppConfig.File.TempDir)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to fetch asset to measure it", "asset_id", asset.ID, "error", err)
+		return 0
+	}
+	defer cleanup()
+	duration, err := utils.ProbeDuration(ctx, localPath)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to measure asset", "asset_id", asset.ID, "error", err)
+		return 0
+	}
+	if err := db.SetAssetDuration(asset.ID, duration); err != nil {
+		slog.ErrorContext(ctx, "Failed to save asset duration", "asset_id", asset.ID, "error", err)
+	}
+	asset.Duration = duration
+	return duration
+}
+
+// probeMediaDuration measures an uploaded video or audio file, returning 0 for
+// other types or when it can't be read
+func probeMediaDuration(ctx context.Context, filePath, assetType string) float64 {
+	if assetType != "video" && assetType != "audio" {
+		return 0
+	}
+	duration, err := utils.ProbeDuration(ctx, filePath)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to measure media duration", "path", filePath, "error", err)
+		return 0
+	}
+	return duration
+}
+
+// usageHandler reports what the caller stores and has rendered this month,
+// against their limits
+func usageHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	usage, err := getUsage(userID.(string))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to get usage", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get usage"})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+func getUsage(userID string) (*UsageResponse, error) {
+	quota, err := quotaFor(userID)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := db.GetStorageUsed(userID)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := renderSecondsThisMonth(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := renderPeriod(time.Now())
+	return &UsageResponse{
+		Storage: StorageUsage{Used: stored, Limit: quota.StorageBytes},
+		RenderMinutes: RenderUsage{
+			Used:        math.Round(rendered/60*100) / 100,
+			Limit:       quota.MonthlyRenderMinutes,
+			PeriodStart: start,
+			PeriodEnd:   end,
+		},
+		MaxOutputSeconds: quota.MaxOutputSeconds,
+	}, nil
+}
+
+// formatBytes writes a size for people, e.g. "1.5 GB"
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1024*1024*1024))
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1024*1024))
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// formatSeconds writes a length of video for people, e.g. "12:05"
+func formatSeconds(seconds float64) string {
+	total := int(math.Ceil(seconds))
+	if total >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", total/3600, total%3600/60, total%60)
+	}
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/config"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type RefreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"` // Seconds until the access token expires
+}
+
+func refreshTokenTTL() time.Duration {
+	return time.Duration(config.AppConfig.Security.RefreshTokenTTL) * time.Second
+}
+
+// startSession signs a user in on a new device, returning an access token and
+// the refresh token that renews it
+func startSession(c *gin.Context, user *models.User) (*RefreshResponse, error) {
+	refreshToken, err := auth.NewOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:               uuid.New().String(),
+		UserID:           user.ID,
+		RefreshTokenHash: auth.HashOpaqueToken(refreshToken),
+		UserAgent:        c.Request.UserAgent(),
+		IPAddress:        c.ClientIP(),
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(refreshTokenTTL()),
+	}
+	if err := db.CreateSession(session); err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &RefreshResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// resumeDeviceSession signs an anonymous user back in with their device
+// token. The device is the account's only one, so its latest session is
+// reused rather than a new one started on every call; no refresh token is
+// sent, since the device token can get another access token the same way.
+func resumeDeviceSession(c *gin.Context, user *models.User) (*RefreshResponse, error) {
+	sessions, err := db.GetActiveSessionsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return startSession(c, user)
+	}
+	session := sessions[0]
+	if err := db.TouchSession(session.ID); err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &RefreshResponse{
+		Token:     token,
+		ExpiresIn: int64(auth.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// refreshHandler trades a refresh token for a new access token and a new
+// refresh token. Each refresh token works once; presenting one that has
+// already been rotated out means it was stolen, so the session is revoked.
+func refreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenHash := auth.HashOpaqueToken(req.RefreshToken)
+	session, err := db.GetSessionByRefreshToken(tokenHash)
+	if err != nil {
+		if reused, err := db.GetSessionByPreviousRefreshToken(tokenHash); err == nil {
+			slog.WarnContext(c.Request.Context(), "Refresh token reuse detected, revoking session", "session_id", reused.ID, "user_id", reused.UserID)
+			if err := db.RevokeSession(reused.ID); err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to revoke session", "session_id", reused.ID, "error", err)
+			}
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if !session.Active() {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Session has been revoked or expired"})
+		return
+	}
+
+	user, err := db.GetUserByID(session.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		return
+	}
+	if user.Disabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	refreshToken, err := auth.NewOpaqueToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	rotated, err := db.RotateSessionRefreshToken(session, auth.HashOpaqueToken(refreshToken), time.Now().Add(refreshTokenTTL()))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to rotate refresh token", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	if !rotated {
+		// Another refresh used the same token first, so it has been presented twice
+		slog.WarnContext(c.Request.Context(), "Refresh token reuse detected, revoking session", "session_id", session.ID, "user_id", session.UserID)
+		if err := db.RevokeSession(session.ID); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to revoke session", "session_id", session.ID, "error", err)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Email, user.Role, session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RefreshResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL().Seconds()),
+	})
+}
+
+// logoutHandler revokes the session the caller's token belongs to
+func logoutHandler(c *gin.Context) {
+	sessionID, exists := c.Get("sessionID")
+	if !exists || sessionID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	if err := db.RevokeSession(sessionID.(string)); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke session", "session_id", sessionID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// listSessionsHandler lists the devices the caller is signed in on
+func listSessionsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	sessions, err := db.GetActiveSessionsByUserID(userID.(string))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch sessions", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	currentID, _ := c.Get("sessionID")
+	for _, session := range sessions {
+		session.Current = session.ID == currentID
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// revokeSessionHandler signs one of the caller's devices out
+func revokeSessionHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	session, err := db.GetSessionByID(c.Param("id"))
+	if err != nil || session.UserID != userID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := db.RevokeSession(session.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke session", "session_id", session.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditSessionRevoke, TargetType: "session", TargetID: session.ID})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
@@ -303,6 +303,13 @@ create_env_file() {
 PORT=8080
 HOST=localhost
 
+# Logging (LOG_LEVEL: debug, info, warn or error; LOG_FORMAT: text or json)
+LOG_LEVEL=info
+LOG_FORMAT=text
+
+# Bearer token required to scrape /metrics (not served when unset)
+# METRICS_TOKEN=
+
 # Database Configuration
 DB_TYPE=sqlite
 DB_PATH=./database/clipflow.db
@@ -315,20 +322,97 @@ UPLOADS_DIR=./uploads
 # Security
 JWT_SECRET=your-super-secret-jwt-key-change-this-in-production
 SESSION_SECRET=your-session-secret-change-this-in-production
+PUBLIC_DOWNLOADS=false
+DOWNLOAD_URL_EXPIRY=3600
+ACCESS_TOKEN_TTL=900
+REFRESH_TOKEN_TTL=2592000
+
+# Login throttling
+LOGIN_FREE_ATTEMPTS=3
+LOGIN_IP_FREE_ATTEMPTS=10
+LOGIN_BACKOFF_BASE=1
+LOGIN_BACKOFF_MAX=300
+LOGIN_LOCKOUT_THRESHOLD=10
+LOGIN_IP_LOCKOUT_THRESHOLD=50
+LOGIN_LOCKOUT_DURATION=900
+LOGIN_ATTEMPT_WINDOW=3600
+
+# Comma-separated emails promoted to admin once verified
+# ADMIN_EMAILS=
+
+# Lifetime of workspace invitations in seconds
+WORKSPACE_INVITATION_TTL=604800
+
+# Rate limits, as requests per window in seconds (0 turns a limit off)
+RATE_LIMIT_AUTH=20
+RATE_LIMIT_AUTH_WINDOW=60
+RATE_LIMIT_API=300
+RATE_LIMIT_API_WINDOW=60
+RATE_LIMIT_UPLOAD=30
+RATE_LIMIT_UPLOAD_WINDOW=60
+RATE_LIMIT_RENDER=10
+RATE_LIMIT_RENDER_WINDOW=60
+MAX_ACTIVE_TASKS=3
+# Reverse proxies allowed to set X-Forwarded-For
+# TRUSTED_PROXIES=127.0.0.1
+
+# Default per-user quotas (0 for no limit); admins can override them per user
+QUOTA_STORAGE_BYTES=5368709120
+QUOTA_MAX_OUTPUT_SECONDS=1800
+QUOTA_RENDER_MINUTES=300
+
+# Retention janitor, periods in seconds (0 keeps files forever)
+JANITOR_INTERVAL=3600
+JANITOR_DRY_RUN=false
+RETENTION_ANONYMOUS_OUTPUTS=604800
+RETENTION_ANONYMOUS_UPLOADS=604800
+RETENTION_OUTPUTS=0
+RETENTION_UPLOADS=0
+RETENTION_TEMP=86400
+# Files no asset or task refers to; uploads from before the asset library
+# have no asset, so run JANITOR_DRY_RUN=true first before turning this on
+RETENTION_ORPHANS=0
+RETENTION_TRASH=2592000
+RETENTION_LOGIN_RECORDS=7776000
+
+# Mail (log, file or smtp). log only notes the recipient and subject; use
+# file in development to open the links, which are written to MAIL_FILE_DIR
+PUBLIC_URL=http://localhost:8080
+MAIL_BACKEND=log
+MAIL_FROM=Clipflow <no-reply@clipflow.local>
+# SMTP_HOST=smtp.example.com
+# SMTP_PORT=587
+# SMTP_USERNAME=
+# SMTP_PASSWORD=
+PASSWORD_RESET_TTL=3600
+EMAIL_VERIFICATION_TTL=604800
+
+# Single sign-on through an OpenID Connect provider (Optional)
+# OIDC_ISSUER_URL=https://accounts.example.com
+# OIDC_CLIENT_ID=clipflow
+# OIDC_CLIENT_SECRET=
+# OIDC_SCOPES=openid,email,profile
+# OIDC_PROVIDER_NAME=SSO
 
 # External Services (Optional)
 # FIREBASE_PROJECT_ID=your-firebase-project-id
 # FIREBASE_PRIVATE_KEY=your-firebase-private-key
 # FIREBASE_CLIENT_EMAIL=your-firebase-client-email
 
-# Logging
-LOG_LEVEL=info
-LOG_FILE=./logs/clipflow.log
-
 # Video Processing
-MAX_FILE_SIZE=100MB
-ALLOWED_VIDEO_FORMATS=mp4,avi,mov,wmv,flv,webm
-ALLOWED_AUDIO_FORMATS=mp3,wav,aac,ogg,flac
+MAX_FILE_SIZE=104857600
+MAX_VIDEO_SIZE=104857600
+MAX_AUDIO_SIZE=20971520
+MAX_IMAGE_SIZE=10485760
+MAX_SUBTITLE_SIZE=1048576
+ALLOWED_VIDEO_FORMATS=mp4,avi,mov,wmv,flv,webm,mkv,m4v
+ALLOWED_AUDIO_FORMATS=mp3,wav,aac,ogg,flac,m4a,opus
+ALLOWED_IMAGE_FORMATS=jpg,jpeg,png,gif,webp
+ALLOWED_SUBTITLE_FORMATS=srt,vtt,ass,ssa
+
+# URL imports: timeout in seconds, and private CIDRs they may still fetch from
+IMPORT_TIMEOUT=600
+# IMPORT_ALLOWED_NETWORKS=
 EOF
     
     print_success "Environment file created: .env"
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateShareRequest struct {
+	ExpiresIn     int64  `json:"expires_in"` // Seconds until the link expires, 0 for never
+	Password      string `json:"password"`
+	AllowDownload bool   `json:"allow_download"`
+}
+
+// watchPage is the data rendered into watch.html
+type watchPage struct {
+	ShareID       string
+	Title         string
+	PageURL       string
+	ImageURL      string
+	VideoURL      string
+	DownloadURL   string
+	AllowDownload bool
+	NeedsPassword bool
+	WrongPassword bool
+	Throttled     bool // Too many wrong passwords, try again later
+	Unavailable   bool
+}
+
+// shareThrottleKey is what password guesses at a share link are throttled by,
+// in place of the email a login is throttled by
+func shareThrottleKey(shareID string) string {
+	return "share:" + shareID
+}
+
+// newShareID returns a short, unguessable ID for use in watch URLs
+func newShareID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func createShareHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req CreateShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresIn < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must not be negative"})
+		return
+	}
+
+	task, ok := getAccessibleTask(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+	if task.Type != "render" || task.Status != "completed" || task.OutputFile == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only completed renders can be shared"})
+		return
+	}
+
+	shareID, err := newShareID()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to generate share ID", "task_id", task.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	share := &models.ShareLink{
+		ID:            shareID,
+		TaskID:        task.ID,
+		UserID:        task.UserID,
+		AllowDownload: req.AllowDownload,
+		CreatedAt:     time.Now(),
+	}
+	if req.ExpiresIn > 0 {
+		expiresAt := share.CreatedAt.Add(time.Duration(req.ExpiresIn) * time.Second)
+		share.ExpiresAt = &expiresAt
+	}
+	if req.Password != "" {
+		share.PasswordHash, err = auth.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process password"})
+			return
+		}
+		share.HasPassword = true
+	}
+
+	if err := db.CreateShareLink(share); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create share link", "task_id", task.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "Created share link", "share_id", share.ID, "task_id", task.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditShareCreate, TargetType: "share", TargetID: share.ID, Details: map[string]string{"task_id": task.ID}})
+	share.URL = "/watch/" + share.ID
+	c.JSON(http.StatusCreated, share)
+}
+
+func listSharesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	task, ok := getAccessibleTask(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	shares, err := db.GetShareLinksByTaskID(task.ID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch share links", "task_id", task.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share links"})
+		return
+	}
+	for _, share := range shares {
+		share.URL = "/watch/" + share.ID
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+func revokeShareHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	task, ok := getAccessibleTask(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	share, err := db.GetShareLinkByID(c.Param("shareId"))
+	if err != nil || share.TaskID != task.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+
+	if err := db.RevokeShareLink(share.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke share link", "share_id", share.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditShareRevoke, TargetType: "share", TargetID: share.ID, Details: map[string]string{"task_id": task.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked successfully"})
+}
+
+// watchHandler renders the public watch page for a share link. Password
+// protected links show a form that posts the password back here.
+func watchHandler(c *gin.Context) {
+	tmpl, err := template.ParseFiles("./watch.html")
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to load watch.html", "error", err)
+		c.String(http.StatusInternalServerError, "Error loading watch page")
+		return
+	}
+
+	baseURL := publicBaseURL()
+	page := watchPage{
+		ShareID:  c.Param("shareId"),
+		Title:    "Clipflow video",
+		PageURL:  baseURL + "/watch/" + c.Param("shareId"),
+		ImageURL: baseURL + "/clipflow-logo.svg",
+	}
+	render := func(status int) {
+		c.Status(status)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		c.Header("Cache-Control", "no-store")
+		if err := tmpl.Execute(c.Writer, page); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to render watch page", "share_id", page.ShareID, "error", err)
+		}
+	}
+
+	share, err := db.GetShareLinkByID(page.ShareID)
+	if err != nil {
+		page.Unavailable = true
+		render(http.StatusNotFound)
+		return
+	}
+	task, err := db.GetTaskByID(share.TaskID)
+	if err != nil || task.OutputFile == "" || task.DeletedAt != nil {
+		page.Unavailable = true
+		render(http.StatusNotFound)
+		return
+	}
+	if !share.Active() {
+		page.Unavailable = true
+		render(http.StatusGone)
+		return
+	}
+
+	if share.HasPassword {
+		page.NeedsPassword = true
+		password, submitted := c.GetPostForm("password")
+		if !submitted {
+			render(http.StatusOK)
+			return
+		}
+
+		// Guesses are throttled like logins, per share link and IP address
+		guard := guardLogin(shareThrottleKey(share.ID), c.ClientIP(), c.Request.UserAgent())
+		defer guard.Close()
+		if wait := guard.RetryAfter(); wait > 0 {
+			guard.Fail("", models.LoginFailureThrottled)
+			c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			page.Throttled = true
+			render(http.StatusTooManyRequests)
+			return
+		}
+		if !auth.CheckPassword(password, share.PasswordHash) {
+			guard.Fail("", models.LoginFailureWrongSharePassword)
+			page.WrongPassword = true
+			render(http.StatusUnauthorized)
+			return
+		}
+		guard.Succeed()
+		page.NeedsPassword = false
+	}
+
+	// The player gets a link that can't be turned into a download by adding
+	// download=1, so that allow_download is enforced by the signature
+	videoURL, err := url.Parse(baseURL + signedDownloadURL(task.OutputFile, true))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to build video URL", "share_id", share.ID, "error", err)
+		c.String(http.StatusInternalServerError, "Error loading watch page")
+		return
+	}
+	page.VideoURL = videoURL.String()
+	page.AllowDownload = share.AllowDownload
+	if share.AllowDownload {
+		downloadURL, err := url.Parse(baseURL + signedDownloadURL(task.OutputFile, false))
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to build download URL", "share_id", share.ID, "error", err)
+			c.String(http.StatusInternalServerError, "Error loading watch page")
+			return
+		}
+		query := downloadURL.Query()
+		query.Set("download", "1")
+		downloadURL.RawQuery = query.Encode()
+		page.DownloadURL = downloadURL.String()
+	}
+
+	if err := db.IncrementShareViews(share.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count share link view", "share_id", share.ID, "error", err)
+	}
+
+	render(http.StatusOK)
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Local stores objects as files under a directory
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	return &Local{dir: dir}, nil
+}
+
+// Path returns the file backing a key. Invalid keys map to the storage root,
+// which no object can occupy.
+func (l *Local) Path(key string) string {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return l.dir
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(cleaned))
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if _, err := cleanKey(key); err != nil {
+		return err
+	}
+	dst := l.Path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put_*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to store file: %v", err)
+	}
+	return nil
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	info, err := l.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(l.Path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+func (l *Local) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if _, err := cleanKey(key); err != nil {
+		return nil, ErrNotFound
+	}
+	info, err := os.Stat(l.Path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if _, err := cleanKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(l.Path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List walks the storage directory, reporting keys with forward slashes
+func (l *Local) List(ctx context.Context, fn func(*ObjectInfo) error) error {
+	return filepath.WalkDir(l.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(l.dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(&ObjectInfo{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+func (l *Local) PresignGet(ctx context.Context, key string, expiry time.Duration, disposition string) (string, error) {
+	return "", ErrPresignNotSupported
+}
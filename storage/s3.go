@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3-compatible backend (AWS S3, MinIO, R2, ...)
+type S3Config struct {
+	Endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // Prepended to every key, e.g. "uploads/"
+	PathStyle bool   // Address the bucket as endpoint/bucket (needed for MinIO)
+}
+
+// S3 stores objects in an S3-compatible bucket, signing requests with AWS
+// Signature Version 4
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3MaxPresignTime = 7 * 24 * time.Hour
+)
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint: %s", cfg.Endpoint)
+	}
+	// No overall timeout, since uploads and downloads stream whole files, but
+	// a backend that stops answering doesn't hold a request forever
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}}
+	return &S3{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+// objectURL builds the URL of an object, using path-style or virtual-hosted
+// addressing as configured
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.bucketURL("/" + s.cfg.Prefix + cleaned), nil
+}
+
+// bucketURL builds the URL of a path within the bucket
+func (s *S3) bucketURL(objectPath string) *url.URL {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		objectPath = "/" + s.cfg.Bucket + objectPath
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+func (s *S3) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs and sends a request, turning S3 error responses into errors
+func (s *S3) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotModified {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s failed: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := s.newRequest(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &s3Object{s3: s, ctx: ctx, key: key, size: info.Size}, info, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	info := &ObjectInfo{Key: key, Size: resp.ContentLength}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	return info, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response that List reads
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through the objects under the prefix with ListObjectsV2
+func (s *S3) List(ctx context.Context, fn func(*ObjectInfo) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+	for {
+		u := s.bucketURL("/")
+		u.RawQuery = canonicalQuery(query)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read S3 object list: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			key := strings.TrimPrefix(object.Key, s.cfg.Prefix)
+			if key == "" || strings.HasSuffix(key, "/") {
+				continue
+			}
+			if err := fn(&ObjectInfo{Key: key, Size: object.Size, ModTime: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3) PresignGet(ctx context.Context, key string, expiry time.Duration, disposition string) (string, error) {
+	if expiry <= 0 || expiry > s3MaxPresignTime {
+		expiry = s3MaxPresignTime
+	}
+	return s.presignGet(key, expiry, disposition, time.Now().UTC())
+}
+
+func (s *S3) presignGet(key string, expiry time.Duration, disposition string, now time.Time) (string, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.credentialScope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if disposition != "" {
+		query.Set("response-content-disposition", disposition)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedBody,
+	}, "\n")
+	signature := s.signature(now, canonicalRequest)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// sign adds SigV4 Authorization headers to a request. Bodies are sent unsigned
+// so large files can be streamed without hashing them first, unless the
+// request already carries its payload hash.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = s3UnsignedBody
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, s.credentialScope(now), signedHeaders, s.signature(now, canonicalRequest)))
+}
+
+func (s *S3) credentialScope(now time.Time) string {
+	return now.Format(s3DateFormat) + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(now time.Time, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		s.credentialScope(now),
+		hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query parameters sorted by name, as SigV4 requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except RFC 3986 unreserved characters
+// (and '/' unless encodeSlash is set), matching what SigV4 expects
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Object reads an object lazily with ranged GETs so it can be seeked, which
+// lets http.ServeContent answer Range requests for proxied downloads
+type s3Object struct {
+	s3     *S3
+	ctx    context.Context
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.s3.newRequest(o.ctx, http.MethodGet, o.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		resp, err := o.s3.do(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.offset + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if target < 0 {
+		return 0, errors.New("negative position")
+	}
+	if target != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
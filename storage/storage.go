@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when an object doesn't exist
+	ErrNotFound = errors.New("object not found")
+
+	// ErrPresignNotSupported is returned by backends that can't hand out direct
+	// download URLs; their files have to be proxied through the server
+	ErrPresignNotSupported = errors.New("presigned URLs not supported by this storage backend")
+)
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage stores uploads and rendered outputs. Keys are slash-separated
+// relative paths such as "20231201_100000_abcd1234.mp4".
+type Storage interface {
+	// Put stores the content of r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+
+	// Get opens an object for reading. The reader supports seeking so it can
+	// be served with Range requests.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, *ObjectInfo, error)
+
+	// Stat returns an object's metadata, or ErrNotFound
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+
+	// Delete removes an object. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// PresignGet returns a URL that downloads the object directly from the
+	// backend until expiry, or ErrPresignNotSupported. A non-empty disposition
+	// is sent back as the response's Content-Disposition header.
+	PresignGet(ctx context.Context, key string, expiry time.Duration, disposition string) (string, error)
+}
+
+// Lister is implemented by backends that can enumerate their objects, so files
+// that nothing refers to any more can be found and removed
+type Lister interface {
+	// List calls fn for every object, stopping at the first error
+	List(ctx context.Context, fn func(*ObjectInfo) error) error
+}
+
+// localPather is implemented by backends whose objects are plain local files
+type localPather interface {
+	Path(key string) string
+}
+
+// cleanKey normalizes a key and stops it from escaping its storage root
+func cleanKey(key string) (string, error) {
+	cleaned := strings.TrimPrefix(path.Clean("/"+key), "/")
+	if cleaned == "" || cleaned == "." {
+		return "", fmt.Errorf("invalid storage key: %q", key)
+	}
+	return cleaned, nil
+}
+
+// PutFile stores a local file under key. Files are moved rather than copied
+// when the backend is the local filesystem; otherwise the local file is
+// removed once uploaded.
+func PutFile(ctx context.Context, s Storage, key, localPath string) error {
+	if local, ok := s.(localPather); ok {
+		dst := local.Path(key)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %v", err)
+		}
+		if err := os.Rename(localPath, dst); err == nil {
+			return nil
+		}
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %v", err)
+	}
+	if err := s.Put(ctx, key, f, info.Size()); err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(localPath)
+}
+
+// Localize makes an object available as a local file for tools like ffmpeg.
+// Objects on the local filesystem are used in place; anything else is
+// downloaded into tempDir. The returned cleanup function removes the copy.
+func Localize(ctx context.Context, s Storage, key, tempDir string) (string, func(), error) {
+	if local, ok := s.(localPather); ok {
+		localPath := local.Path(key)
+		if _, err := os.Stat(localPath); err != nil {
+			if os.IsNotExist(err) {
+				return "", nil, ErrNotFound
+			}
+			return "", nil, err
+		}
+		return localPath, func() {}, nil
+	}
+
+	src, _, err := s.Get(ctx, key)
+	if err != nil {
+		return "", nil, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+	dst, err := os.CreateTemp(tempDir, "fetch_*_"+path.Base(key))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", nil, fmt.Errorf("failed to download %s: %v", key, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", nil, err
+	}
+	return dst.Name(), func() { os.Remove(dst.Name()) }, nil
+}
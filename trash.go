@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"clipflow/config"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TrashedTask is a task in the trash, with when the janitor will delete it
+type TrashedTask struct {
+	*models.Task
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// TrashedAsset is an asset in the trash, with when the janitor will delete it
+type TrashedAsset struct {
+	*models.Asset
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+type TrashResponse struct {
+	Tasks  []TrashedTask  `json:"tasks"`
+	Assets []TrashedAsset `json:"assets"`
+}
+
+// purgeAt returns when the janitor empties an item deleted at the given time
+// from the trash, or nil if the trash is kept forever
+func purgeAt(deletedAt *time.Time) *time.Time {
+	retention := config.AppConfig.Retention.Trash
+	if deletedAt == nil || retention <= 0 {
+		return nil
+	}
+	at := deletedAt.Add(time.Duration(retention) * time.Second)
+	return &at
+}
+
+// getTrashedItem loads the task or asset named in the URL, which must be in the
+// trash and editable by the caller, writing the error response itself when it
+// isn't. Exactly one of the results is set when ok. API keys need the scope
+// that deleting the item needed: render for tasks, upload for assets.
+func getTrashedItem(c *gin.Context, userID string) (*models.Task, *models.Asset, bool) {
+	id := c.Param("id")
+	if task, err := db.GetTaskByID(id); err == nil && task.DeletedAt != nil {
+		if !canManageTrashed(c, userID, task.UserID, task.WorkspaceID, models.ScopeRender) {
+			return nil, nil, false
+		}
+		return task, nil, true
+	}
+	if asset, err := db.GetAssetByID(id); err == nil && asset.DeletedAt != nil {
+		if !canManageTrashed(c, userID, asset.UserID, asset.WorkspaceID, models.ScopeUpload) {
+			return nil, nil, false
+		}
+		return nil, asset, true
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Item not found in the trash"})
+	return nil, nil, false
+}
+
+// canManageTrashed checks that the caller may restore or purge an item, and
+// that an API key has the given scope, writing the error response itself
+func canManageTrashed(c *gin.Context, userID, ownerID, workspaceID, scope string) bool {
+	if value, exists := c.Get("apiKey"); exists && !value.(*models.APIKey).HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("API key lacks the %s scope", scope)})
+		return false
+	}
+	if !canAccess(userID, ownerID, workspaceID, models.WorkspaceEditor) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+	return true
+}
+
+// listTrashHandler lists the tasks and assets in the caller's trash, or in a
+// workspace's with ?workspace_id=
+func listTrashHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	tasks, err := db.GetTrashedTasks(userID.(string), workspaceID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch trashed tasks", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trash"})
+		return
+	}
+	assets, err := db.GetTrashedAssets(userID.(string), workspaceID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch trashed assets", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trash"})
+		return
+	}
+
+	response := TrashResponse{Tasks: make([]TrashedTask, 0, len(tasks)), Assets: make([]TrashedAsset, 0, len(assets))}
+	for _, task := range tasks {
+		response.Tasks = append(response.Tasks, TrashedTask{Task: task, PurgeAt: purgeAt(task.DeletedAt)})
+	}
+	for _, asset := range assets {
+		response.Assets = append(response.Assets, TrashedAsset{Asset: asset, PurgeAt: purgeAt(asset.DeletedAt)})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// restoreTrashHandler takes a task or asset back out of the trash
+func restoreTrashHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	task, asset, ok := getTrashedItem(c, userID.(string))
+	if !ok {
+		return
+	}
+
+	if task != nil {
+		if err := db.RestoreTask(task.ID); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to restore task", "task_id", task.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore task"})
+			return
+		}
+		recordAudit(c, models.AuditEvent{Action: models.AuditTrashRestore, TargetType: "task", TargetID: task.ID})
+		task.DeletedAt = nil
+		withTaskDownloadURLs(task)
+		c.JSON(http.StatusOK, gin.H{"task": task})
+		return
+	}
+
+	if err := db.RestoreAsset(asset.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to restore asset", "asset_id", asset.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore asset"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditTrashRestore, TargetType: "asset", TargetID: asset.ID})
+	asset.DeletedAt = nil
+	withAssetDownloadURLs(asset)
+	c.JSON(http.StatusOK, gin.H{"asset": asset})
+}
+
+// purgeTrashHandler deletes a task or asset in the trash for good. Its file is
+// left for the janitor to delete on its next run.
+func purgeTrashHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	task, asset, ok := getTrashedItem(c, userID.(string))
+	if !ok {
+		return
+	}
+
+	if task != nil {
+		if err := db.PurgeTask(task.ID, outputKey(task)); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to purge task", "task_id", task.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge task"})
+			return
+		}
+		recordAudit(c, models.AuditEvent{Action: models.AuditTrashPurge, TargetType: "task", TargetID: task.ID})
+		c.JSON(http.StatusOK, gin.H{"message": "Task deleted permanently"})
+		return
+	}
+
+	if err := db.PurgeAsset(asset.ID, asset.StoredName); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to purge asset", "asset_id", asset.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge asset"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditTrashPurge, TargetType: "asset", TargetID: asset.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Asset deleted permanently"})
+}
+
+// emptyTrashHandler deletes everything in the caller's trash for good, or in a
+// workspace's with ?workspace_id=
+func emptyTrashHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	tasks, err := db.GetTrashedTasks(userID.(string), workspaceID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch trashed tasks", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+		return
+	}
+	assets, err := db.GetTrashedAssets(userID.(string), workspaceID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch trashed assets", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+		return
+	}
+
+	for _, task := range tasks {
+		if err := db.PurgeTask(task.ID, outputKey(task)); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to purge task", "task_id", task.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+			return
+		}
+		recordAudit(c, models.AuditEvent{Action: models.AuditTrashPurge, TargetType: "task", TargetID: task.ID})
+	}
+	for _, asset := range assets {
+		if err := db.PurgeAsset(asset.ID, asset.StoredName); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to purge asset", "asset_id", asset.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+			return
+		}
+		recordAudit(c, models.AuditEvent{Action: models.AuditTrashPurge, TargetType: "asset", TargetID: asset.ID})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Trash emptied", "tasks": len(tasks), "assets": len(assets)})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"clipflow/config"
+	"clipflow/models"
+	"clipflow/storage"
+	"clipflow/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Resumable uploads following the tus 1.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, checksum and termination extensions. Chunks are appended to a
+// partial file in TempDir; once the last byte arrives the file is moved into
+// upload storage and registered as an asset exactly like a regular upload.
+
+const (
+	tusVersion                = "1.0.0"
+	tusExtensions             = "creation,checksum,termination"
+	tusChecksumAlgorithms     = "md5,sha1,sha256"
+	statusTusChecksumMismatch = 460 // Defined by the tus checksum extension
+	tusOffsetOctetStream      = "application/offset+octet-stream"
+)
+
+// errUploadRejected marks a finished upload whose content failed validation
+var errUploadRejected = errors.New("upload rejected")
+
+// tusLocks serializes PATCH requests per upload so two clients can't append at once
+var tusLocks = &keyedMutex{locks: make(map[string]*refMutex)}
+
+func tusPartPath(id string) string {
+	return filepath.Join(config.AppConfig.File.TempDir, "uploads", id+".part")
+}
+
+// requireTusVersion rejects requests from clients speaking another protocol version
+func requireTusVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header ("key base64value,key2 base64value")
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+		if parts[0] == "" {
+			return nil, errors.New("empty metadata key")
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for metadata key %s", parts[0])
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
+
+// parseTusChecksum parses an Upload-Checksum header ("sha1 base64digest")
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("malformed Upload-Checksum header")
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New("invalid checksum encoding")
+	}
+	switch parts[0] {
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported checksum algorithm: %s", parts[0])
+}
+
+// getOwnedUploadSession loads an upload session and checks that it belongs to the
+// caller, aborting with the appropriate status when it doesn't
+func getOwnedUploadSession(c *gin.Context) (*models.UploadSession, bool) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return nil, false
+	}
+	upload, err := db.GetUploadSession(c.Param("id"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	if upload.UserID != userID {
+		c.AbortWithStatus(http.StatusForbidden)
+		return nil, false
+	}
+	return upload, true
+}
+
+func setTusUploadHeaders(c *gin.Context, upload *models.UploadSession) {
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Cache-Control", "no-store")
+	if upload.AssetID != "" {
+		if asset, err := db.GetAssetByID(upload.AssetID); err == nil {
+			c.Header("Clipflow-Asset-Id", asset.ID)
+			c.Header("Clipflow-Asset-Url", asset.URL)
+		}
+	}
+}
+
+func tusOptionsHandler(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	c.Header("Tus-Max-Size", strconv.FormatInt(utils.MaxUploadSize(), 10))
+	c.Status(http.StatusNoContent)
+}
+
+func tusCreateHandler(c *gin.Context) {
+	if !requireTusVersion(c) {
+		return
+	}
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspaceID, ok := workspaceScope(c, userID.(string), models.WorkspaceEditor)
+	if !ok {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length header must be a non-negative integer"})
+		return
+	}
+	if length > utils.MaxUploadSize() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload exceeds maximum size"})
+		return
+	}
+
+	metadata, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filename := filepath.Base(metadata["filename"])
+	if metadata["filename"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename metadata is required"})
+		return
+	}
+	if _, err := utils.ValidateUpload(filename, length); err != nil {
+		slog.WarnContext(c.Request.Context(), "Resumable upload rejected", "filename", filename, "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkStorageQuota(c, userID.(string), length) {
+		return
+	}
+
+	upload := &models.UploadSession{
+		ID:          uuid.New().String(),
+		UserID:      userID.(string),
+		WorkspaceID: workspaceID,
+		Filename:    filename,
+		ContentType: metadata["filetype"],
+		Length:      length,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	partPath := tusPartPath(upload.ID)
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create resumable upload directory", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	f, err := os.Create(partPath)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create partial file", "upload_id", upload.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	f.Close()
+
+	if err := db.CreateUploadSession(upload); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create upload session", "user_id", userID, "error", err)
+		os.Remove(partPath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	// An empty file is complete as soon as it is created
+	if length == 0 {
+		if err := completeTusUpload(c, upload); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to finalize upload", "upload_id", upload.ID, "error", err)
+			if errors.Is(err, errUploadRejected) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+			return
+		}
+	}
+
+	slog.InfoContext(c.Request.Context(), "Created resumable upload", "upload_id", upload.ID, "user_id", userID, "filename", filename, "length", length)
+	setTusUploadHeaders(c, upload)
+	c.Header("Location", "/api/uploads/tus/"+upload.ID)
+	c.Status(http.StatusCreated)
+}
+
+func tusHeadHandler(c *gin.Context) {
+	if !requireTusVersion(c) {
+		return
+	}
+	upload, ok := getOwnedUploadSession(c)
+	if !ok {
+		return
+	}
+	setTusUploadHeaders(c, upload)
+	c.Status(http.StatusOK)
+}
+
+func tusPatchHandler(c *gin.Context) {
+	if !requireTusVersion(c) {
+		return
+	}
+	if c.ContentType() != tusOffsetOctetStream {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	upload, ok := getOwnedUploadSession(c)
+	if !ok {
+		return
+	}
+
+	unlock := tusLocks.Lock(upload.ID)
+	defer unlock()
+
+	// Reload under the lock in case a concurrent PATCH just moved the offset
+	upload, err := db.GetUploadSession(upload.ID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		setTusUploadHeaders(c, upload)
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+	remaining := upload.Length - upload.Offset
+	if c.Request.ContentLength > remaining {
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var checksum hash.Hash
+	var expected []byte
+	if header := c.GetHeader("Upload-Checksum"); header != "" {
+		checksum, expected, err = parseTusChecksum(header)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	f, err := os.OpenFile(tusPartPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to open partial file", "upload_id", upload.ID, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Drop any bytes past the committed offset left over from an interrupted request
+	if err := f.Truncate(upload.Offset); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to truncate partial file", "upload_id", upload.ID, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to seek partial file", "upload_id", upload.ID, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var w io.Writer = f
+	if checksum != nil {
+		w = io.MultiWriter(f, checksum)
+	}
+	written, copyErr := io.Copy(w, io.LimitReader(c.Request.Body, remaining))
+
+	if checksum != nil {
+		if copyErr != nil || string(checksum.Sum(nil)) != string(expected) {
+			// A chunk with a checksum is all or nothing
+			f.Truncate(upload.Offset)
+			if copyErr != nil {
+				slog.WarnContext(c.Request.Context(), "Resumable upload interrupted", "upload_id", upload.ID, "error", copyErr)
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			slog.WarnContext(c.Request.Context(), "Resumable upload rejected chunk - checksum mismatch", "upload_id", upload.ID, "offset", upload.Offset)
+			c.AbortWithStatus(statusTusChecksumMismatch)
+			return
+		}
+	}
+
+	// Without a checksum, keep whatever arrived so the client can resume from there
+	upload.Offset += written
+	if err := db.UpdateUploadSession(upload); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to update upload session", "upload_id", upload.ID, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		slog.WarnContext(c.Request.Context(), "Resumable upload interrupted", "upload_id", upload.ID, "offset", upload.Offset, "error", copyErr)
+		setTusUploadHeaders(c, upload)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if upload.Offset == upload.Length && upload.AssetID == "" {
+		f.Close()
+		if err := completeTusUpload(c, upload); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to finalize upload", "upload_id", upload.ID, "error", err)
+			if errors.Is(err, errUploadRejected) {
+				c.String(http.StatusBadRequest, err.Error())
+				return
+			}
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Resumable upload completed", "upload_id", upload.ID, "filename", upload.Filename)
+	}
+
+	setTusUploadHeaders(c, upload)
+	c.Status(http.StatusNoContent)
+}
+
+func tusDeleteHandler(c *gin.Context) {
+	if !requireTusVersion(c) {
+		return
+	}
+	upload, ok := getOwnedUploadSession(c)
+	if !ok {
+		return
+	}
+
+	unlock := tusLocks.Lock(upload.ID)
+	defer unlock()
+
+	if err := db.DeleteUploadSession(upload.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete upload session", "upload_id", upload.ID, "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(tusPartPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(c.Request.Context(), "Failed to remove partial file", "upload_id", upload.ID, "error", err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// completeTusUpload moves a fully received file into upload storage and registers
+// it as an asset, the same way uploadFileHandler does for a single-request upload.
+// Files whose content doesn't check out are deleted along with their session.
+func completeTusUpload(c *gin.Context, upload *models.UploadSession) error {
+	partPath := tusPartPath(upload.ID)
+	reject := func(err error) error {
+		utils.CleanupFile(partPath)
+		db.DeleteUploadSession(upload.ID)
+		return fmt.Errorf("%w: %v", errUploadRejected, err)
+	}
+
+	assetType, err := utils.ValidateUpload(upload.Filename, upload.Length)
+	if err != nil {
+		return reject(err)
+	}
+	if err := utils.VerifyMediaFile(c.Request.Context(), partPath, assetType); err != nil {
+		return reject(err)
+	}
+
+	// PutFile moves or deletes the part file, so measure it first
+	duration := probeMediaDuration(c.Request.Context(), partPath, assetType)
+
+	ctx := context.Background()
+	ext := filepath.Ext(upload.Filename)
+	storedName := utils.GenerateStoredName(ext)
+	if err := storage.PutFile(ctx, uploadStore, storedName, partPath); err != nil {
+		return err
+	}
+
+	asset, err := registerAsset(upload.UserID, upload.WorkspaceID, assetType, &utils.FileInfo{
+		OriginalName: upload.Filename,
+		StoredName:   storedName,
+		FileType:     ext,
+		Size:         upload.Length,
+		Duration:     duration,
+	})
+	if err != nil {
+		uploadStore.Delete(ctx, storedName)
+		return err
+	}
+
+	recordAudit(c, uploadAuditEvent(asset, "tus"))
+	uploadedBytes.Add(float64(asset.Size), "tus")
+
+	upload.AssetID = asset.ID
+	return db.UpdateUploadSession(upload)
+}
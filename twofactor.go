@@ -0,0 +1,379 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer         = "Clipflow"
+	recoveryCodeCount  = 10
+	twoFactorChallenge = 5 * time.Minute // How long a login has to answer with a code
+)
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int64  `json:"expires_in"` // Seconds until the challenge token expires
+}
+
+type VerifyTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"` // TOTP or recovery code
+	MergeAnonymous bool   `json:"merge_anonymous"`
+}
+
+type EnableTwoFactorRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ConfirmTwoFactorRequest re-authenticates the user before 2FA is turned off
+// or its recovery codes are replaced
+type ConfirmTwoFactorRequest struct {
+	Password string `json:"password"`                // Not needed by accounts that only sign in through SSO
+	Code     string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+// startTwoFactorChallenge answers a correct password for an account with 2FA.
+// The challenge token is traded for a session at /api/login/2fa.
+func startTwoFactorChallenge(c *gin.Context, user *models.User) {
+	if user.Disabled() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	token, err := issueUserToken(user.ID, models.TokenTwoFactorChallenge, twoFactorChallenge)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create 2FA challenge", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TwoFactorChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresIn:         int64(twoFactorChallenge.Seconds()),
+	})
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code.
+// Either works only once.
+func checkSecondFactor(user *models.User, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return false, nil
+	}
+
+	if step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		return db.UseTOTPStep(user.ID, step)
+	}
+
+	used, err := db.UseRecoveryCode(user.ID, auth.HashOpaqueToken(auth.NormalizeRecoveryCode(code)))
+	if used {
+		slog.Info("User used a recovery code", "user_id", user.ID)
+	}
+	return used, err
+}
+
+// newRecoveryCodes generates a fresh set of recovery codes, returning them for
+// the user along with the hashed records to store
+func newRecoveryCodes(userID string) ([]string, []*models.RecoveryCode, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]*models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := auth.NewRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		records = append(records, &models.RecoveryCode{
+			ID:        uuid.New().String(),
+			UserID:    userID,
+			CodeHash:  auth.HashOpaqueToken(auth.NormalizeRecoveryCode(code)),
+			CreatedAt: time.Now(),
+		})
+	}
+	return codes, records, nil
+}
+
+// verifyTwoFactorHandler finishes a login for an account with 2FA. Wrong codes
+// count as failed logins, so guessing runs into the same backoff and lockout.
+func verifyTwoFactorHandler(c *gin.Context) {
+	var req VerifyTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenHash := auth.HashOpaqueToken(req.ChallengeToken)
+	challenge, err := db.GetUserToken(tokenHash, models.TokenTwoFactorChallenge)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+	user, err := db.GetUserByID(challenge.UserID)
+	if err != nil || !user.TOTPEnabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+
+	guard := guardLogin(user.Email, c.ClientIP(), c.Request.UserAgent())
+	defer guard.Close()
+	if wait := guard.RetryAfter(); wait > 0 {
+		guard.Fail(user.ID, models.LoginFailureThrottled)
+		respondLoginThrottled(c, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(user, req.Code)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to check 2FA code", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		guard.Fail(user.ID, models.LoginFailureWrongCode)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// The challenge works once, even if two requests raced with the same code
+	if _, err := db.ConsumeUserToken(tokenHash, models.TokenTwoFactorChallenge); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge, please log in again"})
+		return
+	}
+	guard.Succeed()
+
+	completeLogin(c, user, req.MergeAnonymous)
+}
+
+// getTwoFactorUser loads the caller for the 2FA management endpoints, which
+// need an account with a password
+func getTwoFactorUser(c *gin.Context) (*models.User, bool) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return nil, false
+	}
+
+	user, err := db.GetUserByID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	}
+	if user.IsAnonymous() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Anonymous accounts can't use two-factor authentication, claim the account first"})
+		return nil, false
+	}
+	return user, true
+}
+
+// confirmTwoFactorChange checks the password and a second factor before 2FA
+// settings change, so that a stolen session alone can't weaken the account.
+// Accounts that only sign in through SSO have no password, so for them the
+// second factor has to do.
+func confirmTwoFactorChange(c *gin.Context, user *models.User, req ConfirmTwoFactorRequest) bool {
+	guard := guardLogin(user.Email, c.ClientIP(), c.Request.UserAgent())
+	defer guard.Close()
+	if wait := guard.RetryAfter(); wait > 0 {
+		guard.Fail(user.ID, models.LoginFailureThrottled)
+		respondLoginThrottled(c, wait)
+		return false
+	}
+
+	if user.PasswordHash != "" && !auth.CheckPassword(req.Password, user.PasswordHash) {
+		guard.Fail(user.ID, models.LoginFailureWrongPassword)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return false
+	}
+	ok, err := checkSecondFactor(user, req.Code)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to check 2FA code", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return false
+	}
+	if !ok {
+		guard.Fail(user.ID, models.LoginFailureWrongCode)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return false
+	}
+	guard.Succeed()
+	return true
+}
+
+func getTwoFactorStatusHandler(c *gin.Context) {
+	user, ok := getTwoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	remaining := 0
+	if user.TOTPEnabled {
+		var err error
+		remaining, err = db.CountRecoveryCodes(user.ID)
+		if err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to count recovery codes", "user_id", user.ID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": user.TOTPEnabled, "recovery_codes_remaining": remaining})
+}
+
+// setupTwoFactorHandler starts enrollment with a new secret. Calling it again
+// before confirming replaces the secret.
+func setupTwoFactorHandler(c *gin.Context) {
+	user, ok := getTwoFactorUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+	if err := db.SetTOTPSecret(user.ID, secret); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to store TOTP secret", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start two-factor setup"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": auth.TOTPProvisioningURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// enableTwoFactorHandler turns 2FA on once the user proves their authenticator
+// produces the right codes, and hands out recovery codes. Other sessions are
+// signed out, since they were started without a second factor.
+func enableTwoFactorHandler(c *gin.Context) {
+	user, ok := getTwoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	var req EnableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(user.TOTPSecret, strings.TrimSpace(req.Code), time.Now())
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code, check your authenticator app's clock"})
+		return
+	}
+	if _, err := db.UseTOTPStep(user.ID, step); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to record TOTP step", "user_id", user.ID, "error", err)
+	}
+
+	codes, records, err := newRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if err := db.EnableTOTP(user.ID, records); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to enable 2FA", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	if err := db.RevokeOtherUserSessions(user.ID, c.GetString("sessionID")); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke other sessions", "user_id", user.ID, "error", err)
+	}
+
+	slog.InfoContext(c.Request.Context(), "User enabled two-factor authentication", "user_id", user.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditTwoFactorEnable, TargetType: "user", TargetID: user.ID})
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "Two-factor authentication enabled. Store these recovery codes somewhere safe, they are only shown once.",
+		"recovery_codes": codes,
+	})
+}
+
+func disableTwoFactorHandler(c *gin.Context) {
+	user, ok := getTwoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	var req ConfirmTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !confirmTwoFactorChange(c, user, req) {
+		return
+	}
+
+	if err := db.DisableTOTP(user.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to disable 2FA", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "User disabled two-factor authentication", "user_id", user.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditTwoFactorDisable, TargetType: "user", TargetID: user.ID})
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// regenerateRecoveryCodesHandler replaces all recovery codes, used or not
+func regenerateRecoveryCodesHandler(c *gin.Context) {
+	user, ok := getTwoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	var req ConfirmTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !confirmTwoFactorChange(c, user, req) {
+		return
+	}
+
+	codes, records, err := newRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	if err := db.ReplaceRecoveryCodes(user.ID, records); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to replace recovery codes", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditRecoveryCodesReplace, TargetType: "user", TargetID: user.ID})
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin
+
+package utils
+
+import "syscall"
+
+// FreeDiskSpace returns how many bytes are free for unprivileged users on the
+// filesystem holding path
+func FreeDiskSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package utils
+
+import "errors"
+
+// FreeDiskSpace is only supported on Linux and macOS
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
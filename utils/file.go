@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"mime/multipart"
 	"os"
@@ -8,36 +9,137 @@ import (
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
-)
+	"clipflow/storage"
 
-const (
-	MaxFileSize = 100 * 1024 * 1024 // 100MB
+	"github.com/google/uuid"
 )
 
 var (
-	AllowedVideoFormats = []string{".mp4", ".avi", ".mov", ".wmv", ".flv", ".webm"}
-	AllowedAudioFormats = []string{".mp3", ".wav", ".aac", ".ogg", ".flac"}
+	// MaxFileSize is the hard cap for any upload, whatever its type
+	MaxFileSize int64 = 100 * 1024 * 1024 // 100MB
+
+	// MaxFileSizes holds the size limit for each type of upload
+	MaxFileSizes = map[string]int64{
+		"video":    100 * 1024 * 1024, // 100MB
+		"audio":    20 * 1024 * 1024,  // 20MB
+		"image":    10 * 1024 * 1024,  // 10MB
+		"subtitle": 1024 * 1024,       // 1MB
+	}
+
+	AllowedVideoFormats    = []string{".mp4", ".avi", ".mov", ".wmv", ".flv", ".webm", ".mkv", ".m4v"}
+	AllowedAudioFormats    = []string{".mp3", ".wav", ".aac", ".ogg", ".flac", ".m4a", ".opus"}
+	AllowedImageFormats    = []string{".jpg", ".jpeg", ".png", ".gif", ".webp"}
+	AllowedSubtitleFormats = []string{".srt", ".vtt", ".ass", ".ssa"}
 )
 
+// UploadLimits configures the upload size limits and allowed formats. Zero
+// sizes and empty format lists keep the built-in defaults.
+type UploadLimits struct {
+	MaxSize                int64
+	MaxSizes               map[string]int64
+	AllowedVideoFormats    []string
+	AllowedAudioFormats    []string
+	AllowedImageFormats    []string
+	AllowedSubtitleFormats []string
+}
+
+// SetUploadLimits replaces the default upload limits (typically from config)
+func SetUploadLimits(limits UploadLimits) {
+	if limits.MaxSize > 0 {
+		MaxFileSize = limits.MaxSize
+	}
+	for fileType, size := range limits.MaxSizes {
+		if size > 0 {
+			MaxFileSizes[fileType] = size
+		}
+	}
+	if len(limits.AllowedVideoFormats) > 0 {
+		AllowedVideoFormats = normalizeFormats(limits.AllowedVideoFormats)
+	}
+	if len(limits.AllowedAudioFormats) > 0 {
+		AllowedAudioFormats = normalizeFormats(limits.AllowedAudioFormats)
+	}
+	if len(limits.AllowedImageFormats) > 0 {
+		AllowedImageFormats = normalizeFormats(limits.AllowedImageFormats)
+	}
+	if len(limits.AllowedSubtitleFormats) > 0 {
+		AllowedSubtitleFormats = normalizeFormats(limits.AllowedSubtitleFormats)
+	}
+}
+
+// normalizeFormats lower-cases extensions and adds the leading dot if missing
+func normalizeFormats(formats []string) []string {
+	normalized := make([]string, 0, len(formats))
+	for _, format := range formats {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		if !strings.HasPrefix(format, ".") {
+			format = "." + format
+		}
+		normalized = append(normalized, format)
+	}
+	return normalized
+}
+
+// MaxSizeFor returns the size limit for a type of upload, never above MaxFileSize
+func MaxSizeFor(fileType string) int64 {
+	if size, ok := MaxFileSizes[fileType]; ok && size < MaxFileSize {
+		return size
+	}
+	return MaxFileSize
+}
+
+// MaxUploadSize returns the largest size any single upload may have
+func MaxUploadSize() int64 {
+	var largest int64
+	for fileType := range MaxFileSizes {
+		if size := MaxSizeFor(fileType); size > largest {
+			largest = size
+		}
+	}
+	return largest
+}
+
+// AllowedFormatsFor returns the allowed extensions for a type of upload
+func AllowedFormatsFor(fileType string) []string {
+	switch fileType {
+	case "video":
+		return AllowedVideoFormats
+	case "audio":
+		return AllowedAudioFormats
+	case "image":
+		return AllowedImageFormats
+	case "subtitle":
+		return AllowedSubtitleFormats
+	}
+	return nil
+}
+
 // FileInfo represents information about an uploaded file
 type FileInfo struct {
 	OriginalName string
-	StoredName   string
-	FilePath     string
+	StoredName   string // Storage key of the saved file
 	FileType     string
 	Size         int64
+	Duration     float64 // Seconds of video or audio, 0 if unknown
 }
 
 // ValidateFile checks if a file is valid for upload
 func ValidateFile(file *multipart.FileHeader, allowedFormats []string) error {
+	return ValidateFileName(file.Filename, file.Size, allowedFormats)
+}
+
+// ValidateFileName checks a file's name and size against the upload limits
+func ValidateFileName(filename string, size int64, allowedFormats []string) error {
 	// Check file size
-	if file.Size > MaxFileSize {
+	if size > MaxFileSize {
 		return fmt.Errorf("file size exceeds maximum allowed size of %d bytes", MaxFileSize)
 	}
 
 	// Check file extension
-	ext := strings.ToLower(filepath.Ext(file.Filename))
+	ext := strings.ToLower(filepath.Ext(filename))
 	allowed := false
 	for _, format := range allowedFormats {
 		if ext == format {
@@ -53,26 +155,11 @@ func ValidateFile(file *multipart.FileHeader, allowedFormats []string) error {
 	return nil
 }
 
-// SaveFile saves an uploaded file to the specified directory
-func SaveFile(file *multipart.FileHeader, uploadDir string) (*FileInfo, error) {
+// SaveFile saves an uploaded file to storage under a newly generated unique name
+func SaveFile(ctx context.Context, file *multipart.FileHeader, store storage.Storage) (*FileInfo, error) {
 	// Generate unique filename
 	ext := filepath.Ext(file.Filename)
-	uniqueName := fmt.Sprintf("%s_%s%s",
-		time.Now().Format("20060102_150405"),
-		uuid.New().String()[:8],
-		ext)
-
-	filePath := filepath.Join(uploadDir, uniqueName)
-
-	// Create directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create upload directory: %v", err)
-	}
-
-	// Save the file
-	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %v", err)
-	}
+	uniqueName := GenerateStoredName(ext)
 
 	src, err := file.Open()
 	if err != nil {
@@ -80,48 +167,74 @@ func SaveFile(file *multipart.FileHeader, uploadDir string) (*FileInfo, error) {
 	}
 	defer src.Close()
 
-	dst, err := os.Create(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create destination file: %v", err)
-	}
-	defer dst.Close()
-
-	// Copy file content
-	if _, err := dst.ReadFrom(src); err != nil {
+	if err := store.Put(ctx, uniqueName, src, file.Size); err != nil {
 		return nil, fmt.Errorf("failed to save file: %v", err)
 	}
 
 	return &FileInfo{
 		OriginalName: file.Filename,
 		StoredName:   uniqueName,
-		FilePath:     filePath,
 		FileType:     ext,
 		Size:         file.Size,
 	}, nil
 }
 
+// GenerateStoredName returns a unique name for a file stored in the uploads directory
+func GenerateStoredName(ext string) string {
+	return fmt.Sprintf("%s_%s%s",
+		time.Now().Format("20060102_150405"),
+		uuid.New().String()[:8],
+		ext)
+}
+
 // CleanupFile removes a file from the filesystem
 func CleanupFile(filePath string) error {
 	return os.Remove(filePath)
 }
 
-// GetFileType determines if a file is video or audio based on extension
+// GetFileType determines if a file is video, audio, image or subtitle based on extension
 func GetFileType(filename string) string {
 	ext := strings.ToLower(filepath.Ext(filename))
 
-	for _, format := range AllowedVideoFormats {
-		if ext == format {
-			return "video"
+	for _, fileType := range []string{"video", "audio", "image", "subtitle"} {
+		for _, format := range AllowedFormatsFor(fileType) {
+			if ext == format {
+				return fileType
+			}
 		}
 	}
 
-	for _, format := range AllowedAudioFormats {
-		if ext == format {
-			return "audio"
-		}
+	return "unknown"
+}
+
+// ValidateUpload checks an incoming file against the allowed formats and the
+// size limit for its type, returning that type. The file's content is verified
+// separately once it has been saved.
+func ValidateUpload(filename string, size int64) (string, error) {
+	fileType := GetFileType(filename)
+	if fileType == "unknown" {
+		return "", fmt.Errorf("unsupported file type")
 	}
 
-	return "unknown"
+	if maxSize := MaxSizeFor(fileType); size > maxSize {
+		label := strings.ToUpper(fileType[:1]) + fileType[1:]
+		return "", fmt.Errorf("%s file too large (max %s)", label, FormatSize(maxSize))
+	}
+
+	return fileType, nil
+}
+
+// FormatSize renders a byte count for error messages, e.g. "100MB"
+func FormatSize(size int64) string {
+	switch {
+	case size >= 1024*1024*1024 && size%(1024*1024*1024) == 0:
+		return fmt.Sprintf("%dGB", size/(1024*1024*1024))
+	case size >= 1024*1024 && size%(1024*1024) == 0:
+		return fmt.Sprintf("%dMB", size/(1024*1024))
+	case size >= 1024 && size%1024 == 0:
+		return fmt.Sprintf("%dKB", size/1024)
+	}
+	return fmt.Sprintf("%d bytes", size)
 }
 
 // ValidateVideoFile validates a video file
@@ -0,0 +1,118 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+// probeStreamKinds maps each upload type to the ffprobe stream type it must contain
+var probeStreamKinds = map[string]string{
+	"video":    "video",
+	"audio":    "audio",
+	"image":    "video", // ffprobe reports still images as a single video frame
+	"subtitle": "subtitle",
+}
+
+// probeTimeout bounds each ffprobe run, so a file crafted to make it hang
+// can't hold an upload or render forever
+const probeTimeout = 30 * time.Second
+
+// DetectMediaKind sniffs a file's magic bytes and reports whether it holds
+// "video", "audio", "image" or "subtitle" content, along with the detected MIME type
+func DetectMediaKind(filePath string) (string, string, error) {
+	mime, err := mimetype.DetectFile(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read file: %v", err)
+	}
+
+	switch {
+	case strings.HasPrefix(mime.String(), "video/"):
+		return "video", mime.String(), nil
+	case strings.HasPrefix(mime.String(), "audio/"):
+		return "audio", mime.String(), nil
+	case strings.HasPrefix(mime.String(), "image/"):
+		return "image", mime.String(), nil
+	case mime.Is("application/x-subrip"), strings.HasPrefix(mime.String(), "text/"):
+		// SRT, VTT and ASS are plain text; ffprobe decides whether they parse
+		return "subtitle", mime.String(), nil
+	}
+	return "unknown", mime.String(), nil
+}
+
+// ProbeStreams runs ffprobe on a file and returns the codec type of each stream
+func ProbeStreams(ctx context.Context, filePath string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "stream=codec_type", "-of", "csv=p=0", filePath)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var streams []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			streams = append(streams, line)
+		}
+	}
+	return streams, nil
+}
+
+// ProbeDuration runs ffprobe on a file and returns its length in seconds
+func ProbeDuration(ctx context.Context, filePath string) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "csv=p=0", filePath)
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration: %v", err)
+	}
+	return duration, nil
+}
+
+// VerifyMediaFile checks that a saved file's content really is the expected kind
+// of media: the magic bytes must match and ffprobe must find at least one stream
+// of that kind
+func VerifyMediaFile(ctx context.Context, filePath, expectedKind string) error {
+	kind, mime, err := DetectMediaKind(filePath)
+	if err != nil {
+		return err
+	}
+	if kind != expectedKind {
+		return fmt.Errorf("file content (%s) does not match an allowed %s format", mime, expectedKind)
+	}
+
+	streams, err := ProbeStreams(ctx, filePath)
+	if err != nil {
+		return fmt.Errorf("file could not be read as %s: %v", expectedKind, err)
+	}
+	for _, stream := range streams {
+		if stream == probeStreamKinds[expectedKind] {
+			return nil
+		}
+	}
+	return fmt.Errorf("file contains no %s stream", probeStreamKinds[expectedKind])
+}
+
+// DetectExtension sniffs a file's magic bytes and returns the usual extension
+// for its content (e.g. ".mp4"), or "" if the format isn't recognized
+func DetectExtension(filePath string) (string, error) {
+	mime, err := mimetype.DetectFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	return mime.Extension(), nil
+}
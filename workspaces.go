@@ -0,0 +1,550 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"clipflow/auth"
+	"clipflow/config"
+	"clipflow/mail"
+	"clipflow/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type WorkspaceRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type CreateInvitationRequest struct {
+	Email string `json:"email" binding:"omitempty,email"` // Empty for a link anyone can use
+	Role  string `json:"role" binding:"required"`
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// WorkspaceResponse is a workspace with its members
+type WorkspaceResponse struct {
+	*models.Workspace
+	Members []*models.WorkspaceMember `json:"members"`
+}
+
+// InvitationResponse includes the invitation link, which is only shown once
+type InvitationResponse struct {
+	*models.WorkspaceInvitation
+	Token string `json:"token"`
+	URL   string `json:"url"`
+}
+
+// workspaceScope returns the workspace named by the workspace_id query
+// parameter, after checking the caller has at least the given role in it. An
+// empty ID means the caller's own tasks and assets outside any workspace. It
+// writes the error response itself when the caller lacks access.
+func workspaceScope(c *gin.Context, userID, role string) (string, bool) {
+	workspaceID := c.Query("workspace_id")
+	if workspaceID == "" {
+		return "", true
+	}
+	if _, ok := requireWorkspaceRole(c, workspaceID, userID, role); !ok {
+		return "", false
+	}
+	return workspaceID, true
+}
+
+// requireWorkspaceRole checks the caller has at least the given role in a
+// workspace and returns their actual role. Workspaces the caller doesn't
+// belong to are reported as not found.
+func requireWorkspaceRole(c *gin.Context, workspaceID, userID, role string) (string, bool) {
+	memberRole, err := db.GetWorkspaceRole(workspaceID, userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.ErrorContext(c.Request.Context(), "Failed to check workspace membership", "user_id", userID, "workspace_id", workspaceID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check workspace access"})
+			return "", false
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return "", false
+	}
+	if !models.WorkspaceRoleAtLeast(memberRole, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("This requires the %s role in the workspace", role)})
+		return "", false
+	}
+	return memberRole, true
+}
+
+// canAccess reports whether a user may act on a task or asset with at least
+// the given workspace role. Outside a workspace only its creator may.
+func canAccess(userID, ownerID, workspaceID, role string) bool {
+	if workspaceID == "" {
+		return userID == ownerID
+	}
+	memberRole, err := db.GetWorkspaceRole(workspaceID, userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Failed to check workspace membership", "user_id", userID, "workspace_id", workspaceID, "error", err)
+		}
+		return false
+	}
+	return models.WorkspaceRoleAtLeast(memberRole, role)
+}
+
+// getRegisteredUser loads the caller, who needs a registered account to use
+// workspaces
+func getRegisteredUser(c *gin.Context) (*models.User, bool) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return nil, false
+	}
+
+	user, err := db.GetUserByID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	}
+	if user.IsAnonymous() {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Anonymous accounts can't use workspaces, claim the account first"})
+		return nil, false
+	}
+	return user, true
+}
+
+func createWorkspaceHandler(c *gin.Context) {
+	user, ok := getRegisteredUser(c)
+	if !ok {
+		return
+	}
+
+	var req WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must not be blank"})
+		return
+	}
+
+	now := time.Now()
+	workspace := &models.Workspace{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedBy: user.ID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := db.CreateWorkspace(workspace); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create workspace", "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workspace"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "User created workspace", "user_id", user.ID, "workspace_id", workspace.ID)
+	c.JSON(http.StatusCreated, workspace)
+}
+
+func listWorkspacesHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspaces, err := db.GetWorkspacesByUserID(userID.(string))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch workspaces", "user_id", userID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspaces"})
+		return
+	}
+
+	c.JSON(http.StatusOK, workspaces)
+}
+
+func getWorkspaceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceViewer)
+	if !ok {
+		return
+	}
+
+	members, err := db.GetWorkspaceMembers(workspace.ID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch workspace members", "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WorkspaceResponse{Workspace: workspace, Members: members})
+}
+
+// getMemberWorkspace loads the workspace named in the URL after checking the
+// caller's role in it, writing the error response itself when that fails
+func getMemberWorkspace(c *gin.Context, userID, role string) (*models.Workspace, bool) {
+	memberRole, ok := requireWorkspaceRole(c, c.Param("id"), userID, role)
+	if !ok {
+		return nil, false
+	}
+	workspace, err := db.GetWorkspaceByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found"})
+		return nil, false
+	}
+	workspace.Role = memberRole
+	return workspace, true
+}
+
+func renameWorkspaceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req WorkspaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must not be blank"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	if err := db.RenameWorkspace(workspace.ID, name); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to rename workspace", "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename workspace"})
+		return
+	}
+	workspace.Name = name
+	workspace.UpdatedAt = time.Now()
+
+	c.JSON(http.StatusOK, workspace)
+}
+
+// deleteWorkspaceHandler deletes a workspace. Its tasks and assets aren't
+// lost; each goes back to the user who created it.
+func deleteWorkspaceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	if err := db.DeleteWorkspace(workspace.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to delete workspace", "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete workspace"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "User deleted workspace", "user_id", userID, "workspace_id", workspace.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Workspace deleted successfully"})
+}
+
+func updateMemberHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	var req UpdateMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.ValidWorkspaceRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, editor or viewer"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+	memberID := c.Param("userId")
+	memberRole, ok := getMemberRole(c, workspace.ID, memberID)
+	if !ok {
+		return
+	}
+	if memberRole == models.WorkspaceOwner && req.Role != models.WorkspaceOwner && !keepsAnOwner(c, workspace.ID) {
+		return
+	}
+
+	if err := db.SetWorkspaceMemberRole(workspace.ID, memberID, req.Role); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to set workspace member role", "member_id", memberID, "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditWorkspaceMemberUpdate, TargetType: "workspace", TargetID: workspace.ID, Details: map[string]string{"user_id": memberID, "role": req.Role, "previous_role": memberRole}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member updated successfully", "role": req.Role})
+}
+
+// removeMemberHandler removes someone from a workspace. Owners can remove
+// anyone; everyone else can only leave.
+func removeMemberHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	memberID := c.Param("userId")
+	required := models.WorkspaceOwner
+	if memberID == userID {
+		required = models.WorkspaceViewer
+	}
+	workspace, ok := getMemberWorkspace(c, userID.(string), required)
+	if !ok {
+		return
+	}
+	memberRole, ok := getMemberRole(c, workspace.ID, memberID)
+	if !ok {
+		return
+	}
+	if memberRole == models.WorkspaceOwner && !keepsAnOwner(c, workspace.ID) {
+		return
+	}
+
+	if err := db.RemoveWorkspaceMember(workspace.ID, memberID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to remove workspace member", "member_id", memberID, "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+
+	slog.InfoContext(c.Request.Context(), "User removed workspace member", "user_id", userID, "member_id", memberID, "workspace_id", workspace.ID)
+	recordAudit(c, models.AuditEvent{Action: models.AuditWorkspaceMemberRemove, TargetType: "workspace", TargetID: workspace.ID, Details: map[string]string{"user_id": memberID, "role": memberRole}})
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+}
+
+func getMemberRole(c *gin.Context, workspaceID, memberID string) (string, bool) {
+	role, err := db.GetWorkspaceRole(workspaceID, memberID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return "", false
+	}
+	return role, true
+}
+
+// keepsAnOwner checks that a workspace has another owner before one stops
+// being an owner, writing the error response itself when it doesn't
+func keepsAnOwner(c *gin.Context, workspaceID string) bool {
+	owners, err := db.CountWorkspaceOwners(workspaceID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to count workspace owners", "workspace_id", workspaceID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member"})
+		return false
+	}
+	if owners <= 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs at least one owner; make someone else an owner or delete the workspace"})
+		return false
+	}
+	return true
+}
+
+// createInvitationHandler invites someone by email, or creates a link anyone
+// can use to join when no email is given
+func createInvitationHandler(c *gin.Context) {
+	user, ok := getRegisteredUser(c)
+	if !ok {
+		return
+	}
+
+	var req CreateInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !models.ValidWorkspaceRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, editor or viewer"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, user.ID, models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	token, err := auth.NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to generate invitation token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+	now := time.Now()
+	ttl := time.Duration(config.AppConfig.Security.WorkspaceInvitationTTL) * time.Second
+	invitation := &models.WorkspaceInvitation{
+		ID:          uuid.New().String(),
+		WorkspaceID: workspace.ID,
+		Email:       strings.ToLower(strings.TrimSpace(req.Email)),
+		Role:        req.Role,
+		TokenHash:   auth.HashOpaqueToken(token),
+		InvitedBy:   user.ID,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+	}
+	if err := db.CreateWorkspaceInvitation(invitation); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to create invitation", "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+		return
+	}
+
+	link := publicBaseURL() + "/?invitation=" + token
+	if invitation.Email != "" {
+		sendMail(mail.Message{
+			To:      invitation.Email,
+			Subject: fmt.Sprintf("%s invited you to %s on Clipflow", user.Username, workspace.Name),
+			Body: fmt.Sprintf("Hi,\n\n%s invited you to join the %q workspace on Clipflow as %s %s. "+
+				"Sign in with this email address and open this link to accept:\n\n%s\n\nThe link expires in %s.\n",
+				user.Username, workspace.Name, articleFor(invitation.Role), invitation.Role, link, formatTTL(ttl)),
+		})
+	}
+
+	slog.InfoContext(c.Request.Context(), "User invited to workspace", "user_id", user.ID, "email", invitation.Email, "workspace_id", workspace.ID, "role", invitation.Role)
+	recordAudit(c, models.AuditEvent{Action: models.AuditWorkspaceInvite, TargetType: "workspace", TargetID: workspace.ID, Details: map[string]string{"invitation_id": invitation.ID, "email": invitation.Email, "role": invitation.Role}})
+	c.JSON(http.StatusCreated, InvitationResponse{
+		WorkspaceInvitation: invitation,
+		Token:               token,
+		URL:                 link,
+	})
+}
+
+// articleFor returns "an" or "a" for the word that follows
+func articleFor(word string) string {
+	if word != "" && strings.ContainsRune("aeiou", rune(word[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+func listInvitationsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	invitations, err := db.GetActiveWorkspaceInvitations(workspace.ID)
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to fetch invitations", "workspace_id", workspace.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+func revokeInvitationHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists || userID == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: userID required in token"})
+		return
+	}
+
+	workspace, ok := getMemberWorkspace(c, userID.(string), models.WorkspaceOwner)
+	if !ok {
+		return
+	}
+
+	invitation, err := db.GetWorkspaceInvitationByID(c.Param("invitationId"))
+	if err != nil || invitation.WorkspaceID != workspace.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	}
+
+	if err := db.RevokeWorkspaceInvitation(invitation.ID); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to revoke invitation", "invitation_id", invitation.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invitation"})
+		return
+	}
+	recordAudit(c, models.AuditEvent{Action: models.AuditWorkspaceInviteRevoke, TargetType: "workspace", TargetID: workspace.ID, Details: map[string]string{"invitation_id": invitation.ID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation revoked successfully"})
+}
+
+// acceptInvitationHandler adds the caller to the workspace an invitation is
+// for. Email invitations only work for a verified account with that email.
+func acceptInvitationHandler(c *gin.Context) {
+	user, ok := getRegisteredUser(c)
+	if !ok {
+		return
+	}
+
+	var req AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, err := db.GetWorkspaceInvitationByToken(auth.HashOpaqueToken(req.Token))
+	if err != nil || !invitation.Active() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+		return
+	}
+	if invitation.Email != "" {
+		if !strings.EqualFold(invitation.Email, user.Email) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invitation is for a different email address"})
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address before accepting this invitation"})
+			return
+		}
+	}
+
+	role, err := db.AcceptWorkspaceInvitation(invitation, user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired invitation"})
+			return
+		}
+		slog.ErrorContext(c.Request.Context(), "Failed to accept invitation", "invitation_id", invitation.ID, "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+		return
+	}
+
+	workspace, err := db.GetWorkspaceByID(invitation.WorkspaceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch workspace"})
+		return
+	}
+	workspace.Role = role
+
+	slog.InfoContext(c.Request.Context(), "User joined workspace", "user_id", user.ID, "workspace_id", workspace.ID, "role", role)
+	recordAudit(c, models.AuditEvent{Action: models.AuditWorkspaceJoin, TargetType: "workspace", TargetID: workspace.ID, Details: map[string]string{"invitation_id": invitation.ID, "role": role}})
+	c.JSON(http.StatusOK, workspace)
+}